@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The agent keeps volumes mounted between runs, like ssh-agent keeps keys,
+// so that short commands don't ask for the password, and don't derive the
+// key again, on every run. It listens on a Unix socket in the state dir.
+// After 'emount run' mounts a volume, it asks the agent to hold it. The
+// agent joins the mount as one more emount process using it (see
+// mountstate.go), so the next 'emount run' shares the mount, and the volume
+// stays mounted after the command exits. The agent releases a volume when
+// its lifetime has passed, with 'emount lock', or when the agent exits, and
+// a volume run with --lock-on-suspend when the session is locked or the
+// system suspends (see logind.go). The agent never sees the password.
+
+const (
+	agentSocketName = "agent.sock"
+
+	// defaultAgentLifetime is how long the agent holds a volume, unless
+	// set with --lifetime or agent_lifetime in the config file
+	defaultAgentLifetime = time.Hour
+
+	// agentStartTimeout is how long emount agent waits for the agent it
+	// started in the background to listen
+	agentStartTimeout = 5 * time.Second
+
+	// agent operations
+	agentHold = "hold"
+	agentLock = "lock"
+)
+
+// errNoAgent is returned by callAgent if no agent is running
+var errNoAgent = errors.New("no emount agent is running")
+
+// agentRequest is a request to the agent, one JSON line
+type agentRequest struct {
+	Op          string `json:"op"`                      // agentHold or agentLock
+	Cipher      string `json:"cipher,omitempty"`        // absolute path of the volume
+	MountPoint  string `json:"mountPoint,omitempty"`    // where it's mounted, for hold
+	All         bool   `json:"all,omitempty"`           // lock all volumes
+	LockSuspend bool   `json:"lockOnSuspend,omitempty"` // hold with --lock-on-suspend
+}
+
+// agentResponse is the agent's response, one JSON line
+type agentResponse struct {
+	Error   string        `json:"error,omitempty"`
+	Volumes []agentVolume `json:"volumes,omitempty"` // held, or released by lock
+}
+
+// agentVolume is a volume held by the agent
+type agentVolume struct {
+	Cipher     string    `json:"cipher"`
+	MountPoint string    `json:"mountPoint"`
+	Expires    time.Time `json:"expires"`             // zero if it's held until locked
+	Unmounted  bool      `json:"unmounted,omitempty"` // unmounted when released
+}
+
+// agent holds volumes mounted
+type agent struct {
+	lifetime time.Duration // 0 holds volumes until they are locked
+
+	mu     sync.Mutex
+	held   map[string]*heldVolume // by absolute path of the volume
+	locker *lockWatcher           // started when a volume is held with lockSuspend
+}
+
+// heldVolume is a volume held by the agent
+type heldVolume struct {
+	mount       *sharedMount
+	expires     time.Time
+	timer       *time.Timer
+	lockSuspend bool // released when the session is locked or suspends
+}
+
+// agentSocketPath returns the path of the agent's socket
+func agentSocketPath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, agentSocketName), nil
+}
+
+// runAgent implements emount agent. Unless foreground is set, the agent
+// is started in the background, and runAgent returns once it's listening.
+func runAgent(lifetime time.Duration, foreground bool, config string) error {
+	path, err := agentSocketPath()
+	if err != nil {
+		return err
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("an emount agent is already running on %s", path)
+	}
+	if !foreground {
+		_, err = startAgent(path, lifetime, config)
+		return err
+	}
+
+	// a socket left by an agent that no longer exists
+	_ = os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("agent: %v", err)
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		_ = l.Close()
+		return err
+	}
+	a := newAgent(lifetime)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	go func() {
+		sig := <-sigs
+		fmt.Printf("emount agent: received %v, releasing the volumes\n", sig)
+		_ = l.Close()
+	}()
+	fmt.Printf("emount agent (pid %d) listening on %s\n", os.Getpid(), path)
+	a.serve(l)
+	a.lock("", true)
+	if a.locker != nil {
+		a.locker.stop()
+	}
+	return nil
+}
+
+// startAgent starts emount agent --foreground in a new session, and waits
+// until it's listening on path. Returns the pid of the agent.
+func startAgent(path string, lifetime time.Duration, config string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	args := []string{"agent", "--foreground", "--lifetime", lifetime.String()}
+	if config != "" {
+		args = append(args, "--config", config)
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = cmd.Start(); err != nil {
+		return 0, fmt.Errorf("starting the agent: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	deadline := time.Now().Add(agentStartTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			return 0, fmt.Errorf("the agent exited (%v). Run 'emount agent "+
+				"--foreground' to see the error", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			fmt.Printf("emount agent started (pid %d), listening on %s\n",
+				cmd.Process.Pid, path)
+			return cmd.Process.Pid, nil
+		}
+	}
+	_ = cmd.Process.Kill()
+	return 0, fmt.Errorf("the agent didn't start within %v", agentStartTimeout)
+}
+
+func newAgent(lifetime time.Duration) *agent {
+	return &agent{
+		lifetime: lifetime,
+		held:     make(map[string]*heldVolume),
+	}
+}
+
+// serve handles connections until the listener is closed
+func (a *agent) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go a.handle(conn)
+	}
+}
+
+// handle answers one request
+func (a *agent) handle(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Minute))
+	var req agentRequest
+	var resp agentResponse
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &req)
+	}
+	if err == nil {
+		switch req.Op {
+		case agentHold:
+			var v agentVolume
+			v, err = a.hold(req.Cipher, req.MountPoint, req.LockSuspend)
+			resp.Volumes = []agentVolume{v}
+		case agentLock:
+			resp.Volumes = a.lock(req.Cipher, req.All)
+		default:
+			err = fmt.Errorf("unknown request %q", req.Op)
+		}
+	}
+	if err != nil {
+		resp = agentResponse{Error: err.Error()}
+	}
+	_ = json.NewEncoder(conn).Encode(&resp)
+}
+
+// hold joins the mount of the volume, which must be mounted by emount,
+// and keeps it mounted for the agent's lifetime. A volume that is already
+// held keeps its expiry time. With lockSuspend, the volume is released when
+// the session is locked or the system suspends. Connecting to logind and
+// locking the volume can block, so they are done without holding a.mu,
+// and the held volumes are checked again after.
+func (a *agent) hold(cipher string, mountPoint string,
+	lockSuspend bool) (agentVolume, error) {
+
+	a.mu.Lock()
+	startLocker := lockSuspend && a.locker == nil
+	a.mu.Unlock()
+	if startLocker {
+		locker, err := watchLock(a.lockSuspended)
+		if err != nil {
+			return agentVolume{}, err
+		}
+		a.mu.Lock()
+		if a.locker == nil {
+			a.locker = locker
+			locker = nil
+		}
+		a.mu.Unlock()
+		if locker != nil {
+			// started by another request meanwhile
+			locker.stop()
+		}
+	}
+
+	a.mu.Lock()
+	v, held := a.joinHeld(cipher, lockSuspend)
+	a.mu.Unlock()
+	if held {
+		return v, nil
+	}
+	mount, err := acquireMountWith(cipher, mountPoint, func(string) (string, error) {
+		return "", fmt.Errorf("%s is not mounted", cipher)
+	})
+	if err != nil {
+		return agentVolume{}, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if v, held := a.joinHeld(cipher, lockSuspend); held {
+		// held by another request meanwhile. The mount state now lists the
+		// agent twice, which is harmless: release removes both entries.
+		return v, nil
+	}
+	h := &heldVolume{mount: mount, lockSuspend: lockSuspend}
+	if a.lifetime > 0 {
+		h.expires = time.Now().Add(a.lifetime)
+		h.timer = time.AfterFunc(a.lifetime, func() {
+			a.lock(cipher, false)
+		})
+	}
+	a.held[cipher] = h
+	fmt.Printf("emount agent: holding %s on %s\n", cipher, mount.mountPoint)
+	return h.info(), nil
+}
+
+// joinHeld returns the volume if it's already held, and releases it on
+// lock or suspend too if lockSuspend is set. a.mu must be held.
+func (a *agent) joinHeld(cipher string, lockSuspend bool) (agentVolume, bool) {
+	h, ok := a.held[cipher]
+	if !ok {
+		return agentVolume{}, false
+	}
+	h.lockSuspend = h.lockSuspend || lockSuspend
+	return h.info(), true
+}
+
+// lock releases the volume, or all volumes, and returns the volumes
+// released. A volume is unmounted, unless an emount process is still
+// running a command on it; then it's unmounted when the last one exits.
+func (a *agent) lock(cipher string, all bool) []agentVolume {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var ciphers []string
+	for c := range a.held {
+		if all || c == cipher {
+			ciphers = append(ciphers, c)
+		}
+	}
+	sort.Strings(ciphers)
+	released := []agentVolume{}
+	for _, c := range ciphers {
+		h := a.held[c]
+		delete(a.held, c)
+		if h.timer != nil {
+			h.timer.Stop()
+		}
+		v := h.info()
+		unmounted, err := h.mount.release()
+		if err != nil {
+			fmt.Printf("emount agent: releasing %s: %v\n", c, err)
+		}
+		v.Unmounted = unmounted
+		fmt.Printf("emount agent: released %s\n", c)
+		released = append(released, v)
+	}
+	return released
+}
+
+// lockSuspended releases the volumes held with lockSuspend, when the
+// session is locked or the system suspends
+func (a *agent) lockSuspended(reason string) {
+	a.mu.Lock()
+	var ciphers []string
+	for c, h := range a.held {
+		if h.lockSuspend {
+			ciphers = append(ciphers, c)
+		}
+	}
+	a.mu.Unlock()
+	if len(ciphers) == 0 {
+		return
+	}
+	fmt.Printf("emount agent: %s, releasing the volumes run with "+
+		"--lock-on-suspend\n", reason)
+	for _, c := range ciphers {
+		a.lock(c, false)
+	}
+}
+
+func (h *heldVolume) info() agentVolume {
+	return agentVolume{
+		Cipher:     h.mount.cipher,
+		MountPoint: h.mount.mountPoint,
+		Expires:    h.expires,
+	}
+}
+
+// callAgent sends the request to the agent, and returns its response.
+// Returns errNoAgent if no agent is listening.
+func callAgent(req *agentRequest) (*agentResponse, error) {
+	path, err := agentSocketPath()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, errNoAgent
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Minute))
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("agent: %v", err)
+	}
+	var resp agentResponse
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("agent: %v", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("agent: %s", resp.Error)
+	}
+	return &resp, nil
+}
+
+// attachAgent asks the agent, if one is running, to hold the volumes
+// mounted for run. With lockSuspend, the agent releases them when the
+// session is locked or the system suspends.
+func attachAgent(mounts []*sharedMount, lockSuspend bool, verbose bool) {
+	for _, m := range mounts {
+		resp, err := callAgent(&agentRequest{Op: agentHold, Cipher: m.cipher,
+			MountPoint: m.mountPoint, LockSuspend: lockSuspend})
+		if err == errNoAgent {
+			return
+		}
+		if err != nil {
+			fmt.Printf("WARNING: %v\n", err)
+			continue
+		}
+		if verbose {
+			v := resp.Volumes[0]
+			if v.Expires.IsZero() {
+				fmt.Printf("The agent keeps %s mounted until it's locked\n", v.Cipher)
+			} else {
+				fmt.Printf("The agent keeps %s mounted until %s\n", v.Cipher,
+					v.Expires.Format("15:04:05"))
+			}
+		}
+	}
+}
+
+// lockVolumes implements emount lock: the agent releases the volume, or
+// all volumes, and they are unmounted
+func lockVolumes(cipher string, all bool) error {
+	if !all {
+		var err error
+		if cipher, err = filepath.Abs(cipher); err != nil {
+			return err
+		}
+	}
+	resp, err := callAgent(&agentRequest{Op: agentLock, Cipher: cipher, All: all})
+	if err != nil {
+		return err
+	}
+	if len(resp.Volumes) == 0 {
+		if all {
+			fmt.Printf("The agent holds no volumes\n")
+			return nil
+		}
+		return fmt.Errorf("%s is not held by the agent", cipher)
+	}
+	for _, v := range resp.Volumes {
+		if v.Unmounted {
+			fmt.Printf("Locked %s\n", v.Cipher)
+		} else {
+			fmt.Printf("Locked %s. It stays mounted on %s until the emount "+
+				"processes using it exit (see 'emount status')\n", v.Cipher,
+				v.MountPoint)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain runs the private mount helper, or the agent, when the test
+// binary is started as one of them by runPrivate or startAgent, and emount
+// when a test starts it with one of testCommands
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && testCommands[os.Args[1]] {
+		os.Exit(run())
+	}
+	os.Exit(m.Run())
+}
+
+// testCommands are the first arguments that make the test binary run emount
+var testCommands = map[string]bool{
+	privateHelperArg: true,
+	"agent":          true,
+	"run":            true,
+	"init":           true,
+	"--init":         true,
+	"export":         true,
+}
+
+func TestAgent(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	cipher, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(cipher)
+	}()
+	okf(t, initCryptVol(cipher, "", nil))
+	runVol := func(noAgent bool) error {
+		opt := &options{}
+		err := parseCommand(opt, []string{"run", cipher, "/bin/true"})
+		if err == nil {
+			opt.noAgent = noAgent
+			err = decryptAndRun(opt)
+		}
+		return err
+	}
+
+	// without an agent, the volume is unmounted when the command exits
+	err = lockVolumes("", true)
+	assert(t, err == errNoAgent, "no agent", err)
+	okf(t, runVol(false))
+	assert(t, sharedMountPoint(cipher) == "", "unmounted", cipher)
+
+	path, err := agentSocketPath()
+	okf(t, err)
+	pid, err := startAgent(path, 500*time.Millisecond, "")
+	okf(t, err)
+	defer func() {
+		_ = syscall.Kill(pid, syscall.SIGTERM)
+	}()
+	err = runAgent(time.Hour, false, "")
+	assert(t, err != nil && strings.Contains(err.Error(), "already running"),
+		"second agent", err)
+
+	// the agent holds the volume, and the next run doesn't need the password
+	okf(t, runVol(false))
+	assert(t, sharedMountPoint(cipher) != "", "held by the agent", cipher)
+	os.Unsetenv("EMOUNT_PASSWORD")
+	okf(t, runVol(false))
+	okf(t, lockVolumes(cipher, false))
+	assert(t, sharedMountPoint(cipher) == "", "locked", cipher)
+	err = lockVolumes(cipher, false)
+	assert(t, err != nil && strings.Contains(err.Error(), "not held"), "not held", err)
+
+	// the volume is unmounted when its lifetime has passed
+	os.Setenv("EMOUNT_PASSWORD", password)
+	okf(t, runVol(false))
+	assert(t, sharedMountPoint(cipher) != "", "held again", cipher)
+	for i := 0; i < 50 && sharedMountPoint(cipher) != ""; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert(t, sharedMountPoint(cipher) == "", "expired", cipher)
+
+	// with --no-agent, the volume is not held
+	okf(t, runVol(true))
+	assert(t, sharedMountPoint(cipher) == "", "--no-agent", cipher)
+
+	// emount unmount asks the agent to release the volume
+	okf(t, runVol(false))
+	okf(t, runUnmount(cipher))
+	assert(t, sharedMountPoint(cipher) == "", "unmount", cipher)
+
+	_, err = callAgent(&agentRequest{Op: "dump"})
+	assert(t, err != nil && strings.Contains(err.Error(), "unknown request"),
+		"invalid request", err)
+	okf(t, syscall.Kill(pid, syscall.SIGTERM))
+	for i := 0; i < 50 && processAlive(pid); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	_, err = os.Stat(path)
+	assert(t, os.IsNotExist(err), "socket removed", err)
+}
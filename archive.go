@@ -0,0 +1,666 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// emount import and export move data between a volume and a tar or zip
+// archive. The volume is mounted as for run, and the entries are streamed
+// between the archive and the mount, so the plaintext is never staged on
+// disk. Compression is gzip, or zstd with the zstd program.
+
+const (
+	formatTar    = "tar"
+	formatTarGz  = "tar.gz"
+	formatTarZst = "tar.zst"
+	formatZip    = "zip"
+
+	// paxXattrPrefix is the prefix of extended attributes in tar PAX records
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+var archiveFormats = []string{formatTar, formatTarGz, formatTarZst, formatZip}
+
+// archiveFormat returns the format of the archive: format if it's not
+// empty, otherwise from the extension of name. "-" is stdin or stdout,
+// a tar archive by default.
+func archiveFormat(name string, format string) (string, error) {
+	if format != "" {
+		for _, f := range archiveFormats {
+			if format == f {
+				return format, nil
+			}
+		}
+		return "", newUsageErr(fmt.Sprintf("invalid --format %q: use one of %s",
+			format, strings.Join(archiveFormats, ", ")))
+	}
+	lower := strings.ToLower(name)
+	switch {
+	case name == "-", strings.HasSuffix(lower, ".tar"):
+		return formatTar, nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return formatTarGz, nil
+	case strings.HasSuffix(lower, ".tar.zst"), strings.HasSuffix(lower, ".tzst"):
+		return formatTarZst, nil
+	case strings.HasSuffix(lower, ".zip"):
+		return formatZip, nil
+	}
+	return "", newUsageErr(fmt.Sprintf("unknown archive type %s: use a .tar, "+
+		".tar.gz, .tar.zst, or .zip file, or --format", name))
+}
+
+// archiveEntry is a file, folder, or link read from an archive
+type archiveEntry struct {
+	name     string // path in the archive
+	mode     os.FileMode
+	mtime    time.Time
+	linkname string // target of a symlink or a hard link
+	hardlink bool
+	xattrs   map[string]string
+}
+
+// extractor writes the entries of an archive into the mounted volume
+type extractor struct {
+	root      string
+	overwrite bool
+	summary   *copySummary
+	progress  *progress
+	dirs      []archiveEntry // folders, to set their mode and time at the end
+}
+
+// volumePath returns the path of the entry in the volume. Names with ".."
+// components, and paths through a symlink in the volume, are rejected, so
+// an archive can't write outside the volume.
+func (x *extractor) volumePath(name string) (string, error) {
+	name = strings.TrimPrefix(filepath.ToSlash(name), "/")
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errors.New("path outside the volume")
+		}
+	}
+	rel := path.Clean(name)
+	if rel == "." {
+		return "", nil
+	}
+	dir := x.root
+	parts := strings.Split(rel, "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		if fi, err := os.Lstat(dir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", errors.New("path through a symlink")
+		}
+	}
+	return filepath.Join(x.root, filepath.FromSlash(rel)), nil
+}
+
+// replace checks whether the entry can be written at path, and removes an
+// existing file if --overwrite was given. An existing folder is kept. It
+// returns false if the entry must be skipped.
+func (x *extractor) replace(path string, e *archiveEntry) (bool, error) {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if e.mode.IsDir() && fi.IsDir() {
+		return true, nil
+	}
+	if !x.overwrite || fi.IsDir() {
+		x.summary.skip("%s: already exists in the volume (use --overwrite)", e.name)
+		return false, nil
+	}
+	return true, os.Remove(path)
+}
+
+// extract writes the entry, with the contents read from r
+func (x *extractor) extract(e *archiveEntry, r io.Reader) error {
+	path, err := x.volumePath(e.name)
+	if err != nil {
+		x.summary.skip("%s: %v", e.name, err)
+		return nil
+	}
+	if path == "" {
+		return nil
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if ok, err := x.replace(path, e); !ok || err != nil {
+		return err
+	}
+	switch {
+	case e.mode.IsDir():
+		err = os.Mkdir(path, 0700)
+		if os.IsExist(err) && !x.overwrite {
+			// a folder already in the volume keeps its mode and time
+			return nil
+		}
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+		x.dirs = append(x.dirs, *e)
+		x.summary.dirs++
+
+	case e.hardlink:
+		target, err := x.volumePath(e.linkname)
+		if err != nil || target == "" {
+			x.summary.skip("%s: invalid hard link to %s", e.name, e.linkname)
+			return nil
+		}
+		if err = os.Link(target, path); err != nil {
+			return err
+		}
+		x.summary.hardlinks++
+		return nil
+
+	case e.mode.IsRegular():
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(io.MultiWriter(f, progressWriter{x.progress}), r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Chmod(path, e.mode.Perm())
+		}
+		if err == nil {
+			err = os.Chtimes(path, time.Now(), e.mtime)
+		}
+		if err != nil {
+			return err
+		}
+		x.summary.files++
+		x.summary.bytes += n
+		x.progress.add(1, 0)
+
+	case e.mode&os.ModeSymlink != 0:
+		if err = os.Symlink(e.linkname, path); err != nil {
+			return err
+		}
+		mtime := unix.NsecToTimeval(e.mtime.UnixNano())
+		_ = unix.Lutimes(path, []unix.Timeval{mtime, mtime})
+		x.summary.symlinks++
+		return nil
+
+	case e.mode&os.ModeNamedPipe != 0:
+		if err = syscall.Mkfifo(path, uint32(e.mode.Perm())); err != nil {
+			x.summary.skip("%s: FIFO not created (%v)", e.name, err)
+			return nil
+		}
+		x.summary.fifos++
+		return nil
+
+	case e.mode&os.ModeDevice != 0:
+		x.summary.skip("%s: device file", e.name)
+		return nil
+	default:
+		x.summary.skip("%s: unsupported entry type", e.name)
+		return nil
+	}
+	for name, value := range e.xattrs {
+		if err := unix.Lsetxattr(path, name, []byte(value), 0); err != nil {
+			x.summary.skip("%s: extended attribute %s not set (%v)", e.name, name, err)
+		}
+	}
+	return nil
+}
+
+// finish sets the mode and time of the folders, deepest first
+func (x *extractor) finish() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		e := x.dirs[i]
+		path, err := x.volumePath(e.name)
+		if err != nil || path == "" {
+			continue
+		}
+		if err = os.Chmod(path, e.mode.Perm()); err != nil {
+			return err
+		}
+		if err = os.Chtimes(path, time.Now(), e.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractTar reads a tar archive into the volume
+func (x *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := &archiveEntry{
+			name:     hdr.Name,
+			mode:     hdr.FileInfo().Mode(),
+			mtime:    hdr.ModTime,
+			linkname: hdr.Linkname,
+			hardlink: hdr.Typeflag == tar.TypeLink,
+		}
+		for k, v := range hdr.PAXRecords {
+			if strings.HasPrefix(k, paxXattrPrefix) {
+				if e.xattrs == nil {
+					e.xattrs = make(map[string]string)
+				}
+				e.xattrs[strings.TrimPrefix(k, paxXattrPrefix)] = v
+			}
+		}
+		if err = x.extract(e, tr); err != nil {
+			return fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+	}
+}
+
+// extractZip reads a zip archive into the volume
+func (x *extractor) extractZip(zr *zip.Reader) error {
+	for _, f := range zr.File {
+		e := &archiveEntry{name: f.Name, mode: f.Mode(), mtime: f.Modified}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+		if e.mode&os.ModeSymlink != 0 {
+			// the target is the contents of a symlink
+			var target []byte
+			if target, err = ioutil.ReadAll(rc); err == nil {
+				e.linkname = string(target)
+			}
+		}
+		if err == nil {
+			err = x.extract(e, rc)
+		}
+		if cerr := rc.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// importArchive implements emount import. The archive is read from the
+// file, or from stdin if it's "-", and its entries are written into the
+// volume. Existing files are skipped, unless overwrite is true.
+func importArchive(cipher string, archive string, format string, overwrite bool,
+	pass *passwordSource, verbose bool) error {
+
+	format, err := archiveFormat(archive, format)
+	if err != nil {
+		return err
+	}
+	var in *os.File
+	if archive == "-" {
+		if format == formatZip {
+			return newUsageErr("a zip archive can't be read from stdin")
+		}
+		in = os.Stdin
+	} else {
+		if in, err = os.Open(archive); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	vol, err := acquireMount(cipher, "", pass)
+	if err != nil {
+		return err
+	}
+	x := &extractor{
+		root:      vol.mountPoint,
+		overwrite: overwrite,
+		summary:   &copySummary{},
+		progress:  newProgress(verbose),
+	}
+	x.progress.begin("Importing", 0, 0)
+
+	if format == formatZip {
+		var fi os.FileInfo
+		var zr *zip.Reader
+		if fi, err = in.Stat(); err == nil {
+			if zr, err = zip.NewReader(in, fi.Size()); err == nil {
+				err = x.extractZip(zr)
+			}
+		}
+	} else {
+		var r io.ReadCloser
+		if r, err = decompressReader(in, format); err == nil {
+			err = x.extractTar(r)
+			if cerr := r.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err == nil {
+		err = x.finish()
+	}
+	x.progress.end()
+	if _, uerr := vol.release(); uerr != nil {
+		printUnmountWarning(vol.mountPoint)
+		if err == nil {
+			err = newExitErr(exitUnmount, uerr)
+		}
+	}
+	x.summary.print(os.Stdout, archive)
+	if err != nil {
+		return fmt.Errorf("importing %s: %v. The entries before the error "+
+			"were imported", archive, err)
+	}
+	return nil
+}
+
+// exportVolume implements emount export. The decrypted contents of the
+// volume are written to the archive file out, which must not exist, or to
+// stdout if out is "-". Messages are written to stderr if the archive is
+// written to stdout.
+func exportVolume(cipher string, out string, format string,
+	pass *passwordSource, verbose bool) error {
+
+	format, err := archiveFormat(out, format)
+	if err != nil {
+		return err
+	}
+	msg := os.Stdout
+	var f *os.File
+	if out == "-" {
+		// only the archive goes to stdout
+		f, msg = os.Stdout, os.Stderr
+		if pass != nil {
+			p := *pass
+			p.msg = msg
+			pass = &p
+		}
+	} else {
+		if f, err = os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			return err
+		}
+	}
+	vol, err := acquireMount(cipher, "", pass)
+	if err != nil {
+		if out != "-" {
+			_ = f.Close()
+			_ = os.Remove(out)
+		}
+		return err
+	}
+	s, err := writeArchive(f, format, vol.mountPoint, newProgress(verbose))
+	if out != "-" {
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(out)
+		}
+	}
+	if _, uerr := vol.release(); uerr != nil {
+		fprintUnmountWarning(msg, vol.mountPoint)
+		if err == nil {
+			err = newExitErr(exitUnmount, uerr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("exporting %s: %v", cipher, err)
+	}
+	s.print(msg, cipher)
+	if out != "-" {
+		fmt.Fprintf(msg, "WARNING: %s is not encrypted. Delete it when it's "+
+			"no longer needed.\n", out)
+	}
+	return nil
+}
+
+// writeArchive writes the contents of the folder root to w as an archive
+func writeArchive(w io.Writer, format string, root string, p *progress) (*copySummary, error) {
+	tree, err := scanSource(root, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &copySummary{}
+	p.begin("Exporting", tree.files, tree.bytes)
+	defer p.end()
+	if format == formatZip {
+		zw := zip.NewWriter(w)
+		if err = writeZip(zw, tree, s, p); err != nil {
+			return nil, err
+		}
+		return s, zw.Close()
+	}
+	cw, err := compressWriter(w, format)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(cw)
+	err = writeTar(tw, tree, s, p)
+	if cerr := tw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	return s, err
+}
+
+// writeTar writes the items of the tree to the tar archive, with their
+// extended attributes as PAX records
+func writeTar(tw *tar.Writer, tree *sourceTree, s *copySummary, p *progress) error {
+	for _, e := range tree.entries {
+		src := filepath.Join(tree.root, e.rel)
+		var target string
+		if e.fi.Mode()&os.ModeSymlink != 0 {
+			var err error
+			if target, err = os.Readlink(src); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(e.fi, target)
+		if err != nil {
+			s.skip("%s: %v", e.rel, err)
+			continue
+		}
+		hdr.Name = filepath.ToSlash(e.rel)
+		if e.fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if e.linkTo != "" {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, filepath.ToSlash(e.linkTo), 0
+		}
+		if names, err := listXattrs(src); err == nil {
+			for _, name := range names {
+				if value, err := getXattr(src, name); err == nil {
+					if hdr.PAXRecords == nil {
+						hdr.PAXRecords = make(map[string]string)
+					}
+					hdr.PAXRecords[paxXattrPrefix+name] = string(value)
+				}
+			}
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		switch {
+		case e.fi.IsDir():
+			s.dirs++
+		case e.linkTo != "":
+			s.hardlinks++
+		case e.fi.Mode().IsRegular():
+			n, err := copyFrom(tw, src, p)
+			if err != nil {
+				return err
+			}
+			s.files++
+			s.bytes += n
+		case e.fi.Mode()&os.ModeSymlink != 0:
+			s.symlinks++
+		case e.fi.Mode()&os.ModeNamedPipe != 0:
+			s.fifos++
+		}
+	}
+	return nil
+}
+
+// writeZip writes the items of the tree to the zip archive. Hard links are
+// stored as separate files, and FIFOs, sockets, and devices are skipped.
+func writeZip(zw *zip.Writer, tree *sourceTree, s *copySummary, p *progress) error {
+	for _, e := range tree.entries {
+		src := filepath.Join(tree.root, e.rel)
+		mode := e.fi.Mode()
+		if !mode.IsDir() && !mode.IsRegular() && mode&os.ModeSymlink == 0 {
+			s.skip("%s: %v can't be stored in a zip archive", e.rel, mode.Type())
+			continue
+		}
+		hdr, err := zip.FileInfoHeader(e.fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(e.rel)
+		if mode.IsDir() {
+			hdr.Name += "/"
+		} else if mode.IsRegular() {
+			hdr.Method = zip.Deflate
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		switch {
+		case mode.IsDir():
+			s.dirs++
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(src)
+			if err != nil {
+				return err
+			}
+			if _, err = io.WriteString(w, target); err != nil {
+				return err
+			}
+			s.symlinks++
+		default:
+			n, err := copyFrom(w, src, p)
+			if err != nil {
+				return err
+			}
+			s.files++
+			s.bytes += n
+		}
+	}
+	return nil
+}
+
+// copyFrom copies the contents of the file to w
+func copyFrom(w io.Writer, path string, p *progress) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := io.Copy(io.MultiWriter(w, progressWriter{p}), f)
+	p.add(1, 0)
+	return n, err
+}
+
+// nopWriteCloser is a WriteCloser for an uncompressed archive
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter returns a writer that compresses to w, for the format
+func compressWriter(w io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case formatTarGz:
+		return gzip.NewWriter(w), nil
+	case formatTarZst:
+		return startZstd(w, nil, "-c")
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// decompressReader returns a reader that decompresses r, for the format
+func decompressReader(r io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case formatTarGz:
+		return gzip.NewReader(r)
+	case formatTarZst:
+		return startZstd(nil, r, "-dc")
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// zstdPipe is the zstd program compressing to w, or decompressing from r
+type zstdPipe struct {
+	cmd    *exec.Cmd
+	in     io.WriteCloser // stdin of zstd, when compressing
+	out    io.ReadCloser  // stdout of zstd, when decompressing
+	stderr bytes.Buffer
+}
+
+// startZstd runs zstd, to compress what is written to the returned pipe to
+// w, or to decompress r into what is read from it
+func startZstd(w io.Writer, r io.Reader, flag string) (*zstdPipe, error) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		return nil, errors.New("zstd is not installed. It's needed for .tar.zst archives")
+	}
+	z := &zstdPipe{cmd: exec.Command("zstd", "-q", flag)}
+	z.cmd.Stderr = &z.stderr
+	var err error
+	if w != nil {
+		z.cmd.Stdout = w
+		z.in, err = z.cmd.StdinPipe()
+	} else {
+		z.cmd.Stdin = r
+		z.out, err = z.cmd.StdoutPipe()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return z, z.cmd.Start()
+}
+
+func (z *zstdPipe) Write(b []byte) (int, error) {
+	return z.in.Write(b)
+}
+
+func (z *zstdPipe) Read(b []byte) (int, error) {
+	return z.out.Read(b)
+}
+
+// Close waits for zstd to finish, and returns its error
+func (z *zstdPipe) Close() error {
+	if z.in != nil {
+		_ = z.in.Close()
+	} else {
+		// zstd can't exit until its output is read
+		_, _ = io.Copy(ioutil.Discard, z.out)
+	}
+	if err := z.cmd.Wait(); err != nil {
+		return fmt.Errorf("zstd: %v %s", err, strings.TrimSpace(z.stderr.String()))
+	}
+	return nil
+}
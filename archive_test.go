@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveFormat(t *testing.T) {
+	for name, format := range map[string]string{
+		"a.tar": formatTar, "a.TGZ": formatTarGz, "b.tar.gz": formatTarGz,
+		"c.tar.zst": formatTarZst, "d.zip": formatZip, "-": formatTar,
+	} {
+		f, err := archiveFormat(name, "")
+		ok(t, err)
+		assert(t, f == format, name, f)
+	}
+	_, err := archiveFormat("a.rar", "")
+	assert(t, isUsageErr(err), "unknown type", err)
+	f, err := archiveFormat("-", formatZip)
+	assert(t, err == nil && f == formatZip, "--format", f)
+	_, err = archiveFormat("a.tar", "7z")
+	assert(t, isUsageErr(err), "invalid format", err)
+}
+
+func TestImportExport(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	src, err := createTestData()
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(src)
+	}()
+	tf := getTestFileInfo()[0]
+	okf(t, os.Symlink("abc.txt", filepath.Join(src, "link")))
+	okf(t, os.Link(src+tf.name, filepath.Join(src, "sub", "hardlink")))
+
+	vol := filepath.Join(dir, "vol")
+	okf(t, initCryptVol(vol, src, nil))
+
+	formats := []string{".tar", ".tar.gz", ".zip"}
+	if _, err := exec.LookPath("zstd"); err == nil {
+		formats = append(formats, ".tar.zst")
+	}
+	for _, ext := range formats {
+		archive := filepath.Join(dir, "out"+ext)
+		okf(t, exportVolume(vol, archive, "", nil, false))
+		err = exportVolume(vol, archive, "", nil, false)
+		assert(t, err != nil, "archive exists", err)
+
+		vol2 := filepath.Join(dir, "vol2"+ext)
+		okf(t, initCryptVol(vol2, "", nil))
+		okf(t, importArchive(vol2, archive, "", false, nil, false))
+
+		// read back the imported files with export
+		out := filepath.Join(dir, "copy"+ext)
+		okf(t, exportVolume(vol2, archive+".tar", "", nil, false))
+		okf(t, os.Mkdir(out, 0700))
+		cmd := exec.Command("tar", "-xf", archive+".tar", "-C", out)
+		okf(t, cmd.Run())
+		okf(t, confirmTestData(t, out))
+		target, err := os.Readlink(filepath.Join(out, "link"))
+		ok(t, err)
+		assert(t, target == "abc.txt", "symlink "+ext, target)
+		if ext != ".zip" {
+			fi1, err := os.Stat(out + tf.name)
+			okf(t, err)
+			fi2, err := os.Stat(filepath.Join(out, "sub", "hardlink"))
+			okf(t, err)
+			assert(t, os.SameFile(fi1, fi2), "hard link "+ext, fi2)
+		}
+
+		// existing files are kept, unless --overwrite
+		okf(t, importArchive(vol2, archive, "", false, nil, false))
+		okf(t, importArchive(vol2, archive, "", true, nil, false))
+	}
+
+	// entries outside the volume are skipped
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "../evil", Mode: 0600, Typeflag: tar.TypeReg},
+		{Name: "out", Linkname: dir, Typeflag: tar.TypeSymlink},
+		{Name: "out/evil", Mode: 0600, Typeflag: tar.TypeReg},
+		{Name: "good", Mode: 0600, Typeflag: tar.TypeReg},
+	} {
+		okf(t, tw.WriteHeader(hdr))
+	}
+	okf(t, tw.Close())
+	root := filepath.Join(dir, "root")
+	okf(t, os.Mkdir(root, 0700))
+	x := &extractor{root: root, summary: &copySummary{}}
+	okf(t, x.extractTar(&buf))
+	assert(t, x.summary.files == 1 && len(x.summary.skipped) == 2, "skipped",
+		strings.Join(x.summary.skipped, "\n"))
+	_, err = os.Stat(filepath.Join(dir, "evil"))
+	assert(t, os.IsNotExist(err), "written outside the volume", err)
+
+	// existing folders keep their mode, unless --overwrite
+	okf(t, os.Mkdir(filepath.Join(root, "sub"), 0700))
+	for _, overwrite := range []bool{false, true} {
+		buf.Reset()
+		tw = tar.NewWriter(&buf)
+		okf(t, tw.WriteHeader(&tar.Header{Name: "sub/", Mode: 0750,
+			Typeflag: tar.TypeDir, ModTime: time.Unix(1e9, 0)}))
+		okf(t, tw.Close())
+		x = &extractor{root: root, overwrite: overwrite, summary: &copySummary{}}
+		okf(t, x.extractTar(&buf))
+		okf(t, x.finish())
+		fi, err := os.Stat(filepath.Join(root, "sub"))
+		okf(t, err)
+		if overwrite {
+			assert(t, fi.Mode().Perm() == 0750 && fi.ModTime().Equal(time.Unix(1e9, 0)),
+				"folder overwritten", fi.Mode())
+		} else {
+			assert(t, fi.Mode().Perm() == 0700 && !fi.ModTime().Equal(time.Unix(1e9, 0)),
+				"folder kept", fi.Mode())
+		}
+	}
+}
+
+// TestExportStdout checks that warnings don't go into an archive written
+// to stdout
+func TestExportStdout(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+	src, err := createTestData()
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(src)
+	}()
+	vol, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(vol)
+	}()
+	okf(t, initCryptVol(vol, src, nil))
+
+	// the test binary runs emount (see TestMain). Without a session bus,
+	// the keyring lookup fails with a warning.
+	exe, err := os.Executable()
+	okf(t, err)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(exe, "export", vol, "--keyring", "-o", "-")
+	cmd.Env = append(os.Environ(), "DBUS_SESSION_BUS_ADDRESS=unix:path="+
+		filepath.Join(vol, "no-bus"))
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	okf(t, cmd.Run())
+	assert(t, strings.Contains(stderr.String(), "WARNING: keyring"), "warning",
+		stderr.String())
+
+	tr := tar.NewReader(&stdout)
+	n := 0
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		okf(t, err)
+		n++
+	}
+	assert(t, n > 0, "archive entries", n)
+}
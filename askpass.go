@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Password prompt backends, selected with --askpass or EMOUNT_ASKPASS
+const (
+	askAuto       = "auto"        // terminal if available, otherwise graphical
+	askTTY        = "tty"         // terminal (/dev/tty)
+	askPinentry   = "pinentry"    // pinentry program, using the Assuan protocol
+	askZenity     = "zenity"      // GNOME dialog
+	askKdialog    = "kdialog"     // KDE dialog
+	askSSHAskpass = "ssh-askpass" // $SSH_ASKPASS or ssh-askpass
+
+	envAskpassKey  = "EMOUNT_ASKPASS"
+	envPinentryKey = "EMOUNT_PINENTRY"
+
+	askTitle = "emount"
+)
+
+// askBackends lists the valid values of --askpass
+var askBackends = []string{askAuto, askTTY, askPinentry, askZenity,
+	askKdialog, askSSHAskpass}
+
+// guiPinentryPrograms are pinentry flavours that don't need a terminal,
+// in order of preference, used by auto when there is no terminal.
+var guiPinentryPrograms = []string{"pinentry-gnome3", "pinentry-qt",
+	"pinentry-gtk-2", "pinentry-gtk", "pinentry-x11"}
+
+// validAskBackend returns true if name is a known prompt backend
+func validAskBackend(name string) bool {
+	for _, b := range askBackends {
+		if name == b {
+			return true
+		}
+	}
+	return false
+}
+
+// askSecret asks the user for a secret using the backend.
+// pinentry is the pinentry program, used if backend is askPinentry.
+func askSecret(backend string, pinentry string, prompt string) (string, error) {
+	switch backend {
+	case askTTY:
+		return terminalGetSecret(prompt)
+	case askPinentry:
+		if pinentry == "" {
+			pinentry = "pinentry"
+		}
+		return pinentryGetSecret(pinentry, prompt)
+	case askZenity:
+		return dialogGetSecret("zenity", "--entry", "--hide-text",
+			"--title="+askTitle, "--text="+prompt)
+	case askKdialog:
+		return dialogGetSecret("kdialog", "--title", askTitle, "--password", prompt)
+	case askSSHAskpass:
+		program := os.Getenv("SSH_ASKPASS")
+		if program == "" {
+			program = "ssh-askpass"
+		}
+		return dialogGetSecret(program, prompt)
+	case askAuto, "":
+		return askSecret(autoAskBackend(&pinentry), pinentry, prompt)
+	}
+	return "", fmt.Errorf("unknown password prompt %q", backend)
+}
+
+// autoAskBackend selects the terminal if there is one. If there isn't,
+// and a graphical display is available, the first installed graphical
+// prompt is used. If pinentry is empty and a graphical pinentry is found,
+// pinentry is set to its path.
+func autoAskBackend(pinentry *string) string {
+	if tty, err := os.Open(ttyPath); err == nil {
+		_ = tty.Close()
+		return askTTY
+	}
+	if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+		return askTTY
+	}
+	if *pinentry != "" {
+		return askPinentry
+	}
+	for _, prog := range guiPinentryPrograms {
+		if path, err := exec.LookPath(prog); err == nil {
+			*pinentry = path
+			return askPinentry
+		}
+	}
+	for _, prog := range []string{askZenity, askKdialog} {
+		if _, err := exec.LookPath(prog); err == nil {
+			return prog
+		}
+	}
+	if os.Getenv("SSH_ASKPASS") != "" {
+		return askSSHAskpass
+	}
+	if _, err := exec.LookPath("ssh-askpass"); err == nil {
+		return askSSHAskpass
+	}
+	return askTTY
+}
+
+// dialogGetSecret runs a dialog program that prints the secret on stdout
+func dialogGetSecret(program string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(program, args...)
+	cmd.Env = filterEnv(os.Environ(), nil, nil)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("%s: password entry cancelled", program)
+		}
+		return "", err
+	}
+	return firstLine(out.Bytes()), nil
+}
+
+// pinentryGetSecret asks for the secret with a pinentry program,
+// which speaks the Assuan protocol on its stdin and stdout.
+func pinentryGetSecret(program string, prompt string) (string, error) {
+	cmd := exec.Command(program)
+	cmd.Env = filterEnv(os.Environ(), nil, nil)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err = cmd.Start(); err != nil {
+		return "", fmt.Errorf("starting pinentry: %v", err)
+	}
+	defer func() {
+		_ = stdin.Close()
+		_ = cmd.Wait()
+	}()
+
+	conn := &assuanConn{w: stdin, r: bufio.NewReader(stdout)}
+	// the server sends a greeting when it starts
+	if _, err = conn.response(); err != nil {
+		return "", err
+	}
+	for _, req := range []string{
+		"SETTITLE " + assuanEncode(askTitle),
+		"SETDESC " + assuanEncode(strings.TrimSpace(prompt)),
+		"SETPROMPT " + assuanEncode("Passphrase:"),
+	} {
+		if _, err = conn.request(req); err != nil {
+			return "", err
+		}
+	}
+	pin, err := conn.request("GETPIN")
+	if err != nil {
+		return "", err
+	}
+	_, _ = conn.request("BYE")
+	return pin, nil
+}
+
+// assuanConn is the client side of an Assuan connection
+type assuanConn struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+// request sends a command and returns the data in the response
+func (c *assuanConn) request(line string) (string, error) {
+	if _, err := io.WriteString(c.w, line+"\n"); err != nil {
+		return "", fmt.Errorf("pinentry: %v", err)
+	}
+	return c.response()
+}
+
+// response reads lines until OK or ERR and returns the decoded data lines.
+// Status (S) and comment (#) lines are ignored.
+func (c *assuanConn) response() (string, error) {
+	var data strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("pinentry: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data.String(), nil
+		case strings.HasPrefix(line, "ERR "):
+			return "", assuanError(line[4:])
+		case strings.HasPrefix(line, "D "):
+			decoded, err := assuanDecode(line[2:])
+			if err != nil {
+				return "", err
+			}
+			data.WriteString(decoded)
+		}
+	}
+}
+
+// assuanError converts the text of an ERR response to an error.
+// The text is a numeric code followed by a description.
+func assuanError(text string) error {
+	fields := strings.SplitN(text, " ", 2)
+	if len(fields) == 2 {
+		return fmt.Errorf("pinentry: %s", fields[1])
+	}
+	return fmt.Errorf("pinentry: error %s", text)
+}
+
+// assuanEncode percent-escapes a command parameter
+func assuanEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '%' || c < 0x20 {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// assuanDecode reverses percent-escaping in a data line
+func assuanDecode(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", errors.New("pinentry: invalid escape in response")
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New("pinentry: invalid escape in response")
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
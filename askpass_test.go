@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakePinentry is a minimal pinentry that answers every request with OK,
+// and GETPIN with a fixed pin. The pin contains an escaped '%' and a space.
+const fakePinentry = `#!/bin/sh
+echo "OK Pleased to meet you"
+while read cmd rest; do
+  case "$cmd" in
+    GETPIN) echo "S PASSWORD_FROM_CACHE"; echo "D fake%25pin word"; echo "OK" ;;
+    BYE) echo "OK closing connection"; exit 0 ;;
+    *) echo "OK" ;;
+  esac
+done
+`
+
+// cancelPinentry returns the error pinentry sends when the user clicks cancel
+const cancelPinentry = `#!/bin/sh
+echo "OK Pleased to meet you"
+while read cmd rest; do
+  case "$cmd" in
+    GETPIN) echo "ERR 83886179 Operation cancelled <Pinentry>" ;;
+    *) echo "OK" ;;
+  esac
+done
+`
+
+func writeScript(t *testing.T, dir string, name string, script string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	okf(t, ioutil.WriteFile(path, []byte(script), 0700))
+	return path
+}
+
+func TestPinentry(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	prog := writeScript(t, dir, "pinentry-fake", fakePinentry)
+	pin, err := askSecret(askPinentry, prog, "Enter encryption passphrase: ")
+	ok(t, err)
+	assert(t, pin == "fake%pin word", "pin", pin)
+
+	prog = writeScript(t, dir, "pinentry-cancel", cancelPinentry)
+	_, err = askSecret(askPinentry, prog, "Enter encryption passphrase: ")
+	if err == nil || !strings.Contains(err.Error(), "Operation cancelled") {
+		t.Errorf("expected cancel error, got %v", err)
+	}
+
+	// promptNewPassword confirmation works with pinentry
+	ps := &passwordSource{fd: -1, askpass: askPinentry,
+		pinentry: writeScript(t, dir, "pinentry-fake2", fakePinentry)}
+	pw, err := promptNewPassword(ps.ask, "New passphrase: ", 0)
+	ok(t, err)
+	assert(t, pw == "fake%pin word", "new password", pw)
+}
+
+func TestAutoAskBackend(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	savTTY := ttyPath
+	savDisplay := os.Getenv("DISPLAY")
+	defer func() {
+		ttyPath = savTTY
+		_ = os.Setenv("DISPLAY", savDisplay)
+	}()
+
+	// terminal available
+	ttyPath = writeScript(t, dir, "tty", "")
+	pinentry := ""
+	assert(t, autoAskBackend(&pinentry) == askTTY, "tty", pinentry)
+
+	// no terminal, no display
+	ttyPath = filepath.Join(dir, "nonexistent")
+	ok(t, os.Unsetenv("DISPLAY"))
+	if os.Getenv("WAYLAND_DISPLAY") == "" {
+		assert(t, autoAskBackend(&pinentry) == askTTY, "no display", pinentry)
+	}
+
+	// no terminal with display uses the configured pinentry
+	ok(t, os.Setenv("DISPLAY", ":99"))
+	pinentry = writeScript(t, dir, "pinentry-fake", fakePinentry)
+	assert(t, autoAskBackend(&pinentry) == askPinentry, "display", pinentry)
+	pin, err := askSecret(askAuto, pinentry, "prompt")
+	ok(t, err)
+	assert(t, pin == "fake%pin word", "auto pin", pin)
+}
+
+func TestAssuanEncoding(t *testing.T) {
+	assert(t, assuanEncode("a%b\nc") == "a%25b%0Ac", "encode",
+		assuanEncode("a%b\nc"))
+
+	s, err := assuanDecode("a%25b%0Ac")
+	ok(t, err)
+	assert(t, s == "a%b\nc", "decode", s)
+
+	_, err = assuanDecode("abc%2")
+	assert(t, err != nil, "truncated escape", err)
+	_, err = assuanDecode("abc%zz")
+	assert(t, err != nil, "invalid escape", err)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Recovery from emount processes that crashed or could not unmount:
+// volumes left mounted, emount_* mount points left in TMPDIR, and state
+// files of volumes that are no longer used.
+
+// tmpDirGrace is the minimum age of an empty temp mount point before it's
+// removed, so that mount points just created by another emount process
+// (which are empty until the volume is mounted) are not removed.
+const tmpDirGrace = time.Minute
+
+// cleanupResult describes the stale items found or cleaned up
+type cleanupResult struct {
+	found  int      // number of stale items
+	report []string // description of each item, and what was done
+	failed int      // number of items that could not be cleaned up
+}
+
+func (r *cleanupResult) add(format string, args ...interface{}) {
+	r.found++
+	r.report = append(r.report, fmt.Sprintf(format, args...))
+}
+
+func (r *cleanupResult) fail(format string, args ...interface{}) {
+	r.failed++
+	r.add(format, args...)
+}
+
+// cleanupStale finds volumes left mounted by emount processes that no
+// longer exist, and empty emount_* mount points in TMPDIR. If fix is true,
+// stale volumes are unmounted (lazily, on linux), and the mount points and
+// state files are removed. Mounts in use by a running emount process
+// are never changed.
+func cleanupStale(fix bool) (*cleanupResult, error) {
+	res := &cleanupResult{}
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, fmt.Errorf("reading mount table: %v", err)
+	}
+	mounted := make(map[string]bool)
+	for _, m := range mounts {
+		mounted[m.mountPoint] = true
+	}
+	// mount points in use, or already handled
+	skip := make(map[string]bool)
+
+	// volumes recorded in state files
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	stateFiles, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, path := range stateFiles {
+		st, err := readStateFile(path)
+		if err != nil || st == nil {
+			continue
+		}
+		if err = cleanupVolume(st.Cipher, mounted, skip, fix, res); err != nil {
+			return nil, err
+		}
+	}
+
+	// gocryptfs mounts on emount mount points, without state. These are
+	// left by older versions of emount, or if saving the state failed.
+	tmpDir := resolvePath(os.TempDir())
+	for _, m := range mounts {
+		if skip[m.mountPoint] || !isGocryptfsMount(m) ||
+			!isTempMountPoint(tmpDir, m.mountPoint) || !ownedByUser(m.mountPoint) {
+			continue
+		}
+		// if the source is the cipher dir, isRecorded waits for an
+		// acquireMount that may be about to record this mount
+		if cipher := mountCipher(m); cipher != "" && isRecorded(cipher, m.mountPoint) {
+			continue
+		}
+		if !fix {
+			res.add("%s is mounted at %s, but not by a running emount process",
+				m.source, m.mountPoint)
+			continue
+		}
+		if err := unmountVol(m.mountPoint); err != nil {
+			res.fail("Unmounting %s failed: %v", m.mountPoint, err)
+			continue
+		}
+		delete(mounted, m.mountPoint)
+		_ = os.Remove(m.mountPoint)
+		res.add("Unmounted %s from %s", m.source, m.mountPoint)
+	}
+
+	// empty temp mount points
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range entries {
+		path := filepath.Join(tmpDir, fi.Name())
+		if !fi.IsDir() || !strings.HasPrefix(fi.Name(), tmpFolderPattern) ||
+			skip[path] || mounted[path] || !ownedByUser(path) ||
+			time.Since(fi.ModTime()) < tmpDirGrace || checkEmptyDir(path) != nil {
+			continue
+		}
+		if !fix {
+			res.add("%s is an unused emount mount point", path)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			res.fail("Removing %s failed: %v", path, err)
+			continue
+		}
+		res.add("Removed %s", path)
+	}
+	return res, nil
+}
+
+// cleanupVolume cleans up the state of the volume, if the emount processes
+// that used it no longer exist. The mount point is added to skip.
+func cleanupVolume(cipher string, mounted map[string]bool, skip map[string]bool,
+	fix bool, res *cleanupResult) error {
+
+	lock, err := lockVolume(cipher)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	st, err := lock.read()
+	if err != nil || st == nil {
+		return err
+	}
+	mp := resolvePath(st.MountPoint)
+	skip[mp] = true
+	if len(st.Users) > 0 {
+		return nil
+	}
+	if !mounted[mp] {
+		if fix {
+			if st.TempMount {
+				_ = os.Remove(st.MountPoint)
+			}
+			return lock.write(nil)
+		}
+		return nil
+	}
+	if !fix {
+		res.add("%s is mounted at %s, but not by a running emount process",
+			st.Cipher, st.MountPoint)
+		return nil
+	}
+	if err = unmountVol(st.MountPoint); err != nil {
+		res.fail("Unmounting %s from %s failed: %v", st.Cipher, st.MountPoint, err)
+		return nil
+	}
+	delete(mounted, mp)
+	if st.TempMount {
+		_ = os.Remove(st.MountPoint)
+	}
+	res.add("Unmounted %s from %s", st.Cipher, st.MountPoint)
+	return lock.write(nil)
+}
+
+// isRecorded returns true if the state of the volume has the mount point
+func isRecorded(cipher string, mountPoint string) bool {
+	lock, err := lockVolume(cipher)
+	if err != nil {
+		return false
+	}
+	defer lock.unlock()
+	st, err := lock.read()
+	return err == nil && st != nil && resolvePath(st.MountPoint) == mountPoint
+}
+
+// isGocryptfsMount returns true if the mount is a gocryptfs volume
+func isGocryptfsMount(m mountEntry) bool {
+	return m.fsType == "fuse.gocryptfs" || strings.HasPrefix(m.source, "gocryptfs@")
+}
+
+// mountCipher returns the cipher dir of a gocryptfs mount, or "" if unknown
+func mountCipher(m mountEntry) string {
+	src := strings.TrimPrefix(m.source, "gocryptfs@")
+	if !filepath.IsAbs(src) {
+		return ""
+	}
+	return src
+}
+
+// isTempMountPoint returns true if path is a mount point created by emount
+// in tmpDir
+func isTempMountPoint(tmpDir string, path string) bool {
+	return filepath.Dir(path) == tmpDir &&
+		strings.HasPrefix(filepath.Base(path), tmpFolderPattern)
+}
+
+// ownedByUser returns true if path is owned by the current user
+func ownedByUser(path string) bool {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == os.Getuid()
+}
+
+// resolvePath returns the absolute path with symlinks resolved,
+// as it appears in the mount table (e.g., /private/tmp on macos)
+func resolvePath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return path
+}
+
+// runCleanup implements emount cleanup
+func runCleanup() error {
+	res, err := cleanupStale(true)
+	if err != nil {
+		return err
+	}
+	var ask func(string) bool
+	if tty, err := os.OpenFile(ttyPath, os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		ask = func(question string) bool {
+			yes, err := askYesNo(tty, question)
+			return err == nil && yes
+		}
+	}
+	if err = cleanupQuarantines(res, ask); err != nil {
+		return err
+	}
+	for _, line := range res.report {
+		fmt.Println(line)
+	}
+	if res.found == 0 {
+		fmt.Println("No stale emount mounts found")
+	}
+	if res.failed > 0 {
+		return newExitErr(exitUnmount,
+			fmt.Errorf("%d of %d stale items could not be cleaned up", res.failed, res.found))
+	}
+	return nil
+}
+
+// offerCleanup checks for stale mounts before emount run mounts a volume.
+// If any are found, and the user is prompted for the password anyway,
+// the user is asked whether to clean them up. Otherwise a hint is printed.
+func offerCleanup(pass *passwordSource) {
+	res, err := cleanupStale(false)
+	if err != nil || res.found == 0 {
+		return
+	}
+	if pass.interactive() {
+		if tty, err := os.OpenFile(ttyPath, os.O_RDWR, 0); err == nil {
+			for _, line := range res.report {
+				fmt.Fprintln(tty, line)
+			}
+			yes, err := askYesNo(tty, "Clean up now?")
+			_ = tty.Close()
+			if err == nil && yes {
+				if err = runCleanup(); err != nil {
+					fmt.Printf("WARNING: %v\n", err)
+				}
+			}
+			return
+		}
+	}
+	fmt.Printf("WARNING: found %d stale emount mounts or mount points. "+
+		"Run 'emount cleanup' to remove them.\n", res.found)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanupStale(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+
+	// use a separate TMPDIR for temp mount points
+	tmpDir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	tmpDir = resolvePath(tmpDir)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	savTmp, hadTmp := os.LookupEnv("TMPDIR")
+	ok(t, os.Setenv("TMPDIR", tmpDir))
+	defer func() {
+		if hadTmp {
+			_ = os.Setenv("TMPDIR", savTmp)
+		} else {
+			_ = os.Unsetenv("TMPDIR")
+		}
+	}()
+
+	// generate random password of about 31-32 hex chars
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	var vols []*sharedMount
+	for i := 0; i < 2; i++ {
+		crypt := filepath.Join(tmpDir, fmt.Sprintf("crypt%d", i))
+		okf(t, initCryptVol(crypt, "", nil))
+		vol, err := acquireMount(crypt, "", nil)
+		okf(t, err)
+		vols = append(vols, vol)
+	}
+	stale, inUse := vols[0], vols[1]
+	defer func() {
+		_, _ = inUse.release()
+	}()
+
+	// the emount process that mounted stale no longer exists
+	dead := exec.Command("true")
+	okf(t, dead.Run())
+	lock, err := lockVolume(stale.cipher)
+	okf(t, err)
+	st, err := lock.read()
+	okf(t, err)
+	st.Users = []mountUser{{PID: dead.Process.Pid}}
+	ok(t, lock.write(st))
+	lock.unlock()
+
+	old := time.Now().Add(-2 * tmpDirGrace)
+	emptyOld := filepath.Join(tmpDir, tmpFolderPattern+"old")
+	emptyNew := filepath.Join(tmpDir, tmpFolderPattern+"new")
+	notEmpty := filepath.Join(tmpDir, tmpFolderPattern+"full")
+	for _, dir := range []string{emptyOld, emptyNew, notEmpty} {
+		okf(t, os.Mkdir(dir, dirMode))
+	}
+	ok(t, ioutil.WriteFile(filepath.Join(notEmpty, "file"), []byte("x"), 0600))
+	ok(t, os.Chtimes(emptyOld, old, old))
+	ok(t, os.Chtimes(notEmpty, old, old))
+
+	// the check only reports
+	res, err := cleanupStale(false)
+	okf(t, err)
+	assert(t, res.found == 2 && res.failed == 0, "stale items found", res.report)
+	assert(t, isMountPoint(stale.mountPoint), "report doesn't unmount",
+		stale.mountPoint)
+
+	res, err = cleanupStale(true)
+	okf(t, err)
+	assert(t, res.found == 2 && res.failed == 0, "stale items cleaned", res.report)
+	assert(t, !isMountPoint(stale.mountPoint), "stale volume unmounted",
+		stale.mountPoint)
+	assert(t, checkFolder(stale.mountPoint) == invalidPath,
+		"stale mount point removed", stale.mountPoint)
+	assert(t, sharedMountPoint(stale.cipher) == "", "stale state removed",
+		stale.cipher)
+	assert(t, checkFolder(emptyOld) == invalidPath, "old mount point removed", emptyOld)
+	assert(t, checkFolder(emptyNew) == isDir, "new mount point kept", emptyNew)
+	assert(t, checkFolder(notEmpty) == isDir, "non-empty dir kept", notEmpty)
+	assert(t, isMountPoint(inUse.mountPoint), "volume in use still mounted",
+		inUse.mountPoint)
+
+	res, err = cleanupStale(true)
+	okf(t, err)
+	assert(t, res.found == 0, "nothing left", res.report)
+}
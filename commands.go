@@ -0,0 +1,671 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Subcommands: emount init, run, passwd, recover, import, export, agent,
+// lock, status, unmount, info, and cleanup. Each command has its own flags
+// and help text. The flags of earlier versions (emount --run FOLDER ...)
+// are parsed by parseLegacyArgs.
+
+// command is an emount subcommand
+type command struct {
+	name        string
+	args        string // synopsis of the arguments
+	summary     string // one line description, for the list of commands
+	help        string // description, for emount help COMMAND
+	nargs       int    // number of arguments, not counting the command of run
+	optArgs     bool   // the arguments are optional
+	runsCommand bool   // arguments after the volume are the command to run
+
+	// flags defines the flags of the command, except --config
+	flags func(fs *flag.FlagSet, opt *options)
+
+	// parse sets the options from the arguments, and validates them
+	parse func(opt *options, cl *commandLine) error
+}
+
+// commandLine is the parsed command line of a subcommand
+type commandLine struct {
+	args []string        // arguments
+	rest []string        // the command to run, and its arguments
+	set  map[string]bool // names of the flags set
+	cfg  *config
+}
+
+// commands is the list of subcommands, in the order they are listed by
+// emount help. It's set in init, because the help refers to it.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name:    "init",
+			args:    "VOLUME",
+			summary: "Initialize a new encrypted volume",
+			help: `Initialize a new encrypted volume at the folder VOLUME. Either the folder
+must not exist or it must be an empty directory. With --from, the volume is
+populated with a recursive copy of the source folder, without the items
+matching --exclude (comma-separated shell patterns, matched against names,
+or paths if they contain a "/"). Permissions, modification times, symlinks,
+hard links, FIFOs, and extended attributes are copied; sockets, device
+files, and attributes the volume doesn't support are skipped and listed.
+Every source file is hashed as it's copied, and read back through the mount
+and compared after the copy, and a verification report is printed. If the
+copy fails or doesn't match the source, --rollback-on-error deletes the new
+volume.
+
+After a verified copy, --retire-source shred overwrites the source files with
+random data and removes them. This doesn't reliably erase data on SSDs or
+copy-on-write file systems. --retire-source quarantine moves them to the
+--quarantine folder, on the same file system, and 'emount run' and
+'emount cleanup' remind you to delete them after --quarantine-days days
+(default 14). The empty source folder can then be the mount point. The
+source is not retired if items were skipped, and --retire-source can't be
+used with --exclude.
+
+The user is prompted to enter a new password, and the password is rejected
+if it is too weak (according to the min_entropy setting in the config file).
+
+The gocryptfs options of the volume (--names, --xchacha, --aessiv,
+--longnames, --raw64, and --scryptn) can't be changed after it's created.
+With deterministic names, a name is encrypted the same way in every
+directory. --xchacha is faster than the default AES-256-GCM on CPUs without
+AES-NI. Each increment of --scryptn doubles the time and memory needed to
+unlock the volume, and to guess the password. 'emount info' shows the
+options of a volume.
+
+The master key of the volume can open it without the password. With
+--key-backup FILE, a paper backup of the key is written to FILE: the key with
+checks to catch typing errors, and a QR code. With --show-key, the backup is
+shown once on the terminal, and the screen is cleared. Without these flags,
+emount asks which to do if the password is typed at a prompt; with
+EMOUNT_PASSWORD or another password source, the key is not saved. Use
+'emount recover' with the key to set a new password.`,
+			nargs: 1,
+			flags: func(fs *flag.FlagSet, opt *options) {
+				fs.StringVar(&opt.srcFolder, "from", "", "folder to copy from")
+				fs.StringVar(&opt.srcFolder, "f", "", "folder to copy from (shorthand)")
+				fs.Var((*stringList)(&opt.initCopy.exclude), "exclude",
+					"patterns of files and folders not copied by --from")
+				fs.BoolVar(&opt.initCopy.rollback, "rollback-on-error", false,
+					"delete the volume if the copy fails or doesn't match the source")
+				fs.StringVar(&opt.initCopy.retire.mode, "retire-source", "",
+					"after a verified copy, shred the source files, or move them to a quarantine folder")
+				fs.StringVar(&opt.initCopy.retire.quarantine, "quarantine", "",
+					"quarantine folder for --retire-source quarantine")
+				fs.IntVar(&opt.initCopy.retire.days, "quarantine-days", defaultQuarantineDays,
+					"days until the quarantined files are due for deletion")
+				fs.BoolVar(&opt.verbose, "v", false, "show progress messages")
+				passwordFlags(fs, opt)
+				opt.crypt = defaultCryptOptions()
+				cryptFlags(fs, opt.crypt)
+				fs.StringVar(&opt.masterKey.file, "key-backup", "",
+					"write a paper backup of the master key to this file")
+				fs.BoolVar(&opt.masterKey.show, "show-key", false,
+					"show the master key once on the terminal")
+			},
+			parse: func(opt *options, cl *commandLine) error {
+				var p *profile
+				opt.init, p = cl.volume()
+				if p != nil {
+					p.applyPassword(opt, cl.set)
+				}
+				if (opt.initCopy.rollback || len(opt.initCopy.exclude) > 0) &&
+					opt.srcFolder == "" {
+					return newUsageErr("--rollback-on-error and --exclude are only " +
+						"used with --from")
+				}
+				opt.initCopy.verbose = opt.verbose
+				if err := opt.initCopy.retire.validate(opt.srcFolder, opt.init,
+					opt.initCopy.exclude); err != nil {
+					return err
+				}
+				if anySet(cl.set, "names") && anySet(cl.set, "plaintextnames") {
+					return newUsageErr("use either --names or --plaintextnames")
+				}
+				if err := opt.crypt.validate(); err != nil {
+					return err
+				}
+				if err := opt.pass.validate(); err != nil {
+					return err
+				}
+				return checkInitArgs(opt)
+			},
+		},
+		{
+			name:    "run",
+			args:    "VOLUME COMMAND [ARGS...]",
+			summary: "Run a command with the volume mounted",
+			help: `Run the command (with optional arguments), providing access to the
+decrypted VOLUME mounted in a temporary location. When the command completes,
+the decrypted volume is unmounted. COMMAND should be a program in your PATH
+or an absolute path to an executable. If VOLUME is a profile, COMMAND is
+optional, and ARGS are appended to the profile's command. Flags override
+the profile.
+
+The default mount point is a dynamically-created temporary folder (inside
+TMPDIR), owned by the calling user with permission mode 0700. The dynamic
+folder name is passed to the command executable through the environment
+variable EMOUNT_FOLDER. The default mount point can be overridden by the
+--mount/-m flag.
+
+Placeholders in ARGS are replaced before the command starts: {mount} with
+the mount point, and {cipher} with the absolute path of VOLUME. With more
+volumes, {mount:NAME} and {cipher:NAME} are those of the volume NAME.
+Double the braces to pass a placeholder unchanged: {{mount}} is passed as
+{mount}. Other text in braces, such as {} for find -exec, is not changed.
+
+If the volume is already mounted by another 'emount run', the mount is
+shared, and it is unmounted when the last emount process using it finishes.
+
+The command inherits the caller's environment, except for variables used by
+emount such as EMOUNT_PASSWORD. --env-allow limits the environment to the
+listed variables, and --env-deny removes the listed variables. VARS is a
+comma-separated list of names, which may contain wildcards (e.g., 'XDG_*').
+Both flags may be repeated.
+
+If 'emount agent' is running, it keeps the volume mounted after the command
+exits, for its lifetime, so later runs don't ask for the password. With
+--no-agent, the volume is unmounted as usual.
+
+With --idle-timeout DURATION (e.g., 15m or 1h30m), the command is stopped
+when there has been no file activity on the volume for DURATION, and the
+volume is unmounted, so the next run asks for the password again. The
+command gets SIGTERM, and SIGKILL if it hasn't exited 10 seconds later.
+Linux only.
+
+With --lock-on-suspend, the command is stopped the same way, and the volume
+is unmounted, when the session is locked or the system is about to suspend,
+from the signals of systemd-logind. The suspend is delayed until the volume
+is unmounted. If the agent holds the volume, it releases it too. Linux only.
+
+With --private, the volume is mounted in a private mount namespace, where
+only the command can see it. Other processes, even of the same user, see
+an empty mount point. This uses unprivileged user namespaces. If they are
+not available, emount prints a warning and mounts the volume as usual.
+A private mount is not shared with other emount processes. Linux only.
+
+With --volume [NAME=]FOLDER[:MOUNT], another encrypted volume is mounted for
+the command. The flag may be repeated, and a profile may list volumes. Each
+volume has its own mount point, MOUNT or a temporary folder, passed to the
+command in EMOUNT_FOLDER_<NAME>, where NAME defaults to the folder name
+without its extension, in upper case. VOLUME is passed in its own variable
+too, and in EMOUNT_FOLDER. The volumes are mounted in order before the
+command starts, and unmounted in reverse order. If one can't be mounted, the
+ones already mounted are unmounted. --private is used with one volume only.
+
+Hooks are shell commands run around the mount: --pre-mount before the
+volume is mounted, --post-mount before the command starts, --pre-unmount
+after it exits, and --post-unmount after the volume is unmounted. They get
+EMOUNT_FOLDER, EMOUNT_CIPHER (the encrypted folder), EMOUNT_PROFILE, and
+EMOUNT_HOOK (the name of the hook) in the environment. If the pre-mount or
+post-mount hook fails, the command is not run. If the pre-unmount hook
+fails, the volume is unmounted anyway.
+
+Use -- before COMMAND if the command starts with '-'.`,
+			nargs:       1,
+			runsCommand: true,
+			flags: func(fs *flag.FlagSet, opt *options) {
+				fs.BoolVar(&opt.verbose, "v", false, "show progress messages")
+				passwordFlags(fs, opt)
+				runFlags(fs, opt)
+			},
+			parse: func(opt *options, cl *commandLine) error {
+				var p *profile
+				opt.run, p = cl.volume()
+				opt.runCmd = cl.rest
+				if p != nil {
+					opt.profile = cl.args[0]
+					p.apply(opt, cl.set)
+				}
+				if err := opt.pass.validate(); err != nil {
+					return err
+				}
+				return checkRunArgs(opt)
+			},
+		},
+		{
+			name:    "passwd",
+			args:    "VOLUME",
+			summary: "Change the password of a volume",
+			help: `Change the password of the encrypted VOLUME. The current password is
+obtained from the password source, and the user is prompted for the new
+password, which is checked the same way as with init. VOLUME/gocryptfs.conf
+is backed up before it is changed, and restored if the change fails.
+With --keyring, the new password is stored in the keyring.`,
+			nargs: 1,
+			flags: passwordFlags,
+			parse: func(opt *options, cl *commandLine) error {
+				var p *profile
+				opt.passwd, p = cl.volume()
+				if p != nil {
+					p.applyPassword(opt, cl.set)
+				}
+				if err := opt.pass.validate(); err != nil {
+					return err
+				}
+				return checkPasswdArgs(opt)
+			},
+		},
+		{
+			name:    "recover",
+			args:    "VOLUME",
+			summary: "Set a new password with the master key",
+			help: `Set a new password for the encrypted VOLUME, using its master key instead
+of the current password, for example when the password is forgotten. The key
+is read from the paper backup written by 'emount init --key-backup', or typed
+when prompted, and its check is confirmed. The volume is mounted read-only
+with the key, to check that its files can be decrypted, before the password
+is changed. VOLUME/gocryptfs.conf is backed up the same way as with passwd.
+With --keyring, the new password is stored in the keyring.`,
+			nargs: 1,
+			flags: func(fs *flag.FlagSet, opt *options) {
+				fs.StringVar(&opt.keyFile, "key-file", "",
+					"read the master key from this paper backup")
+				passwordFlags(fs, opt)
+			},
+			parse: func(opt *options, cl *commandLine) error {
+				var p *profile
+				opt.recover, p = cl.volume()
+				if p != nil {
+					p.applyPassword(opt, cl.set)
+				}
+				if err := opt.pass.validate(); err != nil {
+					return err
+				}
+				if checkFolder(opt.recover) != isDir {
+					return fmt.Errorf("invalid volume folder %s", opt.recover)
+				}
+				return nil
+			},
+		},
+		{
+			name:    "import",
+			args:    "VOLUME ARCHIVE",
+			summary: "Import a tar or zip archive into a volume",
+			help: `Import the files of ARCHIVE into the encrypted VOLUME. ARCHIVE is a .tar,
+.tar.gz, .tar.zst, or .zip file, or - to read a tar archive from stdin.
+The volume is mounted, or the mount of a running emount process is shared,
+and the entries are written straight into it, so the plaintext is not
+stored on disk. Permissions, modification times, symlinks, hard links, and
+extended attributes are kept. Entries that would be written outside the
+volume are skipped. Existing files are skipped, and existing folders keep
+their mode and time, unless --overwrite is given. .tar.zst archives need
+the zstd program.`,
+			nargs: 2,
+			flags: func(fs *flag.FlagSet, opt *options) {
+				fs.StringVar(&opt.format, "format", "",
+					"archive format: tar, tar.gz, tar.zst, zip (default from the name)")
+				fs.BoolVar(&opt.overwrite, "overwrite", false, "replace existing files")
+				fs.BoolVar(&opt.verbose, "v", false, "show progress messages")
+				passwordFlags(fs, opt)
+			},
+			parse: func(opt *options, cl *commandLine) error {
+				var p *profile
+				opt.importTo, p = cl.volume()
+				opt.archive = cl.args[1]
+				if p != nil {
+					p.applyPassword(opt, cl.set)
+				}
+				if err := opt.pass.validate(); err != nil {
+					return err
+				}
+				if _, err := archiveFormat(opt.archive, opt.format); err != nil {
+					return err
+				}
+				if checkFolder(opt.importTo) != isDir {
+					return fmt.Errorf("invalid volume folder %s", opt.importTo)
+				}
+				return nil
+			},
+		},
+		{
+			name:    "export",
+			args:    "VOLUME -o ARCHIVE",
+			summary: "Export the decrypted files of a volume to an archive",
+			help: `Write the decrypted files of VOLUME to ARCHIVE, a .tar, .tar.gz, .tar.zst,
+or .zip file, which must not exist, or - to write a tar archive to stdout.
+The volume is mounted, or the mount of a running emount process is shared,
+and its files are streamed into the archive. The archive is not encrypted.
+Permissions, modification times, symlinks, hard links, and extended
+attributes are kept in tar archives. .tar.zst archives need the zstd
+program.`,
+			nargs: 1,
+			flags: func(fs *flag.FlagSet, opt *options) {
+				fs.StringVar(&opt.archive, "o", "", "archive file to write, or - for stdout")
+				fs.StringVar(&opt.archive, "output", "", "archive file to write, or - for stdout")
+				fs.StringVar(&opt.format, "format", "",
+					"archive format: tar, tar.gz, tar.zst, zip (default from the name)")
+				fs.BoolVar(&opt.verbose, "v", false, "show progress messages")
+				passwordFlags(fs, opt)
+			},
+			parse: func(opt *options, cl *commandLine) error {
+				var p *profile
+				opt.exportFrom, p = cl.volume()
+				if p != nil {
+					p.applyPassword(opt, cl.set)
+				}
+				if opt.archive == "" {
+					return newUsageErr("export needs -o ARCHIVE")
+				}
+				if err := opt.pass.validate(); err != nil {
+					return err
+				}
+				if _, err := archiveFormat(opt.archive, opt.format); err != nil {
+					return err
+				}
+				if checkFolder(opt.exportFrom) != isDir {
+					return fmt.Errorf("invalid volume folder %s", opt.exportFrom)
+				}
+				return nil
+			},
+		},
+		{
+			name:    "agent",
+			summary: "Keep volumes mounted between runs",
+			help: `Start the agent, which keeps volumes mounted between runs of 'emount run',
+so that short commands don't ask for the password on every run. The agent
+runs in the background, and listens on a socket in $XDG_RUNTIME_DIR/emount.
+When 'emount run' has mounted a volume, the agent holds it for --lifetime
+(default 1h, or agent_lifetime in the config file; 0 holds it until it's
+locked), and later runs share the mount. The agent doesn't know the
+password. 'emount lock' releases volumes before their lifetime ends, and
+they are all released when the agent gets SIGTERM. Use
+'emount run --no-agent' to unmount the volume when the command exits, as
+without the agent. Runs with --idle-timeout or --private are not held, and
+volumes run with --lock-on-suspend are released when the session is locked
+or the system suspends.
+With --foreground, the agent doesn't detach, for example to run it as a
+service.`,
+			flags: func(fs *flag.FlagSet, opt *options) {
+				fs.DurationVar(&opt.lifetime, "lifetime", defaultAgentLifetime,
+					"how long a volume is held (0 until it's locked)")
+				fs.BoolVar(&opt.foreground, "foreground", false,
+					"run in the foreground")
+			},
+			parse: func(opt *options, cl *commandLine) error {
+				opt.agent = true
+				if !anySet(cl.set, "lifetime") && cl.cfg.AgentLifetime != nil {
+					opt.lifetime = cl.cfg.AgentLifetime.Duration
+				}
+				if opt.lifetime < 0 {
+					return newUsageErr("--lifetime may not be negative")
+				}
+				return nil
+			},
+		},
+		{
+			name:    "lock",
+			args:    "[VOLUME] [--all]",
+			summary: "Unmount volumes held by the agent",
+			help: `Release VOLUME, or with --all every volume, held by the agent, and unmount
+it. A volume that a running 'emount run' command is still using stays
+mounted until the command exits.`,
+			nargs:   1,
+			optArgs: true,
+			flags: func(fs *flag.FlagSet, opt *options) {
+				fs.BoolVar(&opt.lockAll, "all", false, "lock all volumes")
+			},
+			parse: func(opt *options, cl *commandLine) error {
+				if len(cl.args) > 0 {
+					opt.lock, _ = cl.volume()
+				}
+				if (opt.lock == "") == !opt.lockAll {
+					return newUsageErr("lock needs either VOLUME or --all")
+				}
+				return nil
+			},
+		},
+		{
+			name:    "status",
+			summary: "List the volumes mounted by emount",
+			help: `List the volumes mounted by running emount processes: the encrypted folder,
+the mount point, when it was mounted, the pids of the emount processes
+using it and of their commands, and the number of open files on the volume.
+With --json, the list is printed as JSON.`,
+			flags: func(fs *flag.FlagSet, opt *options) {
+				fs.BoolVar(&opt.json, "json", false, "output as JSON")
+			},
+			parse: func(opt *options, cl *commandLine) error {
+				opt.status = true
+				return nil
+			},
+		},
+		{
+			name:    "unmount",
+			args:    "VOLUME|MOUNTPOINT",
+			summary: "Stop the commands using a volume, and unmount it",
+			help: `Unmount a volume mounted by emount, given its encrypted folder, profile, or
+mount point. The emount processes using the volume get SIGTERM, which they
+forward to their commands, and the volume is unmounted when the commands
+have exited. Commands that are still running after 10 seconds are killed.
+A volume left mounted by an emount process that no longer exists is
+unmounted directly.`,
+			nargs: 1,
+			parse: func(opt *options, cl *commandLine) error {
+				opt.unmount, _ = cl.volume()
+				return nil
+			},
+		},
+		{
+			name:    "info",
+			args:    "VOLUME",
+			summary: "Show the settings of a volume",
+			help: `Show the settings of the encrypted VOLUME, from VOLUME/gocryptfs.conf: the
+gocryptfs version that created it, its feature flags, and the scrypt cost
+of the password. If the volume is mounted by emount, the mount point is
+shown. The password is not needed. With --json, the information is printed
+as JSON.`,
+			nargs: 1,
+			flags: func(fs *flag.FlagSet, opt *options) {
+				fs.BoolVar(&opt.json, "json", false, "output as JSON")
+			},
+			parse: func(opt *options, cl *commandLine) error {
+				opt.info, _ = cl.volume()
+				if checkFolder(opt.info) != isDir {
+					return fmt.Errorf("invalid volume folder %s", opt.info)
+				}
+				return nil
+			},
+		},
+		{
+			name:    "cleanup",
+			summary: "Unmount and remove stale emount mounts",
+			help: `Unmount volumes left mounted by emount processes that no longer exist,
+for example after a crash or a failed unmount, and remove unused emount_*
+mount points from TMPDIR. Volumes in use by a running emount process are
+not changed. emount run checks for these at startup, and offers to
+clean them up.`,
+			parse: func(opt *options, cl *commandLine) error {
+				opt.cleanup = true
+				return nil
+			},
+		},
+	}
+}
+
+// findCommand returns the command with the name, or nil
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// flagSet returns the flags of the command, which set opt
+func (c *command) flagSet(opt *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("emount "+c.name, flag.ContinueOnError)
+	// errors are reported by run, followed by the command's help
+	fs.SetOutput(ioutil.Discard)
+	if c.flags != nil {
+		c.flags(fs, opt)
+	}
+	configFlag(fs, opt)
+	return fs
+}
+
+// parseCommand parses the command line of a subcommand. args[0] is the name
+// of the command.
+func parseCommand(opt *options, args []string) error {
+	if args[0] == "help" {
+		return showHelp(args[1:])
+	}
+	c := findCommand(args[0])
+	if c == nil {
+		return newUsageErr(fmt.Sprintf("Unknown command %q", args[0]))
+	}
+	opt.pass = newPasswordSource()
+	fs := c.flagSet(opt)
+	pos, rest, err := parseInterspersed(fs, args[1:], c.nargs)
+	if err == flag.ErrHelp {
+		showCommandHelp(c)
+		return errHelp
+	}
+	if err != nil {
+		return &usageErr{message: err.Error(), command: c}
+	}
+	if len(pos) < c.nargs && !c.optArgs {
+		return &usageErr{message: fmt.Sprintf("Missing argument: emount %s %s",
+			c.name, c.args), command: c}
+	}
+	if len(rest) > 0 && !c.runsCommand {
+		return &usageErr{message: fmt.Sprintf("Unexpected arguments: %s",
+			strings.Join(rest, " ")), command: c}
+	}
+
+	cfg, err := loadConfig(opt.config)
+	if err != nil {
+		return err
+	}
+	if err = cfg.applyDefaults(); err != nil {
+		return err
+	}
+	err = c.parse(opt, &commandLine{
+		args: pos,
+		rest: rest,
+		set:  setFlags(fs),
+		cfg:  cfg,
+	})
+	if e, ok := err.(*usageErr); ok && e.command == nil {
+		e.command = c
+	}
+	return err
+}
+
+// parseInterspersed parses flags that may be before or after the
+// positional arguments. After max positional arguments, or after "--",
+// parsing stops, and the remaining arguments are returned in rest.
+func parseInterspersed(fs *flag.FlagSet, args []string, max int) (pos []string,
+	rest []string, err error) {
+
+	for {
+		if err = fs.Parse(args); err != nil {
+			return nil, nil, err
+		}
+		n := len(args) - fs.NArg()
+		dashdash := n > 0 && args[n-1] == "--"
+		args = fs.Args()
+		if dashdash {
+			for len(args) > 0 && len(pos) < max {
+				pos = append(pos, args[0])
+				args = args[1:]
+			}
+			return pos, args, nil
+		}
+		if len(args) == 0 || len(pos) == max {
+			return pos, args, nil
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
+	}
+}
+
+// volume returns the encrypted folder named by the first argument, and
+// its profile if the argument is the name of a profile in the config file.
+// An argument with a path separator is always a folder.
+func (cl *commandLine) volume() (string, *profile) {
+	arg := cl.args[0]
+	if !strings.ContainsRune(arg, filepath.Separator) {
+		if p, ok := cl.cfg.Profiles[arg]; ok {
+			return p.Cipher, p
+		}
+	}
+	return arg, nil
+}
+
+// showHelp implements emount help [COMMAND]
+func showHelp(args []string) error {
+	if len(args) == 0 {
+		showUsage()
+		return errHelp
+	}
+	c := findCommand(args[0])
+	if c == nil || len(args) > 1 {
+		return newUsageErr(fmt.Sprintf("Unknown command %q",
+			strings.Join(args, " ")))
+	}
+	showCommandHelp(c)
+	return errHelp
+}
+
+// showCommandHelp shows the description and flags of the command
+func showCommandHelp(c *command) {
+	fmt.Printf("Usage: emount %s [flags] %s\n\n%s\n\nFlags:\n", c.name, c.args, c.help)
+	fs := c.flagSet(&options{pass: newPasswordSource()})
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+}
+
+// passwordFlags defines the flags that select the password source
+func passwordFlags(fs *flag.FlagSet, opt *options) {
+	fs.IntVar(&opt.pass.fd, "passfd", -1,
+		"read password from the first line of this file descriptor")
+	fs.StringVar(&opt.pass.file, "passfile", "",
+		"read password from the first line of this file")
+	fs.StringVar(&opt.pass.extpass, "extpass", "",
+		"run this program to get the password")
+	fs.StringVar(&opt.pass.askpass, "askpass", opt.pass.askpass,
+		"password prompt: "+strings.Join(askBackends, ", "))
+	fs.StringVar(&opt.pass.pinentry, "pinentry", opt.pass.pinentry,
+		"pinentry program for --askpass pinentry")
+	fs.BoolVar(&opt.pass.keyring, "keyring", false,
+		"use the password stored in the keyring, and store new passwords")
+}
+
+// runFlags defines the flags for running a command on the volume
+func runFlags(fs *flag.FlagSet, opt *options) {
+	fs.BoolVar(&opt.private, "private", false,
+		"mount the volume in a private mount namespace (linux)")
+	fs.DurationVar(&opt.idleTimeout, "idle-timeout", 0,
+		"stop the command when the volume has been idle this long")
+	fs.BoolVar(&opt.lockSuspend, "lock-on-suspend", false,
+		"unmount the volume when the session locks or suspends (linux)")
+	fs.Var((*stringList)(&opt.envAllow), "env-allow",
+		"environment variables passed to command (default all)")
+	fs.Var((*stringList)(&opt.envDeny), "env-deny",
+		"environment variables removed from command environment")
+	fs.StringVar(&opt.mountPoint, "mount", "",
+		"mount point for decrypted content")
+	fs.StringVar(&opt.mountPoint, "m", "",
+		"mount point for decrypted content (shorthand)")
+	fs.Var((*volumeList)(&opt.volumes), "volume",
+		"another volume to mount, [NAME=]FOLDER[:MOUNT] (may be repeated)")
+	hookFlags(fs, &opt.hooks)
+	fs.BoolVar(&opt.noAgent, "no-agent", false,
+		"don't ask the agent to keep the volume mounted")
+}
+
+// configFlag defines the --config flag
+func configFlag(fs *flag.FlagSet, opt *options) {
+	fs.StringVar(&opt.config, "config", "",
+		"config file (default $XDG_CONFIG_HOME/emount/config.toml)")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+
+	savArgs, savEntropy := os.Args, minEntropy
+	defer func() {
+		os.Args, minEntropy = savArgs, savEntropy
+	}()
+
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	sav, had := os.LookupEnv(envConfigHome)
+	ok(t, os.Setenv(envConfigHome, dir))
+	defer func() {
+		if had {
+			_ = os.Setenv(envConfigHome, sav)
+		} else {
+			_ = os.Unsetenv(envConfigHome)
+		}
+	}()
+	cipher := filepath.Join(dir, "demo.enc")
+	okf(t, os.Mkdir(cipher, 0700))
+	okf(t, os.Mkdir(filepath.Join(dir, configDirName), 0700))
+	okf(t, ioutil.WriteFile(filepath.Join(dir, configDirName, configFileName), []byte(`
+[profile.demo]
+cipher = "`+cipher+`"
+command = ["/bin/echo", "a"]
+keyring = true
+`), 0600))
+
+	parse := func(args ...string) (*options, error) {
+		os.Args = append([]string{"prog"}, args...)
+		opt := &options{}
+		return opt, parseArgs(opt)
+	}
+
+	// flags before and after the volume; the command's flags are its own
+	opt, err := parse("run", "--env-deny", "HOME", cipher, "-v", "bash", "-c", "echo -v")
+	okf(t, err)
+	assert(t, opt.run == cipher, "run folder", opt.run)
+	assert(t, opt.verbose, "flag after volume", opt.verbose)
+	assert(t, len(opt.envDeny) == 1, "flag before volume", opt.envDeny)
+	assert(t, strings.HasSuffix(opt.runCmd[0], "/bash") &&
+		strings.Join(opt.runCmd[1:], " ") == "-c echo -v", "command", opt.runCmd)
+
+	opt, err = parse("run", cipher, "--", "/bin/echo", "-m")
+	okf(t, err)
+	assert(t, opt.mountPoint == "" && len(opt.runCmd) == 2, "command after --", opt.runCmd)
+
+	// a profile name is a volume
+	opt, err = parse("run", "demo", "--keyring=false", "b")
+	okf(t, err)
+	assert(t, opt.run == cipher && opt.profile == "demo", "profile", opt.run)
+	assert(t, strings.Join(opt.runCmd, " ") == "/bin/echo a b", "profile command", opt.runCmd)
+	assert(t, !opt.pass.keyring, "flag overrides profile", opt.pass.keyring)
+
+	opt, err = parse("passwd", "demo")
+	okf(t, err)
+	assert(t, opt.passwd == cipher && opt.pass.keyring, "passwd profile", opt.passwd)
+
+	opt, err = parse("status", "--json")
+	okf(t, err)
+	assert(t, opt.status && opt.json, "status", opt)
+
+	opt, err = parse("unmount", cipher)
+	okf(t, err)
+	assert(t, opt.unmount == cipher, "unmount", opt.unmount)
+
+	// flags of other commands are rejected
+	_, err = parse("passwd", cipher, "--mount", dir)
+	assert(t, isUsageErr(err), "passwd --mount", err)
+	_, err = parse("status", "extra")
+	assert(t, isUsageErr(err), "status with args", err)
+	_, err = parse("run")
+	assert(t, isUsageErr(err), "run without volume", err)
+	_, err = parse("mount", cipher)
+	assert(t, isUsageErr(err), "unknown command", err)
+
+	_, err = parse("run", "-h")
+	assert(t, err == errHelp, "run -h", err)
+	_, err = parse("help", "init")
+	assert(t, err == errHelp, "help init", err)
+
+	// the legacy flags still work
+	opt, err = parse("--status")
+	okf(t, err)
+	assert(t, opt.status, "--status", opt.status)
+}
+
+func TestInfoAndUnmount(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	newCrypt, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(newCrypt)
+	}()
+	okf(t, initCryptVol(newCrypt, "", nil))
+
+	info, err := readVolumeInfo(newCrypt)
+	okf(t, err)
+	assert(t, info.Version > 0 && len(info.FeatureFlags) > 0, "info", info)
+	assert(t, *info.Options == *defaultCryptOptions(), "default options", info.Options)
+	assert(t, info.MountPoint == "", "not mounted", info.MountPoint)
+	var buf bytes.Buffer
+	ok(t, printInfo(&buf, info, false))
+	assert(t, strings.Contains(buf.String(), "feature flags:"), "text", buf.String())
+
+	err = runUnmount(newCrypt)
+	assert(t, err != nil, "unmount when not mounted", err)
+
+	// a mount left by an emount process that no longer exists
+	vol, err := acquireMount(newCrypt, "", nil)
+	okf(t, err)
+	lock, err := lockVolume(vol.cipher)
+	okf(t, err)
+	st, err := lock.read()
+	okf(t, err)
+	st.Users[0].PID = 1 << 22 // above pid_max
+	okf(t, lock.write(st))
+	lock.unlock()
+
+	info, err = readVolumeInfo(newCrypt)
+	okf(t, err)
+	assert(t, info.MountPoint == "", "stale mount is not shown", info.MountPoint)
+
+	ok(t, runUnmount(vol.mountPoint))
+	assert(t, !isMountPoint(vol.mountPoint), "unmounted", vol.mountPoint)
+	st, err = findMount(newCrypt)
+	ok(t, err)
+	assert(t, st == nil, "state removed", st)
+}
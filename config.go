@@ -0,0 +1,283 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// The config file, $XDG_CONFIG_HOME/emount/config.toml, has global defaults
+// and named volume profiles:
+//
+//	min_entropy = 40.0
+//
+//	[profile.joplin]
+//	cipher = "~/.config/joplin.enc"
+//	mount = "~/.config/joplin"
+//	command = ["/usr/bin/joplin"]
+//	keyring = true
+//	idle_timeout = "30m"
+//	lock_on_suspend = true
+//
+//	[[profile.joplin.volume]]
+//	name = "secrets"
+//	cipher = "~/secrets.enc"
+//
+// Command-line flags override the profile, which overrides the global
+// defaults.
+
+const (
+	configDirName  = "emount"
+	configFileName = "config.toml"
+	envConfigHome  = "XDG_CONFIG_HOME"
+)
+
+// config is the contents of the config file
+type config struct {
+	MinEntropy       *float64            `toml:"min_entropy"`
+	DirMode          string              `toml:"dir_mode"` // octal, e.g., "0700"
+	TmpFolderPattern string              `toml:"tmp_folder_pattern"`
+	AgentLifetime    *duration           `toml:"agent_lifetime"`
+	Profiles         map[string]*profile `toml:"profile"`
+}
+
+// profile is a named volume, with the options used to run it
+type profile struct {
+	Cipher      string   `toml:"cipher"`
+	Mount       string   `toml:"mount"`
+	Command     []string `toml:"command"`
+	PassFile    string   `toml:"passfile"`
+	ExtPass     string   `toml:"extpass"`
+	Askpass     string   `toml:"askpass"`
+	Pinentry    string   `toml:"pinentry"`
+	Keyring     bool     `toml:"keyring"`
+	EnvAllow    []string `toml:"env_allow"`
+	EnvDeny     []string `toml:"env_deny"`
+	IdleTimeout duration `toml:"idle_timeout"`
+	Private     bool     `toml:"private"`
+	LockSuspend bool     `toml:"lock_on_suspend"`
+	MinEntropy  *float64 `toml:"min_entropy"`
+	PreMount    string   `toml:"pre_mount"`
+	PostMount   string   `toml:"post_mount"`
+	PreUnmount  string   `toml:"pre_unmount"`
+	PostUnmount string   `toml:"post_unmount"`
+	Volumes     []volume `toml:"volume"` // more volumes mounted for run
+}
+
+// duration is a time.Duration in the config file, e.g., "1h30m"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// defaultConfigPath returns the path of the config file
+func defaultConfigPath() string {
+	dir := os.Getenv(envConfigHome)
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, configDirName, configFileName)
+}
+
+// loadConfig reads the config file. If path is empty, the default path
+// is used, and it's not an error if the file doesn't exist.
+func loadConfig(path string) (*config, error) {
+	required := path != ""
+	if !required {
+		path = defaultConfigPath()
+	}
+	cfg := &config{}
+	if path == "" {
+		return cfg, nil
+	}
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return cfg, nil
+		}
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		var keys []string
+		for _, k := range undecoded {
+			keys = append(keys, k.String())
+		}
+		return nil, fmt.Errorf("config file %s: unknown settings: %s",
+			path, strings.Join(keys, ", "))
+	}
+	for name, p := range cfg.Profiles {
+		if p.Cipher == "" {
+			return nil, fmt.Errorf("config file %s: profile %s has no cipher",
+				path, name)
+		}
+		p.Cipher = expandPath(p.Cipher)
+		p.Mount = expandPath(p.Mount)
+		p.PassFile = expandPath(p.PassFile)
+		for i := range p.Volumes {
+			v := &p.Volumes[i]
+			if v.Cipher == "" {
+				return nil, fmt.Errorf("config file %s: a volume of profile "+
+					"%s has no cipher", path, name)
+			}
+			v.Cipher = expandPath(v.Cipher)
+			v.Mount = expandPath(v.Mount)
+		}
+	}
+	return cfg, nil
+}
+
+// applyDefaults sets the global defaults from the config file
+func (cfg *config) applyDefaults() error {
+	if cfg.MinEntropy != nil {
+		minEntropy = *cfg.MinEntropy
+	}
+	if cfg.DirMode != "" {
+		mode, err := strconv.ParseUint(cfg.DirMode, 8, 32)
+		if err != nil || mode&^0777 != 0 || mode&0700 != 0700 {
+			return fmt.Errorf("invalid dir_mode %q in config file: it must be "+
+				"an octal mode, at least 0700", cfg.DirMode)
+		}
+		dirMode = os.FileMode(mode)
+	}
+	if cfg.TmpFolderPattern != "" {
+		if strings.ContainsAny(cfg.TmpFolderPattern, `/*`) {
+			return fmt.Errorf("invalid tmp_folder_pattern %q in config file",
+				cfg.TmpFolderPattern)
+		}
+		tmpFolderPattern = cfg.TmpFolderPattern
+	}
+	return nil
+}
+
+// profile returns the named profile
+func (cfg *config) profile(name string) (*profile, error) {
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		var names []string
+		for n := range cfg.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return nil, fmt.Errorf("profile %s not found: the config file "+
+				"%s has no profiles", name, defaultConfigPath())
+		}
+		return nil, fmt.Errorf("profile %s not found. Profiles: %s",
+			name, strings.Join(names, ", "))
+	}
+	return p, nil
+}
+
+// apply sets the options from the profile, except those set by flags.
+// set has the names of the flags on the command line. Arguments after the
+// flags are appended to the profile's command.
+func (p *profile) apply(opt *options, set map[string]bool) {
+	if !anySet(set, "run", "r") {
+		opt.run = p.Cipher
+	}
+	if !anySet(set, "mount", "m") {
+		opt.mountPoint = p.Mount
+	}
+	if len(opt.volumes) == 0 {
+		opt.volumes = p.Volumes
+	}
+	if len(p.Command) > 0 {
+		opt.runCmd = append(append([]string{}, p.Command...), opt.runCmd...)
+	}
+	p.applyPassword(opt, set)
+	if !anySet(set, "env-allow") {
+		opt.envAllow = p.EnvAllow
+	}
+	if !anySet(set, "env-deny") {
+		opt.envDeny = p.EnvDeny
+	}
+	if !anySet(set, "idle-timeout") {
+		opt.idleTimeout = p.IdleTimeout.Duration
+	}
+	if !anySet(set, "private") {
+		opt.private = p.Private
+	}
+	if !anySet(set, "lock-on-suspend") {
+		opt.lockSuspend = p.LockSuspend
+	}
+	if !anySet(set, hookPreMount) {
+		opt.hooks.preMount = p.PreMount
+	}
+	if !anySet(set, hookPostMount) {
+		opt.hooks.postMount = p.PostMount
+	}
+	if !anySet(set, hookPreUnmount) {
+		opt.hooks.preUnmount = p.PreUnmount
+	}
+	if !anySet(set, hookPostUnmount) {
+		opt.hooks.postUnmount = p.PostUnmount
+	}
+}
+
+// applyPassword sets the password source and min_entropy from the profile,
+// except those set by flags
+func (p *profile) applyPassword(opt *options, set map[string]bool) {
+	// a password source flag replaces the profile's password source
+	if !anySet(set, "passfd", "passfile", "extpass") {
+		opt.pass.file = p.PassFile
+		opt.pass.extpass = p.ExtPass
+	}
+	if !anySet(set, "askpass") && p.Askpass != "" {
+		opt.pass.askpass = p.Askpass
+	}
+	if !anySet(set, "pinentry") && p.Pinentry != "" {
+		opt.pass.pinentry = p.Pinentry
+	}
+	if !anySet(set, "keyring") {
+		opt.pass.keyring = p.Keyring
+	}
+	if p.MinEntropy != nil {
+		minEntropy = *p.MinEntropy
+	}
+}
+
+// anySet returns true if one of the flags is in set
+func anySet(set map[string]bool, names ...string) bool {
+	for _, n := range names {
+		if set[n] {
+			return true
+		}
+	}
+	return false
+}
+
+// setFlags returns the names of the flags set on the command line
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// expandPath expands a leading ~ to the home directory, and environment
+// variables such as $HOME
+func expandPath(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = home + path[1:]
+		}
+	}
+	return os.ExpandEnv(path)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigProfile(t *testing.T) {
+
+	savArgs, savFlags := os.Args, flag.CommandLine
+	savEntropy, savMode, savPattern := minEntropy, dirMode, tmpFolderPattern
+	defer func() {
+		os.Args, flag.CommandLine = savArgs, savFlags
+		minEntropy, dirMode, tmpFolderPattern = savEntropy, savMode, savPattern
+	}()
+
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	sav, had := os.LookupEnv(envConfigHome)
+	ok(t, os.Setenv(envConfigHome, dir))
+	defer func() {
+		if had {
+			_ = os.Setenv(envConfigHome, sav)
+		} else {
+			_ = os.Unsetenv(envConfigHome)
+		}
+	}()
+	cipher := filepath.Join(dir, "demo.enc")
+	okf(t, os.Mkdir(cipher, 0700))
+	okf(t, os.Mkdir(filepath.Join(dir, configDirName), 0700))
+	cfgPath := filepath.Join(dir, configDirName, configFileName)
+	okf(t, ioutil.WriteFile(cfgPath, []byte(`
+min_entropy = 30.0
+dir_mode = "0750"
+
+[profile.demo]
+cipher = "$`+envConfigHome+`/demo.enc"
+command = ["/bin/echo", "a"]
+keyring = true
+idle_timeout = "1m"
+env_allow = ["PATH", "XDG_*"]
+`), 0600))
+
+	flag.CommandLine = flag.NewFlagSet("prog", flag.ContinueOnError)
+	os.Args = []string{"prog", "--profile", "demo", "--keyring=false", "b"}
+	var opt options
+	okf(t, parseArgs(&opt))
+	assert(t, opt.run == cipher, "cipher from profile", opt.run)
+	assert(t, strings.Join(opt.runCmd, " ") == "/bin/echo a b",
+		"command with args", opt.runCmd)
+	assert(t, !opt.pass.keyring, "flag overrides profile", opt.pass.keyring)
+	assert(t, opt.idleTimeout == time.Minute, "idle timeout", opt.idleTimeout)
+	assert(t, len(opt.envAllow) == 2, "env allow", opt.envAllow)
+	assert(t, minEntropy == 30.0 && dirMode == 0750, "global defaults",
+		minEntropy, dirMode)
+
+	flag.CommandLine = flag.NewFlagSet("prog", flag.ContinueOnError)
+	os.Args = []string{"prog", "--profile", "nosuch"}
+	err = parseArgs(&options{})
+	assert(t, err != nil && strings.Contains(err.Error(), "Profiles: demo"),
+		"unknown profile", err)
+
+	// unknown settings are reported, to catch typos
+	okf(t, ioutil.WriteFile(cfgPath, []byte("min_entropi = 30.0\n"), 0600))
+	_, err = loadConfig("")
+	assert(t, err != nil && strings.Contains(err.Error(), "min_entropi"),
+		"unknown setting", err)
+
+	// a missing default config file is not an error, but --config is
+	ok(t, os.Remove(cfgPath))
+	_, err = loadConfig("")
+	ok(t, err)
+	_, err = loadConfig(cfgPath)
+	assert(t, err != nil, "missing --config file", err)
+}
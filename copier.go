@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/sys/unix"
+)
+
+// The copier of init --from. Each kind of file is handled explicitly, and
+// anything that can't be copied is reported in the summary:
+//   - regular files: contents, permission bits, and modification time
+//   - folders: permission bits and modification time, set after their
+//     contents are copied, so read-only folders can be copied
+//   - symlinks: recreated with the same target, which is not followed, and
+//     the modification time of the link
+//   - hard links: files with several links in the source folder are linked
+//     the same way in the volume
+//   - FIFOs: recreated
+//   - sockets and device files: skipped
+//   - extended attributes: copied; those the volume doesn't support
+//     (gocryptfs supports user.* attributes) are skipped
+//   - ownership and access times are not preserved
+// Files and folders matching an --exclude pattern are left out.
+
+// progressInterval is how often the progress is shown without a terminal
+const progressInterval = 10 * time.Second
+
+// sourceEntry is an item of the source folder
+type sourceEntry struct {
+	rel    string // path relative to the source folder
+	fi     os.FileInfo
+	linkTo string // for a hard link, the first entry linked to the same file
+}
+
+// sourceTree is the list of items to copy from the source folder
+type sourceTree struct {
+	root     string
+	entries  []sourceEntry // a folder comes before its contents
+	files    int           // regular files, not counting extra hard links
+	bytes    int64         // bytes in files
+	excluded int           // items matching an --exclude pattern
+}
+
+// fileID identifies a file for hard links
+type fileID struct {
+	dev, ino uint64
+}
+
+// isExcluded returns true if the item matches one of the patterns. Patterns
+// are shell patterns matched against the name of the item, or, if they
+// contain a "/", against its path relative to the source folder.
+func isExcluded(rel string, patterns []string) bool {
+	rel = filepath.ToSlash(rel)
+	base := filepath.Base(rel)
+	for _, p := range patterns {
+		p = strings.TrimSuffix(p, "/")
+		name := base
+		if strings.Contains(p, "/") {
+			p, name = strings.TrimPrefix(p, "/"), rel
+		}
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// scanSource lists the items of the source folder, without those that
+// match one of the exclude patterns
+func scanSource(root string, exclude []string) (*sourceTree, error) {
+	t := &sourceTree{root: root}
+	inodes := make(map[fileID]string)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if isExcluded(rel, exclude) {
+			t.excluded++
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		e := sourceEntry{rel: rel, fi: fi}
+		if fi.Mode().IsRegular() {
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+				id := fileID{uint64(st.Dev), uint64(st.Ino)}
+				if first, ok := inodes[id]; ok {
+					e.linkTo = first
+				} else {
+					inodes[id] = rel
+				}
+			}
+			if e.linkTo == "" {
+				t.files++
+				t.bytes += fi.Size()
+			}
+		}
+		t.entries = append(t.entries, e)
+		return nil
+	})
+	return t, err
+}
+
+// copySummary is what was copied, and what was skipped
+type copySummary struct {
+	files     int
+	bytes     int64
+	dirs      int
+	symlinks  int
+	hardlinks int
+	fifos     int
+	excluded  int
+	skipped   []string // items or attributes not copied, and why
+}
+
+func (s *copySummary) skip(format string, args ...interface{}) {
+	s.skipped = append(s.skipped, fmt.Sprintf(format, args...))
+}
+
+// print writes the summary of the copy
+func (s *copySummary) print(w io.Writer, src string) {
+	fmt.Fprintf(w, "Copied %d files (%s), %d folders, %d symlinks, %d hard links, "+
+		"and %d FIFOs from %s\n", s.files, formatSize(s.bytes), s.dirs, s.symlinks,
+		s.hardlinks, s.fifos, src)
+	if s.excluded > 0 {
+		fmt.Fprintf(w, "%d items matching --exclude were left out\n", s.excluded)
+	}
+	if len(s.skipped) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Skipped %d items or attributes:\n", len(s.skipped))
+	for i, line := range s.skipped {
+		if i == maxReportItems {
+			fmt.Fprintf(w, "  ... and %d more\n", len(s.skipped)-maxReportItems)
+			break
+		}
+		fmt.Fprintf(w, "  %s\n", line)
+	}
+}
+
+// copyTree copies the items of the source folder into dst, and returns the
+// summary, and the hashes of the files and the symlink targets, to verify
+// the copy
+func copyTree(t *sourceTree, dst string, p *progress) (*copySummary, []sourceFile, error) {
+	s := &copySummary{excluded: t.excluded}
+	var files []sourceFile
+	sums := make(map[string][sha256.Size]byte)
+	var dirs []sourceEntry
+	p.begin("Copying", t.files, t.bytes)
+	defer p.end()
+
+	for _, e := range t.entries {
+		src, path := filepath.Join(t.root, e.rel), filepath.Join(dst, e.rel)
+		mode := e.fi.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.Mkdir(path, 0700); err != nil {
+				return nil, nil, err
+			}
+			copyXattrs(src, path, e.rel, s)
+			dirs = append(dirs, e)
+			s.dirs++
+
+		case mode.IsRegular() && e.linkTo != "":
+			sum := sums[e.linkTo]
+			if err := os.Link(filepath.Join(dst, e.linkTo), path); err != nil {
+				s.skip("%s: hard link to %s copied as a separate file (%v)",
+					e.rel, e.linkTo, err)
+				var n int64
+				if sum, n, err = copyFile(src, path, e.fi, p); err != nil {
+					return nil, nil, err
+				}
+				s.bytes += n
+				copyXattrs(src, path, e.rel, s)
+			} else {
+				s.hardlinks++
+			}
+			files = append(files, sourceFile{rel: e.rel, size: e.fi.Size(), sum: sum})
+
+		case mode.IsRegular():
+			sum, n, err := copyFile(src, path, e.fi, p)
+			if err != nil {
+				return nil, nil, err
+			}
+			copyXattrs(src, path, e.rel, s)
+			sums[e.rel] = sum
+			files = append(files, sourceFile{rel: e.rel, size: n, sum: sum})
+			s.files++
+			s.bytes += n
+			p.add(1, 0)
+
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(src)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err = os.Symlink(target, path); err != nil {
+				return nil, nil, err
+			}
+			mtime := unix.NsecToTimeval(e.fi.ModTime().UnixNano())
+			if err = unix.Lutimes(path, []unix.Timeval{mtime, mtime}); err != nil {
+				s.skip("%s: modification time of the symlink not set (%v)", e.rel, err)
+			}
+			files = append(files, sourceFile{rel: e.rel, target: target, link: true})
+			s.symlinks++
+
+		case mode&os.ModeNamedPipe != 0:
+			if err := syscall.Mkfifo(path, uint32(mode.Perm())); err != nil {
+				s.skip("%s: FIFO not created (%v)", e.rel, err)
+				continue
+			}
+			_ = os.Chtimes(path, time.Now(), e.fi.ModTime())
+			s.fifos++
+
+		case mode&os.ModeSocket != 0:
+			s.skip("%s: socket", e.rel)
+		case mode&os.ModeDevice != 0:
+			s.skip("%s: device file", e.rel)
+		default:
+			s.skip("%s: unsupported file type %v", e.rel, mode.Type())
+		}
+	}
+
+	// set the permissions and times of the folders, deepest first, after
+	// their contents are copied
+	for i := len(dirs) - 1; i >= 0; i-- {
+		e := dirs[i]
+		path := filepath.Join(dst, e.rel)
+		if err := os.Chmod(path, e.fi.Mode().Perm()); err != nil {
+			return nil, nil, err
+		}
+		if err := os.Chtimes(path, time.Now(), e.fi.ModTime()); err != nil {
+			return nil, nil, err
+		}
+	}
+	return s, files, nil
+}
+
+// copyFile copies a regular file, with its permission bits and modification
+// time, and returns the hash and the size of the data copied
+func copyFile(src string, dst string, fi os.FileInfo, p *progress) ([sha256.Size]byte, int64, error) {
+	var sum [sha256.Size]byte
+	in, err := os.Open(src)
+	if err != nil {
+		return sum, 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return sum, 0, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h, progressWriter{p}), in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(dst, fi.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Chtimes(dst, time.Now(), fi.ModTime())
+	}
+	if err != nil {
+		return sum, 0, err
+	}
+	h.Sum(sum[:0])
+	return sum, n, nil
+}
+
+// copyXattrs copies the extended attributes of src to dst. Attributes
+// that can't be read or set are added to the skipped items.
+func copyXattrs(src string, dst string, rel string, s *copySummary) {
+	names, err := listXattrs(src)
+	if err != nil {
+		s.skip("%s: extended attributes not copied (%v)", rel, err)
+		return
+	}
+	for _, name := range names {
+		value, err := getXattr(src, name)
+		if err == nil {
+			err = unix.Lsetxattr(dst, name, value, 0)
+		}
+		if err != nil {
+			s.skip("%s: extended attribute %s not copied (%v)", rel, name, err)
+		}
+	}
+}
+
+// listXattrs returns the names of the extended attributes of the file
+func listXattrs(path string) ([]string, error) {
+	n, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP || n == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if n, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(string(buf[:n]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// getXattr returns the value of an extended attribute of the file
+func getXattr(path string, name string) ([]byte, error) {
+	n, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if n, err = unix.Lgetxattr(path, name, buf); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// progress shows the progress of copying or verifying: the files and bytes
+// done, and the estimated time left. On a terminal, the line on stderr is
+// redrawn. Otherwise, with -v, a line is printed every progressInterval.
+// A nil progress, or one without w, shows nothing.
+type progress struct {
+	w          io.Writer
+	live       bool // redraw the line on a terminal
+	phase      string
+	files      int
+	totalFiles int
+	bytes      int64
+	totalBytes int64
+	start      time.Time
+	shown      time.Time
+}
+
+func newProgress(verbose bool) *progress {
+	p := &progress{}
+	if terminal.IsTerminal(int(os.Stderr.Fd())) {
+		p.w, p.live = os.Stderr, true
+	} else if verbose {
+		p.w = os.Stdout
+	}
+	return p
+}
+
+// begin starts a phase with the totals expected
+func (p *progress) begin(phase string, totalFiles int, totalBytes int64) {
+	if p == nil {
+		return
+	}
+	p.phase, p.totalFiles, p.totalBytes = phase, totalFiles, totalBytes
+	p.files, p.bytes = 0, 0
+	p.start = time.Now()
+	p.shown = p.start
+}
+
+// add adds files and bytes done, and shows the progress if it's time
+func (p *progress) add(files int, bytes int64) {
+	if p == nil || p.w == nil {
+		return
+	}
+	p.files += files
+	p.bytes += bytes
+	interval := progressInterval
+	if p.live {
+		interval = 200 * time.Millisecond
+	}
+	if time.Since(p.shown) >= interval {
+		p.show()
+	}
+}
+
+// end shows the final progress of the phase
+func (p *progress) end() {
+	if p == nil || p.w == nil {
+		return
+	}
+	p.show()
+	if p.live {
+		fmt.Fprintln(p.w)
+	}
+}
+
+func (p *progress) show() {
+	p.shown = time.Now()
+	line := fmt.Sprintf("%s: %d/%d files, %s/%s", p.phase, p.files, p.totalFiles,
+		formatSize(p.bytes), formatSize(p.totalBytes))
+	if p.totalFiles == 0 && p.totalBytes == 0 {
+		// the totals are not known
+		line = fmt.Sprintf("%s: %d files, %s", p.phase, p.files, formatSize(p.bytes))
+	}
+	elapsed := time.Since(p.start)
+	if p.bytes > 0 && p.bytes < p.totalBytes && elapsed > time.Second {
+		left := time.Duration(float64(elapsed) / float64(p.bytes) *
+			float64(p.totalBytes-p.bytes))
+		line += fmt.Sprintf(", ETA %s", left.Round(time.Second))
+	}
+	if p.live {
+		// clear to the end of the line
+		fmt.Fprintf(p.w, "\r%s\033[K", line)
+	} else {
+		fmt.Fprintln(p.w, line)
+	}
+}
+
+// progressWriter counts the bytes written as progress
+type progressWriter struct {
+	p *progress
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	w.p.add(0, int64(len(b)))
+	return len(b), nil
+}
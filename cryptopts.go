@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// gocryptfs settings chosen when a volume is created. They are recorded by
+// gocryptfs in the feature flags and scrypt parameters of gocryptfs.conf,
+// and emount info reads them back from there.
+
+const (
+	defaultScryptN = 16 // gocryptfs default cost, 2^16
+	minScryptN     = 10
+	maxScryptN     = 28
+)
+
+// file name encryption modes
+const (
+	namesEME           = "eme"           // EME with a per-directory IV (default)
+	namesDeterministic = "deterministic" // EME without per-directory IVs
+	namesPlaintext     = "plaintext"     // names are not encrypted
+)
+
+var nameModes = []string{namesEME, namesDeterministic, namesPlaintext}
+
+// cryptOptions are the gocryptfs options for a new volume
+type cryptOptions struct {
+	Names     string `json:"names"`     // file name encryption, one of nameModes
+	XChaCha   bool   `json:"xchacha"`   // XChaCha20-Poly1305 instead of AES-256-GCM
+	AESSIV    bool   `json:"aessiv"`    // AES-SIV, deterministic content encryption
+	LongNames bool   `json:"longNames"` // encrypted names over 255 bytes are stored in extra files
+	Raw64     bool   `json:"raw64"`     // encrypted names use unpadded base64
+	ScryptN   int    `json:"scryptN"`   // log2 of the scrypt cost of the password
+}
+
+// defaultCryptOptions returns the gocryptfs defaults
+func defaultCryptOptions() *cryptOptions {
+	return &cryptOptions{
+		Names:     namesEME,
+		LongNames: true,
+		Raw64:     true,
+		ScryptN:   defaultScryptN,
+	}
+}
+
+// cryptFlags defines the flags for the gocryptfs options of init
+func cryptFlags(fs *flag.FlagSet, o *cryptOptions) {
+	fs.StringVar(&o.Names, "names", o.Names,
+		"file name encryption: "+strings.Join(nameModes, ", "))
+	fs.Var((*plaintextNamesFlag)(&o.Names), "plaintextnames",
+		"do not encrypt file names (same as --names plaintext)")
+	fs.BoolVar(&o.XChaCha, "xchacha", o.XChaCha,
+		"encrypt content with XChaCha20-Poly1305, for CPUs without AES-NI")
+	fs.BoolVar(&o.AESSIV, "aessiv", o.AESSIV,
+		"encrypt content with AES-SIV, which is deterministic")
+	fs.BoolVar(&o.LongNames, "longnames", o.LongNames,
+		"store encrypted names longer than 255 bytes in extra files")
+	fs.BoolVar(&o.Raw64, "raw64", o.Raw64,
+		"use unpadded base64 for encrypted names")
+	fs.IntVar(&o.ScryptN, "scryptn", o.ScryptN,
+		fmt.Sprintf("scrypt cost of the password, as log2 (%d-%d)", minScryptN, maxScryptN))
+}
+
+// plaintextNamesFlag is --plaintextnames, which sets the name encryption
+type plaintextNamesFlag string
+
+func (f *plaintextNamesFlag) String() string {
+	return strconv.FormatBool(f != nil && string(*f) == namesPlaintext)
+}
+
+func (f *plaintextNamesFlag) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if v {
+		*f = namesPlaintext
+	} else if *f == namesPlaintext {
+		*f = namesEME
+	}
+	return nil
+}
+
+func (f *plaintextNamesFlag) IsBoolFlag() bool {
+	return true
+}
+
+// validate checks that the options can be used together
+func (o *cryptOptions) validate() error {
+	valid := false
+	for _, m := range nameModes {
+		valid = valid || o.Names == m
+	}
+	if !valid {
+		return newUsageErr(fmt.Sprintf("invalid --names %q: use one of %s",
+			o.Names, strings.Join(nameModes, ", ")))
+	}
+	if o.XChaCha && o.AESSIV {
+		return newUsageErr("--xchacha and --aessiv select different content " +
+			"encryption, and may not be used together")
+	}
+	if o.Names == namesPlaintext && (!o.LongNames || !o.Raw64) {
+		return newUsageErr("--longnames and --raw64 only apply to encrypted " +
+			"file names, and are not used with plaintext names")
+	}
+	if o.ScryptN < minScryptN || o.ScryptN > maxScryptN {
+		return newUsageErr(fmt.Sprintf("--scryptn must be between %d and %d",
+			minScryptN, maxScryptN))
+	}
+	return nil
+}
+
+// initArgs returns the gocryptfs -init arguments for the options that
+// are not the default
+func (o *cryptOptions) initArgs() []string {
+	var args []string
+	switch o.Names {
+	case namesPlaintext:
+		args = append(args, "-plaintextnames")
+	case namesDeterministic:
+		args = append(args, "-deterministic-names")
+	}
+	if o.XChaCha {
+		args = append(args, "-xchacha")
+	}
+	if o.AESSIV {
+		args = append(args, "-aessiv")
+	}
+	if !o.LongNames {
+		args = append(args, "-longnames=false")
+	}
+	if !o.Raw64 {
+		args = append(args, "-raw64=false")
+	}
+	if o.ScryptN != defaultScryptN {
+		args = append(args, "-scryptn", strconv.Itoa(o.ScryptN))
+	}
+	return args
+}
+
+// contentCipher returns the name of the content encryption
+func (o *cryptOptions) contentCipher() string {
+	switch {
+	case o.XChaCha:
+		return "XChaCha20-Poly1305"
+	case o.AESSIV:
+		return "AES-SIV-512"
+	}
+	return "AES-256-GCM"
+}
+
+// describeNames returns the file name settings, e.g., "eme, long names, raw64"
+func (o *cryptOptions) describeNames() string {
+	if o.Names == namesPlaintext {
+		return namesPlaintext
+	}
+	desc := []string{o.Names}
+	if o.LongNames {
+		desc = append(desc, "long names")
+	}
+	if o.Raw64 {
+		desc = append(desc, "raw64")
+	}
+	return strings.Join(desc, ", ")
+}
+
+// cryptOptionsFromConfig returns the options recorded in gocryptfs.conf
+func cryptOptionsFromConfig(conf *gocryptfsConfig, scryptN int) *cryptOptions {
+	has := make(map[string]bool)
+	for _, f := range conf.FeatureFlags {
+		has[f] = true
+	}
+	o := &cryptOptions{
+		Names:     namesEME,
+		XChaCha:   has["XChaCha20Poly1305"],
+		AESSIV:    has["AESSIV"],
+		LongNames: has["LongNames"],
+		Raw64:     has["Raw64"],
+		ScryptN:   scryptN,
+	}
+	switch {
+	case has["PlaintextNames"]:
+		o.Names = namesPlaintext
+	case !has["DirIV"]:
+		o.Names = namesDeterministic
+	}
+	return o
+}
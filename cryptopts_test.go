@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCryptOptions(t *testing.T) {
+
+	o := defaultCryptOptions()
+	ok(t, o.validate())
+	assert(t, len(o.initArgs()) == 0, "defaults have no args", o.initArgs())
+
+	o.XChaCha, o.AESSIV = true, true
+	assert(t, isUsageErr(o.validate()), "xchacha and aessiv", o)
+
+	o = defaultCryptOptions()
+	o.Names, o.Raw64 = namesPlaintext, false
+	assert(t, isUsageErr(o.validate()), "plaintext names with raw64=false", o)
+
+	o = defaultCryptOptions()
+	o.ScryptN = 30
+	assert(t, isUsageErr(o.validate()), "scryptn range", o)
+
+	o = defaultCryptOptions()
+	o.Names = "rot13"
+	assert(t, isUsageErr(o.validate()), "unknown names", o)
+
+	o = defaultCryptOptions()
+	o.Names, o.XChaCha, o.LongNames, o.ScryptN = namesDeterministic, true, false, 20
+	ok(t, o.validate())
+	assert(t, strings.Join(o.initArgs(), " ") ==
+		"-deterministic-names -xchacha -longnames=false -scryptn 20", "args", o.initArgs())
+
+	// the options are read back from gocryptfs.conf
+	defer setTestRuntimeDir(t)()
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	cipher := filepath.Join(dir, "vol")
+	o = defaultCryptOptions()
+	o.Names, o.XChaCha, o.ScryptN = namesPlaintext, true, 12
+	okf(t, initCryptVolWith(cipher, &initOptions{crypt: o}))
+	info, err := readVolumeInfo(cipher)
+	okf(t, err)
+	assert(t, info.Options.Names == namesPlaintext && info.Options.XChaCha &&
+		info.Options.ScryptN == 12, "recorded options", info.Options)
+	assert(t, info.Options.contentCipher() == "XChaCha20-Poly1305", "cipher",
+		info.Options.contentCipher())
+}
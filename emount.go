@@ -9,18 +9,51 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
-
-	"github.com/otiai10/copy"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // options holds command-line options and configuration
 type options struct {
-	run        string   // run volume path
-	init       string   // init volume path
-	srcFolder  string   // folder to copy from during initialization
-	mountPoint string   // path for mounting unencrypted data
-	runCmd     []string // command to run that accesses unencrypted data
-	verbose    bool
+	run         string        // run volume path
+	init        string        // init volume path
+	passwd      string        // path of volume to change password
+	cleanup     bool          // clean up stale mounts
+	status      bool          // list mounted volumes
+	unmount     string        // volume or mount point to unmount
+	info        string        // volume to show the settings of
+	json        bool          // status or info output as JSON
+	srcFolder   string        // folder to copy from during initialization
+	crypt       *cryptOptions // gocryptfs options for init, or nil for the defaults
+	masterKey   keyBackup     // how init saves the master key
+	initCopy    copyOptions   // how init copies srcFolder
+	keyFile     string        // master key backup used by recover
+	recover     string        // volume to recover with its master key
+	importTo    string        // volume to import an archive into
+	exportFrom  string        // volume to export to an archive
+	archive     string        // archive to import, or to export to
+	format      string        // archive format, if not from its name
+	overwrite   bool          // import replaces existing files
+	mountPoint  string        // path for mounting unencrypted data
+	volumes     []volume      // more volumes mounted for run
+	hooks       hookSet       // commands run around the mount lifecycle
+	noAgent     bool          // run doesn't ask the agent to hold the volumes
+	agent       bool          // run the agent
+	lifetime    time.Duration // how long the agent holds a volume
+	foreground  bool          // run the agent in the foreground
+	lock        string        // volume the agent releases
+	lockAll     bool          // the agent releases all volumes
+	runCmd      []string      // command to run that accesses unencrypted data
+	envAllow    []string      // if non-empty, only these vars are passed to runCmd
+	envDeny     []string      // vars removed from the environment of runCmd
+	idleTimeout time.Duration // if not 0, stop the command when the volume is idle
+	private     bool          // mount in a private mount namespace (linux)
+	lockSuspend bool          // unmount when the session is locked or suspends
+	pass        *passwordSource
+	verbose     bool
+	config      string // config file, if not the default
+	profile     string // name of the volume profile to run
 }
 
 type dirCheckResponse int
@@ -31,46 +64,75 @@ const (
 	isNotDir    = dirCheckResponse(2)
 )
 
-const (
+// Defaults, which can be changed in the config file (see config.go)
+var (
 	// dirMode sets permissions for the tmp folder created for mountpoint.
 	// Only used if -m option is not used.
-	dirMode = 0700
+	dirMode os.FileMode = 0700
 
 	// minEntropy is the minimum password entropy (float)
 	// This is a better metric for password strength than length
 	// and number of symbols!
-	// Adjust here to enforce security policy cryptographic controls.
+	// Adjust in the config file to enforce security policy cryptographic controls.
 	// Examples of pass phrases that are slightly above 24 include:
 	//   "horse-table", "summurr" "ostrich/3", "factory8717"
 	minEntropy = 24.0
 
 	tmpFolderPattern = "emount_"
-	envPasswordKey   = "EMOUNT_PASSWORD"
-	envFolderKey     = "EMOUNT_FOLDER"
+)
+
+const (
+	envPasswordKey = "EMOUNT_PASSWORD"
+	envFolderKey   = "EMOUNT_FOLDER"
 )
 
 // initCryptVol initializes encrypted storage folder at path.
 // @param path should be a path to a folder that will be created.
 // User is prompted to enter a password and gocryptfs is used to initialize it.
-func initCryptVol(path string, initFrom string) error {
+// pass is the password source; if nil, EMOUNT_PASSWORD is used, or the user
+// is prompted.
+func initCryptVol(path string, initFrom string, pass *passwordSource) error {
+	return initCryptVolWith(path, &initOptions{from: initFrom, pass: pass})
+}
 
-	var err error
-	encPass := os.Getenv(envPasswordKey)
-	if encPass == "" {
-		encPass, err = promptNewPassword("Enter encryption passphrase: ", minEntropy)
-		if err != nil {
-			return err
-		}
+// initOptions are the options of init. The zero value creates a volume
+// with the gocryptfs defaults, and doesn't copy anything into it.
+type initOptions struct {
+	from    string          // folder copied into the new volume, or ""
+	pass    *passwordSource // if nil, EMOUNT_PASSWORD is used, or a prompt
+	crypt   *cryptOptions   // gocryptfs options, or nil for the defaults
+	copy    copyOptions     // how the folder is copied
+	saveKey func(cipher string, masterKey string) error
+}
+
+// initCryptVolWith is initCryptVol with more options. If opt.saveKey is not
+// nil, it's called with the master key of the new volume, before the
+// initial copy; otherwise gocryptfs doesn't print the key.
+func initCryptVolWith(path string, opt *initOptions) error {
+
+	crypt := opt.crypt
+	if crypt == nil {
+		crypt = defaultCryptOptions()
 	}
-	if encPass == "" {
-		return errors.New("Password may not be empty")
+	if err := crypt.validate(); err != nil {
+		return err
+	}
+	encPass, err := opt.pass.getNewPassword("Enter encryption passphrase: ",
+		minEntropy)
+	if err != nil {
+		return err
 	}
 	if err := os.MkdirAll(path, dirMode); err != nil {
 		return err
 	}
 
 	var out bytes.Buffer
-	cmd := exec.Command("gocryptfs", "-init", "-q", "--", path)
+	args := []string{"-init"}
+	if opt.saveKey == nil {
+		args = append(args, "-q")
+	}
+	args = append(append(args, crypt.initArgs()...), "--", path)
+	cmd := exec.Command("gocryptfs", args...)
 	cmd.Stdin = bytes.NewBufferString(encPass)
 	cmd.Stdout = &out
 	cmd.Stderr = &out
@@ -82,45 +144,50 @@ func initCryptVol(path string, initFrom string) error {
 		}
 		return fmt.Errorf("Initialization failed: %v", err)
 	}
+	opt.pass.remember(path, encPass)
 
-	if initFrom != "" {
-		if err := initialCopy(path, encPass, initFrom); err != nil {
-			return fmt.Errorf("The vault was successfully created, but some "+
-				"files were not copied into it: (%v). If you can fix these "+
-				"errors, you may want to delete the crypt volume and try again.",
-				err)
+	if opt.saveKey != nil {
+		key, err := masterKeyFromOutput(out.String())
+		if err == nil {
+			err = opt.saveKey(path, key)
+		}
+		if err != nil {
+			return fmt.Errorf("The vault was successfully created, but its "+
+				"master key was not saved: %v. You may want to delete the "+
+				"crypt volume and try again", err)
 		}
 	}
 
-	return nil
-}
-
-// initialCopy performs copy into newly created crypt volume
-// Mounts volume for the first time, performs recursive copy from another folder,
-// then umounts it.
-func initialCopy(cryptPath string, password string, initFrom string) error {
-
-	// Most likely source of errors here is access to source files:
-	// Mount is likely to succeed here because it was just created
-	// and we know the password works. Similarly, we are using
-	// an empty new temp folder for the destination, so we shouldn't
-	// get permission errors during write, and there are no existing
-	// files in the destination that might cause overwrite concerns.
-	mountPoint, err := mountCrypt(cryptPath, "", password)
-	if err != nil {
-		return fmt.Errorf("failed to mount new volume: %v", err)
-	}
-	defer func() {
-		_ = os.RemoveAll(mountPoint)
-	}()
-	err = copy.Copy(initFrom, mountPoint)
-	if err != nil {
-		return err
-	}
-	err = unmountVol(mountPoint)
-	if err != nil {
-		printUnmountWarning(mountPoint)
+	if opt.from != "" {
+		summary, err := initialCopy(path, encPass, opt.from, &opt.copy)
+		if err != nil {
+			if !opt.copy.rollback {
+				return fmt.Errorf("The vault was successfully created, but "+
+					"the files were not all copied into it: (%v). If you can fix "+
+					"these errors, you may want to delete the crypt volume and "+
+					"try again, or use --rollback-on-error.", err)
+			}
+			if rerr := rollbackVolume(path); rerr != nil {
+				return fmt.Errorf("The files were not all copied into the new "+
+					"vault: (%v), and deleting the vault failed: %v", err, rerr)
+			}
+			return fmt.Errorf("The files were not all copied into the new "+
+				"vault: (%v). The vault was deleted, and %s is empty.", err, path)
+		}
+		if opt.copy.retire.mode != "" {
+			if summary.excluded > 0 || len(summary.skipped) > 0 {
+				return fmt.Errorf("The vault was created and the copy was "+
+					"verified, but %s was not retired, because some of its "+
+					"items were left out or skipped, and would be lost",
+					opt.from)
+			}
+			if err := retireSource(opt.from, path, &opt.copy.retire); err != nil {
+				return fmt.Errorf("The vault was created and the copy was "+
+					"verified, but retiring the source folder failed: %v", err)
+			}
+		}
 	}
+
 	return nil
 }
 
@@ -134,9 +201,10 @@ func initialCopy(cryptPath string, password string, initFrom string) error {
 // interactive terminal, etc. The caller's environment including PATH, DISPLAY,
 // etc. is also passed to the subcommand, with one addition
 // for the EMOUNT_FOLDER.
+//
+// If the command fails, the returned error carries its exit code
+// (see exitCode), or 128+signal if it was killed by a signal.
 func runCommand(runCmd []string, env []string) error {
-	var err error
-
 	cmd := exec.Cmd{
 		Path:   runCmd[0],
 		Args:   runCmd[:],
@@ -145,19 +213,22 @@ func runCommand(runCmd []string, env []string) error {
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
 	}
-	err = cmd.Run()
-	if err != nil {
-		if ee, ok := err.(*exec.ExitError); ok {
-			return fmt.Errorf("Command exited with error. [rc=%d]",
-				ee.ProcessState.ExitCode())
-		}
-		return fmt.Errorf("Command error: %v", err)
+	if err := cmd.Run(); err != nil {
+		return commandExitErr(err)
 	}
 	return nil
 }
 
 func mountCrypt(cryptPath string, mountPoint string,
 	encPass string) (string, error) {
+	return mountCryptWith(cryptPath, mountPoint, encPass, nil)
+}
+
+// mountCryptWith is mountCrypt with extra gocryptfs options. input is
+// written to the stdin of gocryptfs: the password, or the master key with
+// -masterkey=stdin.
+func mountCryptWith(cryptPath string, mountPoint string, input string,
+	extraArgs []string) (string, error) {
 
 	var cleanup bool
 	var err error
@@ -177,87 +248,199 @@ func mountCrypt(cryptPath string, mountPoint string,
 			_ = os.RemoveAll(mountPoint)
 		}
 	}()
+	if cleanup {
+		if err = os.Chmod(mountPoint, dirMode); err != nil {
+			return "", fmt.Errorf("Failed to create mount point: %v", err)
+		}
+	}
 
 	var out bytes.Buffer
-	cmd := exec.Command("gocryptfs", "-q", "--", cryptPath, mountPoint)
-	cmd.Stdin = bytes.NewBufferString(encPass)
+	args := append(append([]string{"-q"}, extraArgs...), "--", cryptPath, mountPoint)
+	cmd := exec.Command("gocryptfs", args...)
+	cmd.Stdin = bytes.NewBufferString(input)
 	cmd.Stdout = &out
 	cmd.Stderr = &out
 	if err := cmd.Run(); err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
 			rc := ee.ProcessState.ExitCode()
 			if rc == 12 {
-				return "", fmt.Errorf("Invalid password")
+				return "", newExitErr(exitPassword,
+					errors.New("Invalid password"))
 			}
-			return "", fmt.Errorf("Mount failed: %s (rc=%d)",
-				string(out.Bytes()), rc)
+			return "", newExitErr(exitMount, fmt.Errorf(
+				"Mount failed: %s (rc=%d)", string(out.Bytes()), rc))
 		}
-		return "", fmt.Errorf("Mount failed: %v", err)
+		return "", newExitErr(exitMount, fmt.Errorf("Mount failed: %v", err))
 	}
 	//fmt.Println("mount succeeded!")
 	cleanup = false
 	return mountPoint, nil
 }
 
+// decryptAndRun mounts the volume, and the extra volumes of opt.volumes,
+// runs the command, and unmounts them in reverse order.
+// If a volume is already mounted by another emount process, that mount is
+// shared, and only the last emount process using it unmounts it.
+// The returned error carries the exit code for emount (see exitCode):
+// the command's exit status if it failed, otherwise exitUnmount if a
+// volume could not be unmounted.
 func decryptAndRun(opt *options) error {
 
-	mountPoint := opt.mountPoint
+	if opt.private {
+		if ok, err := runPrivate(opt); ok {
+			return err
+		}
+	}
+	offerCleanup(opt.pass)
+	remindQuarantines()
+	vols := opt.runVolumes()
+	mountPoints := make([]string, len(vols))
+	for i, v := range vols {
+		mountPoints[i] = v.Mount
+	}
 
-	var err error
-	encPass := os.Getenv(envPasswordKey)
-	if encPass == "" {
-		encPass, err = terminalGetSecret("Enter encryption passphrase: ")
-		if err != nil {
+	// with --lock-on-suspend, connect to logind before anything is mounted,
+	// so the run fails early if it can't be reached
+	var locker *lockWatcher
+	if opt.lockSuspend {
+		var err error
+		if locker, err = newLockWatcher(); err != nil {
 			return err
 		}
+		defer locker.stop()
 	}
-	if encPass == "" {
-		return errors.New("Password may not be empty")
+
+	// pass through caller's environment, without the variables used by
+	// emount. The variables for the volumes are added below.
+	env := filterEnv(os.Environ(), opt.envAllow, opt.envDeny)
+	if err := opt.hooks.run(hookPreMount, env, vols, mountPoints, opt.profile,
+		false); err != nil {
+		return newExitErr(exitMount, err)
 	}
 
-	mountPoint, err = mountCrypt(opt.run, mountPoint, encPass)
+	mounts, err := mountVolumes(vols, opt.pass, opt.verbose)
 	if err != nil {
-		return fmt.Errorf("Failed to mount: %v", err)
+		return err
 	}
-	if opt.verbose {
-		fmt.Printf("Mounted %s on %s\n", opt.run, mountPoint)
+	for i, vol := range mounts {
+		mountPoints[i] = vol.mountPoint
+	}
+
+	// replace {mount} and the other placeholders in the arguments.
+	// On error here, and below, keep going, so the volumes are released
+	// the same way as when the command exits. The error is reported by
+	// the caller.
+	runCmd, cmdErr := expandArgs(opt.runCmd, vols, mountPoints)
+
+	// From here on, signals are caught so that emount always reaches the
+	// unmount below. While the command runs, they are forwarded to it.
+	fwd := newSignalForwarder(strings.Join(mountPoints, ", "))
+	defer fwd.stop()
+
+	// stop the command when the volumes have been idle for idleTimeout.
+	// When it's run again, they are mounted again, with the password.
+	if opt.idleTimeout > 0 && cmdErr == nil {
+		idle, err := watchIdle(mountPoints, opt.idleTimeout, func() {
+			fwd.stopCommand(fmt.Sprintf("no activity on the volume for %v",
+				opt.idleTimeout))
+		})
+		if err != nil {
+			cmdErr = err
+		} else {
+			defer idle.stop()
+		}
 	}
 
-	// pass through caller's environment, with one additional var for folder
-	env := append(os.Environ()[:],
-		fmt.Sprintf("%s=%s", envFolderKey, mountPoint))
+	// stop the command, and unmount the volumes, when the session is locked
+	// or the system is about to suspend, including while they were being
+	// mounted. If the command hasn't started yet, it's not started.
+	// unmounted is closed after the volumes are released.
+	var unmounted chan struct{}
+	if locker != nil {
+		unmounted = make(chan struct{})
+		locker.start(func(reason string) {
+			fwd.stopCommand(reason)
+			// delay the suspend until the volumes are unmounted. logind
+			// doesn't wait longer than its InhibitDelayMaxSec.
+			<-unmounted
+		})
+	}
 
-	if err = runCommand(opt.runCmd, env); err != nil {
-		// print error but keep going
-		fmt.Printf("Command execution error: %v\n", err)
+	// the agent keeps the volumes mounted for the next runs, unless they
+	// should be unmounted when idle
+	if cmdErr == nil && !opt.noAgent && opt.idleTimeout == 0 {
+		attachAgent(mounts, opt.lockSuspend, opt.verbose)
+	}
+
+	// if the run couldn't be set up, the command is not started
+	if cmdErr == nil {
+		if sig := fwd.interrupted(); sig != nil {
+			// interrupted while mounting: don't start the command
+			cmdErr = newExitErr(128+int(sig.(syscall.Signal)),
+				fmt.Errorf("Interrupted by %v", sig))
+		} else if reason := fwd.stopped(); reason != "" {
+			cmdErr = newExitErr(128+int(syscall.SIGTERM),
+				fmt.Errorf("The command was not started: %s", reason))
+		} else if err := opt.hooks.run(hookPostMount, env, vols, mountPoints,
+			opt.profile, true); err != nil {
+			cmdErr = newExitErr(exitMount, err)
+		} else if reason := fwd.stopped(); reason != "" {
+			// stopped while the post-mount hook ran
+			cmdErr = newExitErr(128+int(syscall.SIGTERM),
+				fmt.Errorf("The command was not started: %s", reason))
+		} else {
+			// the command gets one additional var for folder, and one for
+			// each volume if there are several
+			cmdEnv := append(append([]string{}, env...), volumeEnv(vols, mountPoints)...)
+			cmdErr = runForwarded(runCmd, cmdEnv, fwd, func(pid int, ownGroup bool) {
+				for _, vol := range mounts {
+					_ = vol.setCommandPID(pid, ownGroup)
+				}
+			})
+		}
 	}
 	if opt.verbose {
 		fmt.Printf("Command completed\n")
 	}
 
-	// unmount
-	err = unmountVol(mountPoint)
-	if err != nil {
-		printUnmountWarning(mountPoint)
-		fmt.Printf("err=%v\n", err)
-	} else {
-		if opt.verbose {
-			fmt.Printf("Unmounting %s\n", mountPoint)
+	// the unmount hooks only get the volumes that are unmounted, not those
+	// that another emount process or the agent keeps mounted.
+	// A failing pre-unmount hook doesn't prevent the unmount.
+	last := make([]bool, len(mounts))
+	for i, vol := range mounts {
+		last[i] = vol.lastUser()
+	}
+	if hv, hm := selectVolumes(vols, mountPoints, last); len(hv) > 0 {
+		if err := opt.hooks.run(hookPreUnmount, env, hv, hm, opt.profile,
+			true); err != nil {
+			fmt.Printf("WARNING: %v. The volume is unmounted anyway.\n", err)
 		}
-		// The folder is unmounted. Attempt to remove the mount point if it was
-		// just created
-		if opt.mountPoint == "" {
-			_ = os.Remove(mountPoint)
-			if opt.verbose {
-				fmt.Printf("Removing directory %s\n", mountPoint)
-			}
+	}
+
+	// unmount, unless another emount process is still using the volume
+	released, err := releaseVolumes(mounts, opt.verbose)
+	if err != nil && cmdErr == nil {
+		cmdErr = newExitErr(exitUnmount, fmt.Errorf("Unmount failed: %v", err))
+	}
+	if unmounted != nil {
+		close(unmounted)
+	}
+	if hv, hm := selectVolumes(vols, mountPoints, released); len(hv) > 0 {
+		if err := opt.hooks.run(hookPostUnmount, env, hv, hm, opt.profile,
+			false); err != nil {
+			fmt.Printf("WARNING: %v\n", err)
 		}
 	}
-	return nil
+	return cmdErr
 }
 
 func printUnmountWarning(path string) {
-	fmt.Printf("WARNING: Unmount folder '%s' failed. Please ensure all files "+
+	fprintUnmountWarning(os.Stdout, path)
+}
+
+// fprintUnmountWarning writes the warning for a failed unmount to w
+func fprintUnmountWarning(w io.Writer, path string) {
+	fmt.Fprintf(w, "WARNING: Unmount folder '%s' failed. Please ensure all files "+
 		"on this volume are closed and try unmounting again. The program 'lsof' "+
 		"may be useful for identifying open file handles. If necessary, "+
 		"you may need to use the unmount -F flag to force unmounting.\n",
@@ -265,6 +448,15 @@ func printUnmountWarning(path string) {
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run parses arguments and performs the requested operation.
+// Returns the process exit code.
+func run() int {
+	if len(os.Args) > 1 && os.Args[1] == privateHelperArg {
+		return runPrivateHelper()
+	}
 	var opt options
 	var err error
 	flag.Usage = func() {
@@ -272,26 +464,87 @@ func main() {
 	}
 	flag.ErrHelp = newUsageErr("Syntax error")
 	err = parseArgs(&opt)
+	if err == errHelp {
+		return exitOK
+	}
 	if err != nil {
-		fmt.Printf("parseArgs returned %v", err)
 		if isUsageErr(err) {
 			fmt.Printf("ERROR: %s\n\n", err.Error())
-			showUsage()
+			showUsageErr(err)
 		} else {
 			fmt.Printf("ERROR: %v\n", err)
 		}
-	} else {
-		if opt.init != "" {
-			if err = initCryptVol(opt.init, opt.srcFolder); err != nil {
-				fmt.Printf("ERROR: %v\n", err)
-			}
+		return exitUsage
+	}
+	if opt.init != "" {
+		if err = initCryptVolWith(opt.init, &initOptions{
+			from:    opt.srcFolder,
+			pass:    opt.pass,
+			crypt:   opt.crypt,
+			copy:    opt.initCopy,
+			saveKey: opt.masterKey.saver(opt.pass),
+		}); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
 		}
-		if opt.run != "" {
-			if err = decryptAndRun(&opt); err != nil {
-				fmt.Printf("ERROR: %v\n", err)
-			}
+	}
+	if opt.passwd != "" {
+		if err = changePassword(opt.passwd, opt.pass); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+	}
+	if opt.recover != "" {
+		if err = recoverVolume(opt.recover, opt.keyFile, opt.pass); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+	}
+	if opt.importTo != "" {
+		if err = importArchive(opt.importTo, opt.archive, opt.format, opt.overwrite,
+			opt.pass, opt.verbose); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+	}
+	if opt.exportFrom != "" {
+		if err = exportVolume(opt.exportFrom, opt.archive, opt.format, opt.pass,
+			opt.verbose); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		}
+	}
+	if opt.cleanup {
+		if err = runCleanup(); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+	}
+	if opt.status {
+		if err = showStatus(opt.json); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+	}
+	if opt.unmount != "" {
+		if err = runUnmount(opt.unmount); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+	}
+	if opt.info != "" {
+		if err = showInfo(opt.info, opt.json); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+	}
+	if opt.agent {
+		if err = runAgent(opt.lifetime, opt.foreground, opt.config); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+	}
+	if opt.lock != "" || opt.lockAll {
+		if err = lockVolumes(opt.lock, opt.lockAll); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+	}
+	if opt.run != "" {
+		if err = decryptAndRun(&opt); err != nil {
+			fmt.Printf("ERROR: %v\n", err)
 		}
 	}
+	return exitCode(err)
 }
 
 // checkEmptyDir verifies the directory exists and is empty.
@@ -8,7 +8,9 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 const testDirPrefix = "gotest_emount_"
@@ -18,8 +20,22 @@ const gocryptConfig = "/gocryptfs.conf"
 
 func TestInitCryptVolEmptyPw(t *testing.T) {
 
+	// use a regular file instead of a terminal, so the test does not block
+	// waiting for input when it's run from a terminal
+	tmpf, err := ioutil.TempFile("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.Remove(tmpf.Name())
+	}()
+	ok(t, tmpf.Close())
+	savTTY := ttyPath
+	ttyPath = tmpf.Name()
+	defer func() {
+		ttyPath = savTTY
+	}()
+
 	// empty password attempts to prompt for new password
-	err := initCryptVol("", "")
+	err = initCryptVol("", "", nil)
 	// expect "Input error: inappropriate ioctl for device"
 	if err == nil {
 		t.Errorf("expected prompt for password, err == nil\n")
@@ -40,7 +56,7 @@ func TestInitCryptVol(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(folder)
 	}()
-	err = initCryptVol(folder, "")
+	err = initCryptVol(folder, "", nil)
 	okf(t, err)
 
 	fs, err := os.Stat(folder)
@@ -151,7 +167,7 @@ func TestInitCryptVolCopy(t *testing.T) {
 		_ = os.RemoveAll(dataFolder)
 	}()
 
-	err = initCryptVol(newCrypt, dataFolder)
+	err = initCryptVol(newCrypt, dataFolder, nil)
 	okf(t, err)
 
 	// mount volume and confirm
@@ -189,7 +205,7 @@ func TestDecryptAndRun(t *testing.T) {
 	}()
 
 	// init & copy from test data
-	err = initCryptVol(newCrypt, dataFolder)
+	err = initCryptVol(newCrypt, dataFolder, nil)
 	okf(t, err)
 
 	mountPoint, err := ioutil.TempDir("", testDirPrefix)
@@ -214,7 +230,8 @@ func TestDecryptAndRun(t *testing.T) {
 	flag.CommandLine = flag.NewFlagSet("prog", flag.ExitOnError)
 	os.Args = []string{"prog", "-r", newCrypt, "-m", mountPoint,
 		"/bin/cp", mountPoint + tf.name, destDir + tf.name}
-	main()
+	rc := run()
+	assert(t, rc == exitOK, "exit code", rc)
 
 	// confirm that copy occurred
 	data, err := ioutil.ReadFile(destDir + tf.name)
@@ -244,7 +261,7 @@ func TestInvalidPassword(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(newCrypt)
 	}()
-	err = initCryptVol(newCrypt, "")
+	err = initCryptVol(newCrypt, "", nil)
 	ok(t, err)
 
 	_, err = mountCrypt(newCrypt, "", "abc")
@@ -480,3 +497,160 @@ func TestUsageError(t *testing.T) {
 
 	assert(t, isUsageErr(e), "usage", e)
 }
+
+func TestRunCommandExitCode(t *testing.T) {
+
+	env := os.Environ()
+
+	err := runCommand([]string{"/bin/sh", "-c", "exit 0"}, env)
+	ok(t, err)
+	assert(t, exitCode(err) == exitOK, "exit 0", exitCode(err))
+
+	err = runCommand([]string{"/bin/sh", "-c", "exit 3"}, env)
+	assert(t, exitCode(err) == 3, "exit 3", exitCode(err))
+
+	// killed by signal uses 128+signal convention
+	err = runCommand([]string{"/bin/sh", "-c", "kill -TERM $$"}, env)
+	assert(t, exitCode(err) == 128+15, "SIGTERM", exitCode(err))
+
+	err = runCommand([]string{"/nonexistent/program"}, env)
+	assert(t, exitCode(err) == exitNoExec, "no exec", exitCode(err))
+}
+
+func TestExitCode(t *testing.T) {
+	assert(t, exitCode(nil) == exitOK, "nil", exitCode(nil))
+	assert(t, exitCode(newUsageErr("x")) == exitUsage, "usage", 0)
+	assert(t, exitCode(fmt.Errorf("x")) == exitError, "plain error", 0)
+
+	// exit code survives wrapping
+	err := fmt.Errorf("Failed to mount: %w",
+		newExitErr(exitPassword, fmt.Errorf("Invalid password")))
+	assert(t, exitCode(err) == exitPassword, "wrapped", exitCode(err))
+}
+
+func TestFilterEnv(t *testing.T) {
+
+	environ := []string{
+		"PATH=/bin",
+		"HOME=/home/user",
+		"XDG_DATA_HOME=/data",
+		"XDG_CONFIG_HOME=/config",
+		"EMOUNT_PASSWORD=secret",
+		"SSH_AUTH_SOCK=/tmp/agent",
+	}
+
+	env := filterEnv(environ, nil, nil)
+	assert(t, len(env) == len(environ)-1, "default keeps all but password", env)
+	for _, kv := range env {
+		assert(t, !strings.HasPrefix(kv, "EMOUNT_PASSWORD="), "password removed", kv)
+	}
+
+	// password is removed even if explicitly allowed
+	env = filterEnv(environ, []string{"PATH", "XDG_*", "EMOUNT_PASSWORD"}, nil)
+	assert(t, strings.Join(env, " ") ==
+		"PATH=/bin XDG_DATA_HOME=/data XDG_CONFIG_HOME=/config", "allow", env)
+
+	env = filterEnv(environ, nil, []string{"SSH_*", "HOME"})
+	assert(t, strings.Join(env, " ") ==
+		"PATH=/bin XDG_DATA_HOME=/data XDG_CONFIG_HOME=/config", "deny", env)
+
+	env = filterEnv(environ, []string{"XDG_*"}, []string{"XDG_CONFIG_HOME"})
+	assert(t, strings.Join(env, " ") == "XDG_DATA_HOME=/data", "allow+deny", env)
+
+	var list stringList
+	ok(t, list.Set("A, B,,C"))
+	ok(t, list.Set("D"))
+	assert(t, list.String() == "A,B,C,D", "stringList", list.String())
+}
+
+func TestSignalForwarding(t *testing.T) {
+
+	env := os.Environ()
+
+	// SIGTERM sent to emount is forwarded to the command
+	fwd := newSignalForwarder("/test/mountpoint")
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	err := runForwarded([]string{"/bin/sh", "-c",
+		"trap 'exit 7' TERM; while true; do sleep 0.1; done"}, env, fwd, nil)
+	fwd.stop()
+	assert(t, exitCode(err) == 7, "forwarded SIGTERM", exitCode(err))
+	assert(t, fwd.interrupted() == syscall.SIGTERM, "caught", fwd.interrupted())
+
+	// second SIGINT kills a command that ignores SIGINT
+	fwd = newSignalForwarder("/test/mountpoint")
+	go func() {
+		for i := 0; i < 2; i++ {
+			time.Sleep(300 * time.Millisecond)
+			_ = syscall.Kill(os.Getpid(), syscall.SIGINT)
+		}
+	}()
+	err = runForwarded([]string{"/bin/sh", "-c",
+		"trap '' INT; while true; do sleep 0.1; done"}, env, fwd, nil)
+	fwd.stop()
+	assert(t, exitCode(err) == 128+9, "escalated SIGINT", exitCode(err))
+}
+
+func TestPasswordSource(t *testing.T) {
+
+	sav := os.Getenv(envPasswordKey)
+	defer func() {
+		_ = os.Setenv(envPasswordKey, sav)
+	}()
+	ok(t, os.Setenv(envPasswordKey, "from-env"))
+
+	ps := newPasswordSource()
+	ok(t, ps.validate())
+	assert(t, !ps.interactive(), "env is not interactive", ps)
+	pw, err := ps.getPassword("")
+	ok(t, err)
+	assert(t, pw == "from-env", "env password", pw)
+
+	// passfile: first line only
+	tmpf, err := ioutil.TempFile("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.Remove(tmpf.Name())
+	}()
+	_, err = tmpf.WriteString("from-file\r\nsecond line\n")
+	ok(t, err)
+	ok(t, tmpf.Close())
+	ps = &passwordSource{fd: -1, file: tmpf.Name()}
+	pw, err = ps.getPassword("")
+	ok(t, err)
+	assert(t, pw == "from-file", "passfile", pw)
+
+	// passfd: the rest of the input is not consumed
+	r, w, err := os.Pipe()
+	okf(t, err)
+	_, err = w.WriteString("from-fd\nrest")
+	ok(t, err)
+	ok(t, w.Close())
+	ps = &passwordSource{fd: int(r.Fd())}
+	pw, err = ps.getPassword("")
+	ok(t, err)
+	assert(t, pw == "from-fd", "passfd", pw)
+	rest, err := ioutil.ReadAll(r)
+	ok(t, err)
+	assert(t, string(rest) == "rest", "passfd rest", string(rest))
+	ok(t, r.Close())
+
+	ps = &passwordSource{fd: -1, extpass: "echo from-extpass"}
+	pw, err = ps.getNewPassword("", minEntropy)
+	ok(t, err)
+	assert(t, pw == "from-extpass", "extpass", pw)
+
+	ps = &passwordSource{fd: -1, extpass: "false"}
+	_, err = ps.getPassword("")
+	assert(t, exitCode(err) == exitPassword, "extpass failure", err)
+
+	ps = &passwordSource{fd: -1, extpass: "true"}
+	_, err = ps.getPassword("")
+	assert(t, exitCode(err) == exitPassword, "empty password", err)
+
+	ps = &passwordSource{fd: 3, file: "x"}
+	err = ps.validate()
+	assert(t, isUsageErr(err), "multiple sources", err)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// consumedEnvVars are variables read by emount that must not be passed
+// to the wrapped command.
+var consumedEnvVars = []string{
+	envPasswordKey,
+	envAskpassKey,
+	envPinentryKey,
+}
+
+// stringList is a flag.Value for comma-separated lists.
+// The flag may be repeated, and values are appended.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*s = append(*s, v)
+		}
+	}
+	return nil
+}
+
+// matchEnvName returns true if the variable name matches any of the patterns.
+// Patterns may contain shell wildcards, e.g., "XDG_*"
+func matchEnvName(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterEnv returns the environment for the wrapped command.
+// - environ the caller's environment, an array of strings of the form name=value
+// - allow if non-empty, only variables matching one of these patterns are kept
+// - deny variables matching any of these patterns are removed
+//
+// Variables consumed by emount, such as EMOUNT_PASSWORD, are always removed.
+func filterEnv(environ []string, allow []string, deny []string) []string {
+	env := make([]string, 0, len(environ))
+	for _, kv := range environ {
+		name := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name = kv[:i]
+		}
+		if matchEnvName(name, consumedEnvVars) {
+			continue
+		}
+		if len(allow) > 0 && !matchEnvName(name, allow) {
+			continue
+		}
+		if matchEnvName(name, deny) {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
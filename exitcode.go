@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// Exit codes used by emount for its own failures. When the wrapped command
+// runs, emount exits with the command's exit code instead, or 128+signal
+// if the command was killed by a signal (the same convention used by shells).
+const (
+	exitOK       = 0
+	exitError    = 1   // general error, e.g., initialization failed
+	exitUsage    = 2   // invalid command-line arguments
+	exitPassword = 121 // password empty, unavailable, or invalid
+	exitMount    = 122 // mounting the volume failed
+	exitUnmount  = 123 // command succeeded but the volume could not be unmounted
+	exitNoExec   = 126 // the command could not be started
+)
+
+// exitErr is an error that carries the process exit code for emount
+type exitErr struct {
+	code int
+	err  error
+}
+
+func (e *exitErr) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitErr) Unwrap() error {
+	return e.err
+}
+
+func newExitErr(code int, err error) error {
+	return &exitErr{
+		code: code,
+		err:  err,
+	}
+}
+
+// exitCode returns the process exit code appropriate for the error.
+// nil maps to exitOK, errors without an exit code map to exitError.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var ee *exitErr
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	if isUsageErr(err) {
+		return exitUsage
+	}
+	return exitError
+}
+
+// commandExitErr converts an error from exec.Cmd.Run or Wait into an exitErr.
+// If the command was terminated by a signal, the exit code is 128+signal.
+func commandExitErr(err error) error {
+	if ee, ok := err.(*exec.ExitError); ok {
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return newExitErr(128+int(ws.Signal()),
+				fmt.Errorf("Command terminated by signal %v", ws.Signal()))
+		}
+		rc := ee.ProcessState.ExitCode()
+		return newExitErr(rc,
+			fmt.Errorf("Command exited with error. [rc=%d]", rc))
+	}
+	return newExitErr(exitNoExec, fmt.Errorf("Command error: %v", err))
+}
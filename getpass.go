@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 
 	zxcvbn "github.com/nbutton23/zxcvbn-go"
@@ -15,13 +17,20 @@ const (
 	maxNewPasswordTries = 10
 )
 
+// ttyPath is the terminal used for password prompts. The controlling
+// terminal is used instead of stdin, so that stdin can be piped
+// into the command.
+var ttyPath = "/dev/tty"
+
 // PromptNewPassword prompts the user for a new vault password.
 // The user is requird to type the password a second time for confirmation,
 // and the password must meet minimum entropy.
 // If unsure, a value of 50.0 is reasonable for a moderately-strong password.
-func promptNewPassword(prompt string, minEntropy float64) (string, error) {
+// ask is the function used to prompt the user, such as terminalGetSecret.
+func promptNewPassword(ask func(string) (string, error), prompt string,
+	minEntropy float64) (string, error) {
 	for i := 0; i < maxNewPasswordTries; i++ {
-		password, err := terminalGetSecret(prompt)
+		password, err := ask(prompt)
 		if err != nil {
 			return "", fmt.Errorf("Input error: %v", err)
 		}
@@ -29,7 +38,7 @@ func promptNewPassword(prompt string, minEntropy float64) (string, error) {
 			log.Printf("Password weak - please try again\n\n")
 			continue
 		}
-		confirm, err := terminalGetSecret("Confirm password:")
+		confirm, err := ask("Confirm password:")
 		if err != nil {
 			log.Printf("Input error: please try again\n\n")
 			continue
@@ -57,12 +66,40 @@ func promptPassword() (string, error) {
 // Typed entry is not echoed to terminal.
 func terminalGetSecret(prompt string) (string, error) {
 
-	fmt.Print(prompt)
-	bytePassword, err := terminal.ReadPassword(0)
-	fmt.Println()
+	tty, err := os.OpenFile(ttyPath, os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("no terminal for password prompt (%v). "+
+			"Use --passfile, --passfd, --extpass, or %s", err, envPasswordKey)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	bytePassword, err := terminal.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
 	if err != nil {
 		return "", err
 	}
 	password := string(bytePassword)
 	return strings.TrimSpace(password), nil
 }
+
+// askYesNo asks a yes/no question on the terminal. The default is no.
+func askYesNo(tty *os.File, question string) (bool, error) {
+	answer, err := askLine(tty, question+" [y/N] ")
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes", nil
+}
+
+// askLine prompts on the terminal, and returns the line entered,
+// with surrounding spaces removed
+func askLine(tty *os.File, prompt string) (string, error) {
+	fmt.Fprint(tty, prompt)
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && answer == "" {
+		return "", err
+	}
+	return strings.TrimSpace(answer), nil
+}
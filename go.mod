@@ -3,8 +3,11 @@ module github.com/stevelr/emount
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v0.3.0
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/nbutton23/zxcvbn-go v0.0.0-20210217022336-fa2cb2858354
-	github.com/otiai10/copy v1.0.3-0.20200214080046-f71bf165e551
 	github.com/stretchr/testify v1.5.1 // indirect
 	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d
+	rsc.io/qr v0.2.0
 )
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Hooks are shell commands run around the mount lifecycle of 'emount run',
+// set by flags or in a profile:
+//
+//	pre-mount     before the volumes are mounted
+//	post-mount    after they are mounted, before the command starts
+//	pre-unmount   after the command exits, before the volumes are unmounted
+//	post-unmount  after they are unmounted
+//
+// A failing pre-mount or post-mount hook aborts the run, and the command is
+// not started. A failing pre-unmount or post-unmount hook is reported, and
+// the volumes are unmounted anyway. The unmount hooks only get the volumes
+// that are really unmounted, and don't run if another emount process or the
+// agent keeps all of them mounted.
+
+const (
+	hookPreMount    = "pre-mount"
+	hookPostMount   = "post-mount"
+	hookPreUnmount  = "pre-unmount"
+	hookPostUnmount = "post-unmount"
+
+	envHookKey    = "EMOUNT_HOOK"
+	envCipherKey  = "EMOUNT_CIPHER"
+	envProfileKey = "EMOUNT_PROFILE"
+)
+
+// hookSet has the hook commands of run. Empty hooks are not run.
+type hookSet struct {
+	preMount    string
+	postMount   string
+	preUnmount  string
+	postUnmount string
+}
+
+// hookFlags defines the flags for the hooks
+func hookFlags(fs *flag.FlagSet, h *hookSet) {
+	fs.StringVar(&h.preMount, hookPreMount, "",
+		"shell command run before the volume is mounted")
+	fs.StringVar(&h.postMount, hookPostMount, "",
+		"shell command run after the volume is mounted")
+	fs.StringVar(&h.preUnmount, hookPreUnmount, "",
+		"shell command run before the volume is unmounted")
+	fs.StringVar(&h.postUnmount, hookPostUnmount, "",
+		"shell command run after the volume is unmounted")
+}
+
+// empty returns true if no hook is set
+func (h *hookSet) empty() bool {
+	return *h == hookSet{}
+}
+
+// command returns the hook command with the name
+func (h *hookSet) command(name string) string {
+	switch name {
+	case hookPreMount:
+		return h.preMount
+	case hookPostMount:
+		return h.postMount
+	case hookPreUnmount:
+		return h.preUnmount
+	case hookPostUnmount:
+		return h.postUnmount
+	}
+	return ""
+}
+
+// run runs the hook with the name, if it's set, with /bin/sh -c.
+// env is the environment of the command, and the hook also gets
+// EMOUNT_HOOK, EMOUNT_CIPHER (EMOUNT_CIPHER_<NAME> with more than one
+// volume), and EMOUNT_PROFILE. mountPoints are the mount points of vols, or
+// empty strings if they are not known yet. The hook runs in the mount point
+// of the run volume while it's mounted.
+func (h *hookSet) run(name string, env []string, vols []volume,
+	mountPoints []string, profile string, mounted bool) error {
+
+	hook := h.command(name)
+	if hook == "" {
+		return nil
+	}
+	env = append(append([]string{}, env...), volumeEnv(vols, mountPoints)...)
+	env = append(env, fmt.Sprintf("%s=%s", envHookKey, name),
+		fmt.Sprintf("%s=%s", envProfileKey, profile))
+	for i, v := range vols {
+		cipher, err := filepath.Abs(v.Cipher)
+		if err != nil {
+			cipher = v.Cipher
+		}
+		if i == 0 {
+			env = append(env, fmt.Sprintf("%s=%s", envCipherKey, cipher))
+		}
+		if len(vols) > 1 {
+			key := envCipherKey + v.envName()[len(envFolderKey):]
+			env = append(env, fmt.Sprintf("%s=%s", key, cipher))
+		}
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", hook)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if mounted {
+		cmd.Dir = mountPoints[0]
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook failed: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	cipher := filepath.Join(dir, "vol.enc")
+	okf(t, initCryptVol(cipher, "", nil))
+	mountPoint := filepath.Join(dir, "mnt")
+	okf(t, os.Mkdir(mountPoint, 0700))
+	log := filepath.Join(dir, "log")
+
+	// each hook logs its name, the volume, and its working directory
+	logHook := `echo "$EMOUNT_HOOK $EMOUNT_PROFILE $EMOUNT_CIPHER $EMOUNT_FOLDER ` +
+		`$(pwd)" >> ` + log
+	hooks := hookSet{logHook, logHook, logHook, logHook}
+	runWith := func(h hookSet, runCmd ...string) error {
+		_ = os.Remove(log)
+		return decryptAndRun(&options{
+			run:        cipher,
+			mountPoint: mountPoint,
+			runCmd:     runCmd,
+			hooks:      h,
+			profile:    "demo",
+			pass:       newPasswordSource(),
+		})
+	}
+	readLog := func() []string {
+		data, err := ioutil.ReadFile(log)
+		if err != nil {
+			return nil
+		}
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+
+	okf(t, runWith(hooks, "/bin/true"))
+	cwd, err := os.Getwd()
+	okf(t, err)
+	want := []string{
+		"pre-mount demo " + cipher + " " + mountPoint + " " + cwd,
+		"post-mount demo " + cipher + " " + mountPoint + " " + mountPoint,
+		"pre-unmount demo " + cipher + " " + mountPoint + " " + mountPoint,
+		"post-unmount demo " + cipher + " " + mountPoint + " " + cwd,
+	}
+	lines := readLog()
+	assert(t, len(lines) == len(want), "hooks", lines)
+	for i := range lines {
+		if i < len(want) && lines[i] != want[i] {
+			t.Errorf("hook %d: expected %q, got %q", i, want[i], lines[i])
+		}
+	}
+
+	// an error after the mount, here an unknown placeholder, runs the
+	// unmount hooks
+	err = runWith(hooks, "/bin/echo", "{mount:nope}")
+	assert(t, err != nil, "unknown placeholder", err)
+	lines = readLog()
+	assert(t, len(lines) == 3 && strings.HasPrefix(lines[1], "pre-unmount") &&
+		strings.HasPrefix(lines[2], "post-unmount"), "hooks after error", lines)
+	ok(t, checkEmptyDir(mountPoint))
+
+	// a failing pre-mount hook aborts before the volume is mounted
+	h := hooks
+	h.preMount = "false"
+	err = runWith(h, "/bin/true")
+	assert(t, exitCode(err) == exitMount && strings.Contains(err.Error(), "pre-mount"),
+		"pre-mount failed", err)
+	assert(t, len(readLog()) == 0, "no hooks after pre-mount", readLog())
+
+	// a failing post-mount hook: the command doesn't run, and the volume
+	// is unmounted
+	h = hooks
+	h.postMount = "false"
+	err = runWith(h, "/bin/sh", "-c", "touch "+filepath.Join(dir, "ran"))
+	assert(t, exitCode(err) == exitMount, "post-mount failed", err)
+	_, err = os.Stat(filepath.Join(dir, "ran"))
+	assert(t, os.IsNotExist(err), "command not run", err)
+	assert(t, len(readLog()) == 3, "unmount hooks", readLog())
+	ok(t, checkEmptyDir(mountPoint))
+
+	// a failing pre-unmount hook doesn't prevent the unmount
+	h = hooks
+	h.preUnmount = "false"
+	fmt.Printf("Ignore the following warning about the pre-unmount hook:  ")
+	okf(t, runWith(h, "/bin/true"))
+	assert(t, len(readLog()) == 3, "post-unmount", readLog())
+	ok(t, checkEmptyDir(mountPoint))
+	assert(t, sharedMountPoint(cipher) == "", "unmounted", cipher)
+
+	// the unmount hooks don't run while another emount process uses the
+	// volume. The test binary runs emount (see TestMain).
+	exe, err := os.Executable()
+	okf(t, err)
+	ready := filepath.Join(dir, "ready")
+	other := exec.Command(exe, "run", cipher, "--mount", mountPoint, "--no-agent",
+		"--", "/bin/sh", "-c", "touch "+ready+"; sleep 30")
+	okf(t, other.Start())
+	defer func() {
+		_ = other.Process.Kill()
+	}()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(ready); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	okf(t, runWith(hooks, "/bin/true"))
+	lines = readLog()
+	assert(t, len(lines) == 2 && strings.HasPrefix(lines[1], "post-mount"),
+		"shared volume", lines)
+	assert(t, sharedMountPoint(cipher) != "", "still mounted", cipher)
+	ok(t, other.Process.Signal(syscall.SIGTERM))
+	_ = other.Wait()
+	assert(t, sharedMountPoint(cipher) == "", "unmounted by the other", cipher)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+)
+
+// idleWatcher calls a function when there has been no filesystem activity
+// on a mounted volume for the idle timeout
+type idleWatcher struct {
+	activity *activityWatcher
+	done     chan struct{}
+}
+
+// watchIdle starts watching the volumes mounted at mountPoints. onIdle is
+// called once, from another goroutine, when there has been no activity
+// on any of them for timeout.
+func watchIdle(mountPoints []string, timeout time.Duration,
+	onIdle func()) (*idleWatcher, error) {
+
+	activity, err := newActivityWatcher(mountPoints)
+	if err != nil {
+		return nil, err
+	}
+	w := &idleWatcher{activity: activity, done: make(chan struct{})}
+	go w.loop(timeout, onIdle)
+	return w, nil
+}
+
+func (w *idleWatcher) loop(timeout time.Duration, onIdle func()) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-w.activity.events:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(timeout)
+		case <-timer.C:
+			onIdle()
+			return
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// stop stops watching. onIdle is not called after stop returns.
+func (w *idleWatcher) stop() {
+	close(w.done)
+	w.activity.close()
+}
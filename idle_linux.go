@@ -0,0 +1,106 @@
+// +build !darwin
+
+package main
+
+// linux filesystem activity, from inotify watches on each directory
+// of the mounted volume
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// activityEvents are the inotify events that count as activity.
+// Reads are included, so a volume that is only being read is not idle.
+const activityEvents = syscall.IN_ACCESS | syscall.IN_MODIFY |
+	syscall.IN_ATTRIB | syscall.IN_OPEN | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF
+
+// activityWatcher sends to events when files on the volume are accessed
+type activityWatcher struct {
+	events chan struct{}
+	fd     int              // inotify instance
+	file   *os.File         // the same, for reading with the runtime poller
+	dirs   map[int32]string // watched directories, by watch descriptor
+}
+
+func newActivityWatcher(mountPoints []string) (*activityWatcher, error) {
+	// non-blocking, so the file is added to the runtime poller,
+	// and close interrupts a pending read
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %v", err)
+	}
+	w := &activityWatcher{
+		events: make(chan struct{}, 1),
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int32]string),
+	}
+	for _, mountPoint := range mountPoints {
+		if err = w.addTree(mountPoint); err != nil {
+			_ = w.file.Close()
+			return nil, err
+		}
+	}
+	go w.read()
+	return w, nil
+}
+
+// addTree watches dir and its subdirectories. A directory removed before
+// it's watched is ignored.
+func (w *activityWatcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, activityEvents)
+		if err == syscall.ENOSPC {
+			return fmt.Errorf("too many directories to watch in %s. "+
+				"Increase fs.inotify.max_user_watches", dir)
+		}
+		if err == nil {
+			w.dirs[int32(wd)] = path
+		}
+		return nil
+	})
+}
+
+func (w *activityWatcher) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			next := off + syscall.SizeofInotifyEvent + int(ev.Len)
+			name := bytes.TrimRight(buf[off+syscall.SizeofInotifyEvent:next], "\x00")
+			if ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 &&
+				ev.Mask&syscall.IN_ISDIR != 0 {
+				// watch new subdirectories. Errors are ignored, because
+				// activity is still seen in the parent directory
+				if parent, ok := w.dirs[ev.Wd]; ok {
+					_ = w.addTree(filepath.Join(parent, string(name)))
+				}
+			}
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, ev.Wd)
+			}
+			off = next
+		}
+		select {
+		case w.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *activityWatcher) close() {
+	_ = w.file.Close()
+}
@@ -0,0 +1,93 @@
+// +build !darwin
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchIdle(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	idle := make(chan struct{})
+	w, err := watchIdle([]string{dir}, 300*time.Millisecond, func() {
+		close(idle)
+	})
+	okf(t, err)
+	defer w.stop()
+
+	// activity in a new subdirectory keeps the volume from being idle
+	sub := filepath.Join(dir, "sub")
+	okf(t, os.Mkdir(sub, 0700))
+	for i := 0; i < 8; i++ {
+		time.Sleep(100 * time.Millisecond)
+		ok(t, ioutil.WriteFile(filepath.Join(sub, "file"), []byte{byte(i)}, 0600))
+	}
+	select {
+	case <-idle:
+		t.Fatalf("idle while files are written")
+	default:
+	}
+
+	select {
+	case <-idle:
+	case <-time.After(3 * time.Second):
+		t.Errorf("not idle after activity stopped")
+	}
+}
+
+func TestIdleTimeoutStopsCommand(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+
+	// generate random password of about 31-32 hex chars
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	newCrypt, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(newCrypt)
+	}()
+	okf(t, initCryptVol(newCrypt, "", nil))
+
+	sleep, err := exec.LookPath("sleep")
+	okf(t, err)
+	start := time.Now()
+	err = decryptAndRun(&options{
+		run:         newCrypt,
+		runCmd:      []string{sleep, "30"},
+		idleTimeout: 300 * time.Millisecond,
+	})
+	assert(t, exitCode(err) == 128+15, "stopped with SIGTERM", err)
+	assert(t, time.Since(start) < 10*time.Second, "stopped when idle",
+		time.Since(start))
+	assert(t, sharedMountPoint(newCrypt) == "", "unmounted", newCrypt)
+
+	// the volume is idle before the command starts, during the post-mount
+	// hook: the command is stopped when it starts
+	start = time.Now()
+	err = decryptAndRun(&options{
+		run:         newCrypt,
+		runCmd:      []string{sleep, "30"},
+		idleTimeout: 300 * time.Millisecond,
+		hooks:       hookSet{postMount: "sleep 1"},
+	})
+	assert(t, exitCode(err) == 128+15, "stopped when started", err)
+	assert(t, time.Since(start) < 10*time.Second, "stopped when idle before start",
+		time.Since(start))
+	assert(t, sharedMountPoint(newCrypt) == "", "unmounted", newCrypt)
+}
@@ -0,0 +1,19 @@
+// +build darwin
+
+package main
+
+// this file applies to macos only
+
+import "errors"
+
+// activityWatcher is not implemented on macos, which has no inotify.
+// FSEvents does not report reads.
+type activityWatcher struct {
+	events chan struct{}
+}
+
+func newActivityWatcher(mountPoints []string) (*activityWatcher, error) {
+	return nil, errors.New("--idle-timeout is not supported on macos")
+}
+
+func (w *activityWatcher) close() {}
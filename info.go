@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gocryptfsConfig is the part of gocryptfs.conf shown by emount info
+type gocryptfsConfig struct {
+	Creator      string
+	Version      int
+	FeatureFlags []string
+	ScryptObject struct {
+		N int
+	}
+}
+
+// volumeInfo describes an encrypted volume, as shown by emount info
+type volumeInfo struct {
+	Cipher       string        `json:"cipher"`
+	Creator      string        `json:"creator"` // gocryptfs version that created it
+	Version      int           `json:"version"` // on-disk format version
+	FeatureFlags []string      `json:"featureFlags"`
+	Options      *cryptOptions `json:"options"`              // options used to create it
+	MountPoint   string        `json:"mountPoint,omitempty"` // if mounted by emount
+}
+
+// readVolumeInfo reads the settings of the volume from its gocryptfs.conf.
+// The password is not needed.
+func readVolumeInfo(cipher string) (*volumeInfo, error) {
+	cipher, err := filepath.Abs(cipher)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(cipher, gocryptfsConf))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a gocryptfs volume: %v", cipher, err)
+	}
+	var conf gocryptfsConfig
+	if err = json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("invalid %s in %s: %v", gocryptfsConf, cipher, err)
+	}
+	info := &volumeInfo{
+		Cipher:       cipher,
+		Creator:      conf.Creator,
+		Version:      conf.Version,
+		FeatureFlags: conf.FeatureFlags,
+		MountPoint:   sharedMountPoint(cipher),
+	}
+	scryptN := 0
+	if conf.ScryptObject.N > 0 {
+		scryptN = bits.Len(uint(conf.ScryptObject.N)) - 1
+	}
+	info.Options = cryptOptionsFromConfig(&conf, scryptN)
+	return info, nil
+}
+
+// printInfo writes the volume info as text, or as JSON
+func printInfo(w io.Writer, info *volumeInfo, asJSON bool) error {
+	if asJSON {
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+	mounted := "no"
+	if info.MountPoint != "" {
+		mounted = info.MountPoint
+	}
+	fmt.Fprintf(w, "%s\n", info.Cipher)
+	fmt.Fprintf(w, "  created by:     %s\n", info.Creator)
+	fmt.Fprintf(w, "  version:        %d\n", info.Version)
+	fmt.Fprintf(w, "  feature flags:  %s\n", strings.Join(info.FeatureFlags, " "))
+	fmt.Fprintf(w, "  file names:     %s\n", info.Options.describeNames())
+	fmt.Fprintf(w, "  content:        %s\n", info.Options.contentCipher())
+	fmt.Fprintf(w, "  scrypt cost:    %d (-scryptn)\n", info.Options.ScryptN)
+	fmt.Fprintf(w, "  mounted at:     %s\n", mounted)
+	return nil
+}
+
+// showInfo implements emount info
+func showInfo(cipher string, asJSON bool) error {
+	info, err := readVolumeInfo(cipher)
+	if err != nil {
+		return err
+	}
+	return printInfo(os.Stdout, info, asJSON)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The initial copy of init --from is verified: every source file is hashed
+// as it's copied, and after the copy the volume is mounted again and each
+// file is read back through the mount and compared with its hash.
+
+// maxReportItems is the number of differences listed in the report
+const maxReportItems = 20
+
+// copyOptions controls the initial copy of init --from
+type copyOptions struct {
+	rollback bool          // delete the volume if the copy fails or doesn't match
+	retire   retireOptions // what to do with the source after a verified copy
+	exclude  []string      // patterns of items not copied
+	verbose  bool          // show the progress without a terminal
+}
+
+// sourceFile is a file or symlink of the source folder
+type sourceFile struct {
+	rel    string            // path relative to the source folder
+	size   int64             // size of a regular file
+	sum    [sha256.Size]byte // hash of a regular file
+	target string            // target of a symlink
+	link   bool
+}
+
+// copyReport is the result of verifying the copy
+type copyReport struct {
+	files     int      // regular files checked
+	bytes     int64    // bytes checked
+	links     int      // symlinks checked
+	differ    []string // content or link target differs from the source
+	missing   []string // not found in the volume
+	readError []string // could not be read from the volume
+}
+
+func (r *copyReport) ok() bool {
+	return len(r.differ) == 0 && len(r.missing) == 0 && len(r.readError) == 0
+}
+
+// print writes the verification report
+func (r *copyReport) print(w io.Writer, src string) {
+	if r.ok() {
+		fmt.Fprintf(w, "Verified the copy of %s: %d files (%s) and %d symlinks "+
+			"match the source.\n", src, r.files, formatSize(r.bytes), r.links)
+		return
+	}
+	fmt.Fprintf(w, "The copy of %s doesn't match the source:\n", src)
+	n := 0
+	for _, l := range []struct {
+		what  string
+		paths []string
+	}{{"differs", r.differ}, {"missing", r.missing}, {"unreadable", r.readError}} {
+		for _, p := range l.paths {
+			if n < maxReportItems {
+				fmt.Fprintf(w, "  %-10s %s\n", l.what, p)
+			}
+			n++
+		}
+	}
+	if n > maxReportItems {
+		fmt.Fprintf(w, "  ... and %d more\n", n-maxReportItems)
+	}
+	fmt.Fprintf(w, "%d files and %d symlinks checked: %d differ, %d missing, "+
+		"%d unreadable.\n", r.files, r.links, len(r.differ), len(r.missing),
+		len(r.readError))
+}
+
+// err returns an error summarizing the differences, or nil if the copy
+// matches the source
+func (r *copyReport) err() error {
+	if r.ok() {
+		return nil
+	}
+	return fmt.Errorf("the copy doesn't match the source: %d differ, %d missing, "+
+		"%d unreadable", len(r.differ), len(r.missing), len(r.readError))
+}
+
+// formatSize formats a number of bytes, e.g., "1.5 MiB"
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// hashFile returns the SHA-256 hash and the size of the file
+func hashFile(path string) ([sha256.Size]byte, int64, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return sum, 0, err
+	}
+	h.Sum(sum[:0])
+	return sum, n, nil
+}
+
+// verifyCopy reads the files back from the copy in dst, and compares them
+// with the source
+func verifyCopy(files []sourceFile, dst string, p *progress) *copyReport {
+	r := &copyReport{}
+	total := int64(0)
+	for _, f := range files {
+		total += f.size
+	}
+	p.begin("Verifying", len(files), total)
+	defer p.end()
+	for _, f := range files {
+		p.add(1, f.size)
+		path := filepath.Join(dst, f.rel)
+		if f.link {
+			r.links++
+			target, err := os.Readlink(path)
+			switch {
+			case os.IsNotExist(err):
+				r.missing = append(r.missing, f.rel)
+			case err != nil:
+				r.readError = append(r.readError, f.rel)
+			case target != f.target:
+				r.differ = append(r.differ, f.rel)
+			}
+			continue
+		}
+		r.files++
+		r.bytes += f.size
+		sum, size, err := hashFile(path)
+		switch {
+		case os.IsNotExist(err):
+			r.missing = append(r.missing, f.rel)
+		case err != nil:
+			r.readError = append(r.readError, f.rel)
+		case size != f.size || !bytes.Equal(sum[:], f.sum[:]):
+			r.differ = append(r.differ, f.rel)
+		}
+	}
+	return r
+}
+
+// initialCopy performs copy into newly created crypt volume
+// Mounts volume for the first time, performs recursive copy from another folder,
+// then umounts it. The copy is then verified, and the report is printed.
+// It returns the summary of the copy, with what was left out or skipped.
+func initialCopy(cryptPath string, password string, initFrom string,
+	copyOpt *copyOptions) (*copySummary, error) {
+
+	if copyOpt == nil {
+		copyOpt = &copyOptions{}
+	}
+	tree, err := scanSource(initFrom, copyOpt.exclude)
+	if err != nil {
+		return nil, err
+	}
+	p := newProgress(copyOpt.verbose)
+
+	// Most likely source of errors here is access to source files:
+	// Mount is likely to succeed here because it was just created
+	// and we know the password works. Similarly, we are using
+	// an empty new temp folder for the destination, so we shouldn't
+	// get permission errors during write, and there are no existing
+	// files in the destination that might cause overwrite concerns.
+	// The mount is recorded like a --run mount, so that emount --cleanup
+	// doesn't mistake it for a stale mount.
+	getPassword := func(string) (string, error) {
+		return password, nil
+	}
+	vol, err := acquireMountWith(cryptPath, "", getPassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mount new volume: %v", err)
+	}
+	summary, files, err := copyTree(tree, vol.mountPoint, p)
+	if _, uerr := vol.release(); uerr != nil {
+		printUnmountWarning(vol.mountPoint)
+		if err == nil {
+			err = uerr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	summary.print(os.Stdout, initFrom)
+
+	// mount again, so the files are read back from the encrypted folder,
+	// not from the kernel's cache of what was written
+	vol, err = acquireMountWith(cryptPath, "", getPassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mount the volume to verify the copy: %v", err)
+	}
+	report := verifyCopy(files, vol.mountPoint, p)
+	if _, uerr := vol.release(); uerr != nil {
+		printUnmountWarning(vol.mountPoint)
+	}
+	report.print(os.Stdout, initFrom)
+	return summary, report.err()
+}
+
+// rollbackVolume deletes the contents of a volume whose initial copy failed,
+// leaving the empty folder, so init can be run again
+func rollbackVolume(cryptPath string) error {
+	if st, err := findMount(cryptPath); err == nil && st != nil {
+		return fmt.Errorf("%s is mounted, not deleting it", cryptPath)
+	}
+	f, err := os.Open(cryptPath)
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.RemoveAll(filepath.Join(cryptPath, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
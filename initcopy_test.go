@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCopyTree(t *testing.T) {
+
+	assert(t, isExcluded("a/node_modules", []string{"node_modules"}), "name", nil)
+	assert(t, isExcluded("a/b.o", []string{"*.tmp", "*.o"}), "glob", nil)
+	assert(t, isExcluded("a/cache", []string{"/a/cache/"}), "path", nil)
+	assert(t, !isExcluded("b/a/cache", []string{"a/cache"}), "path from the root", nil)
+
+	src, err := createTestData()
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(src)
+	}()
+	tf := getTestFileInfo()[0]
+	okf(t, os.Symlink("file1.txt", filepath.Join(src, "link")))
+	okf(t, os.Link(src+tf.name, filepath.Join(src, "sub", "hardlink")))
+	okf(t, syscall.Mkfifo(filepath.Join(src, "fifo"), 0600))
+	okf(t, os.MkdirAll(filepath.Join(src, "node_modules", "x"), 0700))
+	okf(t, ioutil.WriteFile(filepath.Join(src, "node_modules", "x", "y.js"), nil, 0600))
+	mtime := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	okf(t, os.Chtimes(src+tf.name, mtime, mtime))
+	okf(t, os.Chmod(filepath.Join(src, "bin"), 0500))
+	defer os.Chmod(filepath.Join(src, "bin"), 0700)
+
+	tree, err := scanSource(src, []string{"node_modules"})
+	okf(t, err)
+	assert(t, tree.files == len(getTestFileInfo()) && tree.excluded == 1, "scan", tree)
+
+	dst, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.Chmod(filepath.Join(dst, "bin"), 0700)
+		_ = os.RemoveAll(dst)
+	}()
+	summary, files, err := copyTree(tree, dst, nil)
+	okf(t, err)
+	assert(t, summary.files == len(getTestFileInfo()) && summary.symlinks == 1 &&
+		summary.hardlinks == 1 && summary.fifos == 1 && summary.dirs == 2,
+		"summary", summary)
+	okf(t, confirmTestData(t, dst))
+
+	fi, err := os.Stat(dst + tf.name)
+	okf(t, err)
+	assert(t, fi.ModTime().Equal(mtime), "mtime", fi.ModTime())
+	linked, err := os.Stat(filepath.Join(dst, "sub", "hardlink"))
+	okf(t, err)
+	assert(t, os.SameFile(fi, linked), "hard link", linked)
+	fi, err = os.Stat(filepath.Join(dst, "bin"))
+	okf(t, err)
+	assert(t, fi.Mode().Perm() == 0500, "folder mode", fi.Mode())
+	_, err = os.Stat(filepath.Join(dst, "node_modules"))
+	assert(t, os.IsNotExist(err), "excluded", err)
+
+	// the copy matches
+	r := verifyCopy(files, dst, nil)
+	assert(t, r.ok() && r.links == 1 && r.files == len(getTestFileInfo())+1, "report", r)
+
+	// and a changed copy doesn't
+	okf(t, os.Remove(filepath.Join(dst, "link")))
+	okf(t, os.Symlink("other.txt", filepath.Join(dst, "link")))
+	okf(t, os.Remove(filepath.Join(dst, "sub", "hardlink")))
+	okf(t, ioutil.WriteFile(dst+tf.name, append(tf.contents, 'x'), 0600))
+
+	r = verifyCopy(files, dst, nil)
+	assert(t, !r.ok() && r.err() != nil, "copy differs", r)
+	assert(t, len(r.differ) == 2 && len(r.missing) == 1, "differences", r)
+	var buf bytes.Buffer
+	r.print(&buf, src)
+	assert(t, strings.Contains(buf.String(), "differs    link"), "report", buf.String())
+
+	assert(t, formatSize(1536) == "1.5 KiB", "size", formatSize(1536))
+}
+
+func TestInitCopyRollback(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	src, err := createTestData()
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(src)
+	}()
+	cipher, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(cipher)
+	}()
+
+	// a source that can't be read
+	opt := &initOptions{from: filepath.Join(src, "missing"),
+		copy: copyOptions{rollback: true}}
+	err = initCryptVolWith(cipher, opt)
+	assert(t, err != nil && strings.Contains(err.Error(), "was deleted"), "rollback", err)
+	ok(t, checkEmptyDir(cipher))
+
+	// a verified copy
+	opt.from = src
+	okf(t, initCryptVolWith(cipher, opt))
+	_, err = os.Stat(filepath.Join(cipher, gocryptfsConf))
+	ok(t, err)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Secret Service (freedesktop.org) D-Bus names, implemented by
+// gnome-keyring, KWallet, KeePassXC, and others
+const (
+	secretsService      = "org.freedesktop.secrets"
+	secretsPath         = dbus.ObjectPath("/org/freedesktop/secrets")
+	secretsIface        = "org.freedesktop.Secret.Service"
+	secretsCollIface    = "org.freedesktop.Secret.Collection"
+	secretsItemIface    = "org.freedesktop.Secret.Item"
+	secretsPromptIface  = "org.freedesktop.Secret.Prompt"
+	secretsItemLabel    = "org.freedesktop.Secret.Item.Label"
+	secretsItemAttrs    = "org.freedesktop.Secret.Item.Attributes"
+	secretsNoPrompt     = dbus.ObjectPath("/")
+	secretsDefaultAlias = "default"
+
+	// keyringApp and keyringVolume are the item attributes used to find
+	// the password of a volume
+	keyringApp    = "emount"
+	keyringVolume = "volume"
+
+	// keyringPromptTimeout limits the wait for the user to respond to an
+	// unlock prompt from the keyring
+	keyringPromptTimeout = 2 * time.Minute
+)
+
+// secret is the Secret Service secret struct, D-Bus signature (oayays)
+type secret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// keyring is a connection to the Secret Service on the session bus
+type keyring struct {
+	conn    *dbus.Conn
+	service dbus.BusObject
+	session dbus.ObjectPath
+}
+
+// openKeyring connects to the Secret Service and opens a session.
+// The "plain" algorithm is used: secrets are not encrypted in transit, but
+// the session bus is private to the user.
+func openKeyring() (*keyring, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("keyring: connecting to session bus: %v", err)
+	}
+	k := &keyring{
+		conn:    conn,
+		service: conn.Object(secretsService, secretsPath),
+	}
+	var output dbus.Variant
+	err = k.service.Call(secretsIface+".OpenSession", 0,
+		"plain", dbus.MakeVariant("")).Store(&output, &k.session)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("keyring: opening session: %v", err)
+	}
+	return k, nil
+}
+
+func (k *keyring) close() {
+	_ = k.conn.Object(secretsService, k.session).
+		Call("org.freedesktop.Secret.Session.Close", 0).Err
+	_ = k.conn.Close()
+}
+
+// keyringAttributes returns the attributes that identify the volume.
+// The volume is identified by its absolute path.
+func keyringAttributes(volume string) (map[string]string, error) {
+	abs, err := filepath.Abs(volume)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"application": keyringApp,
+		keyringVolume: abs,
+	}, nil
+}
+
+// lookup returns the password stored for the volume. If there is no
+// password, returns "" and no error.
+func (k *keyring) lookup(volume string) (string, error) {
+	attrs, err := keyringAttributes(volume)
+	if err != nil {
+		return "", err
+	}
+	var unlocked, locked []dbus.ObjectPath
+	err = k.service.Call(secretsIface+".SearchItems", 0, attrs).
+		Store(&unlocked, &locked)
+	if err != nil {
+		return "", fmt.Errorf("keyring: search: %v", err)
+	}
+	if len(unlocked) == 0 && len(locked) > 0 {
+		if unlocked, err = k.unlock(locked[:1]); err != nil {
+			return "", err
+		}
+	}
+	if len(unlocked) == 0 {
+		return "", nil
+	}
+	var s secret
+	err = k.conn.Object(secretsService, unlocked[0]).
+		Call(secretsItemIface+".GetSecret", 0, k.session).Store(&s)
+	if err != nil {
+		return "", fmt.Errorf("keyring: get secret: %v", err)
+	}
+	return string(s.Value), nil
+}
+
+// store saves the password for the volume in the default collection,
+// replacing any previous password for the volume
+func (k *keyring) store(volume string, password string) error {
+	attrs, err := keyringAttributes(volume)
+	if err != nil {
+		return err
+	}
+	var coll dbus.ObjectPath
+	err = k.service.Call(secretsIface+".ReadAlias", 0, secretsDefaultAlias).
+		Store(&coll)
+	if err != nil {
+		return fmt.Errorf("keyring: read default collection: %v", err)
+	}
+	if coll == secretsNoPrompt {
+		return errors.New("keyring: there is no default collection")
+	}
+	if _, err = k.unlock([]dbus.ObjectPath{coll}); err != nil {
+		return err
+	}
+	props := map[string]dbus.Variant{
+		secretsItemLabel: dbus.MakeVariant("emount password for " +
+			attrs[keyringVolume]),
+		secretsItemAttrs: dbus.MakeVariant(attrs),
+	}
+	s := secret{
+		Session:     k.session,
+		Value:       []byte(password),
+		ContentType: "text/plain",
+	}
+	var item, prompt dbus.ObjectPath
+	err = k.conn.Object(secretsService, coll).
+		Call(secretsCollIface+".CreateItem", 0, props, s, true).
+		Store(&item, &prompt)
+	if err != nil {
+		return fmt.Errorf("keyring: create item: %v", err)
+	}
+	if prompt != secretsNoPrompt {
+		if _, err = k.prompt(prompt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlock unlocks the objects, if necessary prompting the user,
+// and returns the objects that are unlocked
+func (k *keyring) unlock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, error) {
+	var unlocked []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	err := k.service.Call(secretsIface+".Unlock", 0, objects).
+		Store(&unlocked, &prompt)
+	if err != nil {
+		return nil, fmt.Errorf("keyring: unlock: %v", err)
+	}
+	if prompt == secretsNoPrompt {
+		return unlocked, nil
+	}
+	result, err := k.prompt(prompt)
+	if err != nil {
+		return nil, err
+	}
+	if paths, ok := result.Value().([]dbus.ObjectPath); ok {
+		return paths, nil
+	}
+	return nil, errors.New("keyring: unexpected unlock result")
+}
+
+// prompt shows a keyring prompt to the user and waits for it to complete
+func (k *keyring) prompt(prompt dbus.ObjectPath) (dbus.Variant, error) {
+	var result dbus.Variant
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(prompt),
+		dbus.WithMatchInterface(secretsPromptIface),
+		dbus.WithMatchMember("Completed"),
+	}
+	if err := k.conn.AddMatchSignal(match...); err != nil {
+		return result, fmt.Errorf("keyring: prompt: %v", err)
+	}
+	defer func() {
+		_ = k.conn.RemoveMatchSignal(match...)
+	}()
+	signals := make(chan *dbus.Signal, 4)
+	k.conn.Signal(signals)
+	defer k.conn.RemoveSignal(signals)
+
+	err := k.conn.Object(secretsService, prompt).
+		Call(secretsPromptIface+".Prompt", 0, "").Err
+	if err != nil {
+		return result, fmt.Errorf("keyring: prompt: %v", err)
+	}
+	timeout := time.After(keyringPromptTimeout)
+	for {
+		select {
+		case sig := <-signals:
+			if sig.Path != prompt || len(sig.Body) != 2 {
+				continue
+			}
+			if dismissed, _ := sig.Body[0].(bool); dismissed {
+				return result, errors.New("keyring: prompt dismissed")
+			}
+			result, _ = sig.Body[1].(dbus.Variant)
+			return result, nil
+		case <-timeout:
+			return result, errors.New("keyring: timeout waiting for prompt")
+		}
+	}
+}
+
+// keyringLookup returns the password stored in the keyring for the volume,
+// or "" if there is none
+func keyringLookup(volume string) (string, error) {
+	k, err := openKeyring()
+	if err != nil {
+		return "", err
+	}
+	defer k.close()
+	return k.lookup(volume)
+}
+
+// keyringStore stores the password for the volume in the keyring
+func keyringStore(volume string, password string) error {
+	k, err := openKeyring()
+	if err != nil {
+		return err
+	}
+	defer k.close()
+	return k.store(volume, password)
+}
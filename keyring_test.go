@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// testBusConfig is a dbus-daemon configuration for a private test bus
+const testBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startTestBus starts a private dbus-daemon, which stands in for the session
+// or system bus, and returns its address. The test is skipped if dbus-daemon
+// is not installed. The daemon is stopped by the returned function.
+func startTestBus(t *testing.T) (string, func()) {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not installed")
+	}
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	socket := filepath.Join(dir, "bus")
+	conf := filepath.Join(dir, "bus.conf")
+	okf(t, ioutil.WriteFile(conf, []byte(fmt.Sprintf(testBusConfig, socket)), 0600))
+
+	cmd := exec.Command(daemon, "--config-file="+conf, "--nofork",
+		"--print-address=1")
+	stdout, err := cmd.StdoutPipe()
+	okf(t, err)
+	okf(t, cmd.Start())
+	// the daemon prints its address when it's ready
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	okf(t, err)
+	return strings.TrimSpace(addr), func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// fakeSecretService implements the parts of the Secret Service used by emount.
+// Items are created unlocked. Locked items require a prompt to unlock.
+type fakeSecretService struct {
+	conn   *dbus.Conn
+	mu     sync.Mutex
+	items  map[dbus.ObjectPath]*fakeSecretItem
+	locked bool              // if true, items found by search are locked
+	unlock []dbus.ObjectPath // objects unlocked by the prompt
+}
+
+type fakeSecretItem struct {
+	attrs map[string]string
+	value []byte
+}
+
+const fakeCollection = dbus.ObjectPath("/org/freedesktop/secrets/collection/login")
+
+func newFakeSecretService(t *testing.T, addr string) *fakeSecretService {
+	t.Helper()
+	conn, err := dbus.Connect(addr)
+	okf(t, err)
+	s := &fakeSecretService{
+		conn:  conn,
+		items: make(map[dbus.ObjectPath]*fakeSecretItem),
+	}
+	okf(t, conn.Export(s, secretsPath, secretsIface))
+	okf(t, conn.Export(fakeSecretCollection{s}, fakeCollection, secretsCollIface))
+	okf(t, conn.Export(fakeSecretPrompt{s}, "/prompt/1", secretsPromptIface))
+	okf(t, conn.Export(s, "/session/1", "org.freedesktop.Secret.Session"))
+	reply, err := conn.RequestName(secretsService, dbus.NameFlagDoNotQueue)
+	okf(t, err)
+	assertf(t, reply == dbus.RequestNameReplyPrimaryOwner, "request name", reply)
+	return s
+}
+
+func (s *fakeSecretService) OpenSession(algorithm string,
+	input dbus.Variant) (dbus.Variant, dbus.ObjectPath, *dbus.Error) {
+	if algorithm != "plain" {
+		return dbus.MakeVariant(""), "/", dbus.MakeFailedError(
+			fmt.Errorf("unsupported algorithm %s", algorithm))
+	}
+	return dbus.MakeVariant(""), "/session/1", nil
+}
+
+func (s *fakeSecretService) Close() *dbus.Error {
+	return nil
+}
+
+func (s *fakeSecretService) search(attrs map[string]string) []dbus.ObjectPath {
+	var found []dbus.ObjectPath
+	for path, item := range s.items {
+		match := true
+		for k, v := range attrs {
+			if item.attrs[k] != v {
+				match = false
+			}
+		}
+		if match {
+			found = append(found, path)
+		}
+	}
+	return found
+}
+
+func (s *fakeSecretService) SearchItems(
+	attrs map[string]string) ([]dbus.ObjectPath, []dbus.ObjectPath, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := s.search(attrs)
+	if s.locked {
+		return []dbus.ObjectPath{}, found, nil
+	}
+	return found, []dbus.ObjectPath{}, nil
+}
+
+func (s *fakeSecretService) Unlock(
+	objects []dbus.ObjectPath) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locked {
+		s.unlock = objects
+		return []dbus.ObjectPath{}, "/prompt/1", nil
+	}
+	return objects, "/", nil
+}
+
+func (s *fakeSecretService) ReadAlias(name string) (dbus.ObjectPath, *dbus.Error) {
+	return fakeCollection, nil
+}
+
+type fakeSecretCollection struct {
+	s *fakeSecretService
+}
+
+func (c fakeSecretCollection) CreateItem(props map[string]dbus.Variant,
+	sec secret, replace bool) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	attrs, ok := props[secretsItemAttrs].Value().(map[string]string)
+	if !ok {
+		return "/", "/", dbus.MakeFailedError(fmt.Errorf("missing attributes"))
+	}
+	var path dbus.ObjectPath
+	if found := c.s.search(attrs); replace && len(found) > 0 {
+		path = found[0]
+	} else {
+		path = dbus.ObjectPath(fmt.Sprintf("%s/%d", fakeCollection, len(c.s.items)+1))
+		if err := c.s.conn.Export(fakeSecretItemObj{c.s, path}, path,
+			secretsItemIface); err != nil {
+			return "/", "/", dbus.MakeFailedError(err)
+		}
+	}
+	c.s.items[path] = &fakeSecretItem{attrs: attrs, value: sec.Value}
+	return path, "/", nil
+}
+
+type fakeSecretItemObj struct {
+	s    *fakeSecretService
+	path dbus.ObjectPath
+}
+
+func (i fakeSecretItemObj) GetSecret(session dbus.ObjectPath) (secret, *dbus.Error) {
+	i.s.mu.Lock()
+	defer i.s.mu.Unlock()
+	return secret{Session: session, Value: i.s.items[i.path].value,
+		ContentType: "text/plain"}, nil
+}
+
+type fakeSecretPrompt struct {
+	s *fakeSecretService
+}
+
+// Prompt simulates the user unlocking the keyring
+func (p fakeSecretPrompt) Prompt(windowID string) *dbus.Error {
+	p.s.mu.Lock()
+	p.s.locked = false
+	unlocked := p.s.unlock
+	p.s.mu.Unlock()
+	go func() {
+		_ = p.s.conn.Emit("/prompt/1", secretsPromptIface+".Completed",
+			false, dbus.MakeVariant(unlocked))
+	}()
+	return nil
+}
+
+func TestKeyring(t *testing.T) {
+
+	addr, stop := startTestBus(t)
+	defer stop()
+	sav := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	defer func() {
+		_ = os.Setenv("DBUS_SESSION_BUS_ADDRESS", sav)
+	}()
+	ok(t, os.Setenv("DBUS_SESSION_BUS_ADDRESS", addr))
+
+	service := newFakeSecretService(t, addr)
+	defer service.conn.Close()
+
+	// nothing stored yet
+	pw, err := keyringLookup("/tmp/vol1")
+	ok(t, err)
+	assert(t, pw == "", "empty keyring", pw)
+
+	ok(t, keyringStore("/tmp/vol1", "secret1"))
+	ok(t, keyringStore("/tmp/vol2", "secret2"))
+	// replaces existing item
+	ok(t, keyringStore("/tmp/vol1", "secret1b"))
+	assert(t, len(service.items) == 2, "items", len(service.items))
+
+	pw, err = keyringLookup("/tmp/vol1")
+	ok(t, err)
+	assert(t, pw == "secret1b", "lookup vol1", pw)
+
+	// locked keyring is unlocked through a prompt
+	service.mu.Lock()
+	service.locked = true
+	service.mu.Unlock()
+	pw, err = keyringLookup("/tmp/vol2")
+	ok(t, err)
+	assert(t, pw == "secret2", "lookup vol2 after unlock", pw)
+
+	// password source uses the keyring before other sources
+	ps := &passwordSource{fd: -1, extpass: "echo from-extpass", keyring: true}
+	pw, fromKeyring, err := ps.getVolumePassword("/tmp/vol2", "")
+	ok(t, err)
+	assert(t, pw == "secret2" && fromKeyring, "keyring source", pw)
+	pw, fromKeyring, err = ps.getVolumePassword("/tmp/vol3", "")
+	ok(t, err)
+	assert(t, pw == "from-extpass" && !fromKeyring, "fallback source", pw)
+	ps.remember("/tmp/vol3", pw)
+	pw, err = keyringLookup("/tmp/vol3")
+	ok(t, err)
+	assert(t, pw == "from-extpass", "remembered", pw)
+}
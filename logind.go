@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// With --lock-on-suspend, volumes are unmounted when the session is locked,
+// or the system is about to suspend, so they don't stay decrypted while the
+// laptop is unattended. emount listens for the signals of systemd-logind on
+// the system bus: Session.Lock for the session emount runs in, and
+// Manager.PrepareForSleep. It takes a delay inhibitor lock, so that logind
+// waits (up to InhibitDelayMaxSec) for the volumes to be unmounted before
+// the system suspends.
+
+// systemd-logind D-Bus names
+const (
+	logindService      = "org.freedesktop.login1"
+	logindPath         = dbus.ObjectPath("/org/freedesktop/login1")
+	logindManagerIface = "org.freedesktop.login1.Manager"
+	logindSessionIface = "org.freedesktop.login1.Session"
+)
+
+// lockWatcher calls a function when the session is locked, or the system
+// is about to suspend
+type lockWatcher struct {
+	conn    *dbus.Conn
+	manager dbus.BusObject
+	session dbus.ObjectPath // session of emount, or "" if it's not in one
+	signals chan *dbus.Signal
+	done    chan struct{}
+
+	mu      sync.Mutex
+	inhibit *os.File // delay inhibitor lock for suspend, or nil
+}
+
+// watchLock connects to logind, and starts watching for the session lock
+// and suspend. onLock is called from another goroutine with the reason;
+// when the system suspends, it's delayed until onLock returns.
+func watchLock(onLock func(reason string)) (*lockWatcher, error) {
+	w, err := newLockWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w.start(onLock)
+	return w, nil
+}
+
+// newLockWatcher connects to logind, and takes the inhibitor lock. The
+// signals received are queued until start.
+func newLockWatcher() (*lockWatcher, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("lock-on-suspend: connecting to system bus: %v", err)
+	}
+	w := &lockWatcher{
+		conn:    conn,
+		manager: conn.Object(logindService, logindPath),
+		signals: make(chan *dbus.Signal, 8),
+		done:    make(chan struct{}),
+	}
+	if err = w.inhibitSleep(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	// not being in a session is not an error: then only suspend is watched
+	var session dbus.ObjectPath
+	err = w.manager.Call(logindManagerIface+".GetSessionByPID", 0,
+		uint32(os.Getpid())).Store(&session)
+	if err == nil {
+		w.session = session
+	}
+
+	err = conn.AddMatchSignal(dbus.WithMatchObjectPath(logindPath),
+		dbus.WithMatchInterface(logindManagerIface),
+		dbus.WithMatchMember("PrepareForSleep"))
+	if err == nil && w.session != "" {
+		err = conn.AddMatchSignal(dbus.WithMatchObjectPath(w.session),
+			dbus.WithMatchInterface(logindSessionIface),
+			dbus.WithMatchMember("Lock"))
+	}
+	if err != nil {
+		w.allowSleep()
+		_ = conn.Close()
+		return nil, fmt.Errorf("lock-on-suspend: %v", err)
+	}
+	conn.Signal(w.signals)
+	return w, nil
+}
+
+// start calls onLock for the signals, from another goroutine
+func (w *lockWatcher) start(onLock func(reason string)) {
+	go w.loop(onLock)
+}
+
+func (w *lockWatcher) loop(onLock func(reason string)) {
+	for {
+		select {
+		case sig, ok := <-w.signals:
+			if !ok {
+				return
+			}
+			switch sig.Name {
+			case logindManagerIface + ".PrepareForSleep":
+				if len(sig.Body) != 1 {
+					continue
+				}
+				if sleeping, _ := sig.Body[0].(bool); sleeping {
+					onLock("the system is suspending")
+					w.allowSleep()
+				} else {
+					// resumed: delay the next suspend again. The warning
+					// goes to stderr, not into the command's output.
+					if err := w.inhibitSleep(); err != nil {
+						fmt.Fprintf(os.Stderr, "emount: WARNING: %v\n", err)
+					}
+				}
+			case logindSessionIface + ".Lock":
+				if sig.Path == w.session {
+					onLock("the session is locked")
+				}
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// inhibitSleep takes the delay inhibitor lock for suspend, if it's not held
+func (w *lockWatcher) inhibitSleep() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.inhibit != nil {
+		return nil
+	}
+	var fd dbus.UnixFD
+	err := w.manager.Call(logindManagerIface+".Inhibit", 0, "sleep", "emount",
+		"Unmount decrypted volumes", "delay").Store(&fd)
+	if err != nil {
+		return fmt.Errorf("lock-on-suspend: logind: %v", err)
+	}
+	w.inhibit = os.NewFile(uintptr(fd), "inhibit")
+	return nil
+}
+
+// allowSleep releases the inhibitor lock, so the system can suspend
+func (w *lockWatcher) allowSleep() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.inhibit != nil {
+		_ = w.inhibit.Close()
+		w.inhibit = nil
+	}
+}
+
+// stop stops watching, and releases the inhibitor lock. onLock may still be
+// running when stop returns.
+func (w *lockWatcher) stop() {
+	close(w.done)
+	w.conn.RemoveSignal(w.signals)
+	w.allowSleep()
+	_ = w.conn.Close()
+}
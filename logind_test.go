@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const fakeSession = dbus.ObjectPath("/org/freedesktop/login1/session/_31")
+
+// fakeLogind implements the parts of the logind manager used by emount.
+// Every process is in fakeSession.
+type fakeLogind struct {
+	conn     *dbus.Conn
+	mu       sync.Mutex
+	inhibits int        // number of inhibitor locks taken
+	pipes    []*os.File // the pipes returned by Inhibit
+}
+
+func newFakeLogind(t *testing.T, addr string) *fakeLogind {
+	t.Helper()
+	conn, err := dbus.Connect(addr)
+	okf(t, err)
+	l := &fakeLogind{conn: conn}
+	okf(t, conn.Export(l, logindPath, logindManagerIface))
+	reply, err := conn.RequestName(logindService, dbus.NameFlagDoNotQueue)
+	okf(t, err)
+	assertf(t, reply == dbus.RequestNameReplyPrimaryOwner, "request name", reply)
+	return l
+}
+
+func (l *fakeLogind) GetSessionByPID(pid uint32) (dbus.ObjectPath, *dbus.Error) {
+	return fakeSession, nil
+}
+
+// Inhibit returns the read end of a pipe, as logind does
+func (l *fakeLogind) Inhibit(what, who, why, mode string) (dbus.UnixFD, *dbus.Error) {
+	if what != "sleep" || mode != "delay" {
+		return -1, dbus.MakeFailedError(fmt.Errorf("unexpected lock %s %s", what, mode))
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return -1, dbus.MakeFailedError(err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inhibits++
+	l.pipes = append(l.pipes, r, w)
+	return dbus.UnixFD(r.Fd()), nil
+}
+
+func (l *fakeLogind) inhibitCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inhibits
+}
+
+func (l *fakeLogind) close() {
+	for _, f := range l.pipes {
+		_ = f.Close()
+	}
+	_ = l.conn.Close()
+}
+
+func (l *fakeLogind) suspend(t *testing.T, sleeping bool) {
+	ok(t, l.conn.Emit(logindPath, logindManagerIface+".PrepareForSleep", sleeping))
+}
+
+func (l *fakeLogind) lockSession(t *testing.T) {
+	ok(t, l.conn.Emit(fakeSession, logindSessionIface+".Lock"))
+}
+
+func TestLockOnSuspend(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	sav := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	defer func() {
+		_ = os.Setenv("DBUS_SYSTEM_BUS_ADDRESS", sav)
+	}()
+
+	// without logind, the run fails before anything is done
+	ok(t, os.Setenv("DBUS_SYSTEM_BUS_ADDRESS", "unix:path="+filepath.Join(dir, "no-bus")))
+	hooked := filepath.Join(dir, "hooked")
+	opt := &options{}
+	okf(t, parseCommand(opt, []string{"run", dir, "--lock-on-suspend", "--no-agent",
+		"--pre-mount", "touch " + hooked, "/bin/true"}))
+	err = decryptAndRun(opt)
+	assert(t, err != nil && strings.Contains(err.Error(), "system bus"), "no bus", err)
+	_, err = os.Stat(hooked)
+	assert(t, os.IsNotExist(err), "pre-mount hook not run", err)
+
+	addr, stop := startTestBus(t)
+	defer stop()
+	ok(t, os.Setenv("DBUS_SYSTEM_BUS_ADDRESS", addr))
+	logind := newFakeLogind(t, addr)
+	defer logind.close()
+
+	cipher := filepath.Join(dir, "vol.enc")
+	okf(t, initCryptVol(cipher, "", nil))
+	started := filepath.Join(dir, "started")
+
+	// runs a command that doesn't exit by itself, or the args, until the
+	// volume is locked by signal
+	runUntil := func(signal func(), args ...string) error {
+		_ = os.Remove(started)
+		if len(args) == 0 {
+			args = []string{"/bin/sh", "-c", "touch " + started + " && sleep 30"}
+		}
+		opt := &options{}
+		okf(t, parseCommand(opt, append([]string{"run", cipher, "--lock-on-suspend",
+			"--no-agent"}, args...)))
+		done := make(chan error, 1)
+		go func() {
+			done <- decryptAndRun(opt)
+		}()
+		for i := 0; i < 100; i++ {
+			if _, err := os.Stat(started); err == nil {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		signal()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(20 * time.Second):
+			t.Fatal("the command was not stopped")
+		}
+		return nil
+	}
+
+	err = runUntil(func() { logind.suspend(t, true) })
+	assert(t, exitCode(err) == 128+int(syscall.SIGTERM), "stopped on suspend", err)
+	assert(t, sharedMountPoint(cipher) == "", "unmounted on suspend", cipher)
+
+	// the lock of another session is ignored
+	err = runUntil(func() {
+		ok(t, logind.conn.Emit("/org/freedesktop/login1/session/c2",
+			logindSessionIface+".Lock"))
+		time.Sleep(200 * time.Millisecond)
+		assert(t, sharedMountPoint(cipher) != "", "other session", cipher)
+		logind.lockSession(t)
+	})
+	assert(t, exitCode(err) == 128+int(syscall.SIGTERM), "stopped on lock", err)
+	assert(t, sharedMountPoint(cipher) == "", "unmounted on lock", cipher)
+	assert(t, logind.inhibitCount() == 2, "inhibitor locks", logind.inhibitCount())
+
+	// a lock before the command starts: the command is not started
+	ran := filepath.Join(dir, "ran")
+	err = runUntil(func() { logind.lockSession(t) }, "--post-mount",
+		"touch "+started+" && sleep 1", "/bin/sh", "-c",
+		"trap '' TERM; touch "+ran)
+	assert(t, exitCode(err) == 128+int(syscall.SIGTERM), "not started", err)
+	_, serr := os.Stat(ran)
+	assert(t, os.IsNotExist(serr), "command not run", serr)
+	assert(t, sharedMountPoint(cipher) == "", "unmounted before start", cipher)
+
+	// the agent releases the volumes run with --lock-on-suspend, and keeps
+	// the others
+	other := filepath.Join(dir, "other.enc")
+	okf(t, initCryptVol(other, "", nil))
+	path, err := agentSocketPath()
+	okf(t, err)
+	pid, err := startAgent(path, 0, "")
+	okf(t, err)
+	defer func() {
+		_ = syscall.Kill(pid, syscall.SIGTERM)
+	}()
+	opt = &options{}
+	okf(t, parseCommand(opt, []string{"run", cipher, "--lock-on-suspend", "/bin/true"}))
+	okf(t, decryptAndRun(opt))
+	opt = &options{}
+	okf(t, parseCommand(opt, []string{"run", other, "/bin/true"}))
+	okf(t, decryptAndRun(opt))
+	assert(t, sharedMountPoint(cipher) != "" && sharedMountPoint(other) != "",
+		"held by the agent", nil)
+
+	logind.suspend(t, true)
+	for i := 0; i < 50 && sharedMountPoint(cipher) != ""; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert(t, sharedMountPoint(cipher) == "", "released on suspend", cipher)
+	assert(t, sharedMountPoint(other) != "", "kept", other)
+
+	// after resume, the agent delays the next suspend again
+	logind.suspend(t, false)
+	for i := 0; i < 50 && logind.inhibitCount() < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert(t, logind.inhibitCount() == 5, "inhibitor lock after resume",
+		logind.inhibitCount())
+	okf(t, lockVolumes("", true))
+	assert(t, sharedMountPoint(other) == "", "locked", other)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"rsc.io/qr"
+)
+
+// The master key of a volume is printed by gocryptfs -init. With the key,
+// the volume can be opened without gocryptfs.conf or the password, so emount
+// init offers to save it as a paper backup, and emount recover uses it to
+// set a new password.
+
+const (
+	masterKeyLen = 64 // hex digits
+	keyLineLen   = 16 // hex digits per line of the paper backup
+)
+
+var (
+	// masterKeyPattern finds the master key in the output of gocryptfs -init,
+	// which prints it in groups of 8 hex digits, on two lines
+	masterKeyPattern = regexp.MustCompile(`[0-9a-fA-F]{8}(?:-\s*[0-9a-fA-F]{8}){7}`)
+
+	// keyLinePattern is a line of the master key in a paper backup
+	keyLinePattern = regexp.MustCompile(
+		`(?m)^\s*([1-4])\s+([0-9a-fA-F]{8})-([0-9a-fA-F]{8})\s+check\s+([0-9a-fA-F]{4})\s*$`)
+
+	// keyCheckPattern is the check of the whole key in a paper backup
+	keyCheckPattern = regexp.MustCompile(`(?m)^\s*key check:\s+([0-9a-fA-F]{4}-[0-9a-fA-F]{4})\s*$`)
+)
+
+// normalizeMasterKey returns the master key as 64 lowercase hex digits.
+// Dashes and spaces in the key are ignored.
+func normalizeMasterKey(s string) (string, error) {
+	key := strings.ToLower(strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, s))
+	if _, err := hex.DecodeString(key); err != nil || len(key) != masterKeyLen {
+		return "", errors.New("a master key is 64 hex digits, in groups of 8")
+	}
+	return key, nil
+}
+
+// masterKeyFromOutput returns the master key printed by gocryptfs -init
+func masterKeyFromOutput(out string) (string, error) {
+	m := masterKeyPattern.FindString(out)
+	if m == "" {
+		return "", errors.New("the master key was not found in the output of gocryptfs")
+	}
+	return normalizeMasterKey(m)
+}
+
+// formatMasterKey returns the key in groups of 8 hex digits separated by
+// dashes, as gocryptfs prints it and accepts it with -masterkey
+func formatMasterKey(key string) string {
+	var groups []string
+	for i := 0; i < len(key); i += 8 {
+		groups = append(groups, key[i:i+8])
+	}
+	return strings.Join(groups, "-")
+}
+
+// keyCheck returns a short checksum of s, to catch typing errors
+func keyCheck(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:2])
+}
+
+// masterKeyCheck returns the check of the whole key, e.g., "3a9f-81c2"
+func masterKeyCheck(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	h := hex.EncodeToString(sum[:4])
+	return h[:4] + "-" + h[4:]
+}
+
+// paperBackup returns the text of a paper backup of the volume's master key:
+// the key in four lines, each with a check, the check of the whole key,
+// and a QR code of the key
+func paperBackup(cipher string, key string, created time.Time) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "emount master key backup\n\n")
+	fmt.Fprintf(&b, "Volume:   %s\n", cipher)
+	fmt.Fprintf(&b, "Created:  %s\n\n", created.Format(time.RFC1123))
+	fmt.Fprintf(&b, "Anyone with this key and the encrypted folder can read the data,\n"+
+		"without the password. Keep it offline, in a safe place.\n\n")
+	fmt.Fprintf(&b, "If the password is forgotten or gocryptfs.conf is damaged, set a new\n"+
+		"password with:  emount recover %s\n"+
+		"and type the key, or use --key-file with a copy of this file.\n\n", cipher)
+	fmt.Fprintf(&b, "Master key:\n")
+	for i := 0; i < masterKeyLen/keyLineLen; i++ {
+		line := key[i*keyLineLen : (i+1)*keyLineLen]
+		fmt.Fprintf(&b, "  %d  %s-%s   check %s\n", i+1, line[:8], line[8:], keyCheck(line))
+	}
+	fmt.Fprintf(&b, "  key check: %s\n\n", masterKeyCheck(key))
+
+	code, err := qr.Encode(strings.ToUpper(formatMasterKey(key)), qr.M)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&b, "QR code of the master key:\n\n%s", qrText(code))
+	return b.String(), nil
+}
+
+// qrText draws the QR code with block characters, two rows per line,
+// with a quiet zone around it. Black is drawn as the block.
+func qrText(code *qr.Code) string {
+	const quiet = 2
+	var b strings.Builder
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		b.WriteString("  ")
+		for x := -quiet; x < code.Size+quiet; x++ {
+			top, bottom := code.Black(x, y), code.Black(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// readKeyBackup reads the master key from a paper backup file, and verifies
+// its checks. A file containing only the key is also accepted.
+func readKeyBackup(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	text := string(data)
+	lines := keyLinePattern.FindAllStringSubmatch(text, -1)
+	if len(lines) == 0 {
+		key, err := normalizeMasterKey(text)
+		if err != nil {
+			return "", fmt.Errorf("no master key in %s: %v", path, err)
+		}
+		return key, nil
+	}
+	if len(lines) != masterKeyLen/keyLineLen {
+		return "", fmt.Errorf("%s has %d lines of the master key, expected %d",
+			path, len(lines), masterKeyLen/keyLineLen)
+	}
+	var key string
+	for i, m := range lines {
+		line := strings.ToLower(m[2] + m[3])
+		if m[1] != fmt.Sprint(i+1) {
+			return "", fmt.Errorf("%s: the lines of the master key are out of order", path)
+		}
+		if keyCheck(line) != strings.ToLower(m[4]) {
+			return "", fmt.Errorf("%s: line %d of the master key doesn't match "+
+				"its check. Is there a typing error?", path, i+1)
+		}
+		key += line
+	}
+	if m := keyCheckPattern.FindStringSubmatch(text); m != nil &&
+		strings.ToLower(m[1]) != masterKeyCheck(key) {
+		return "", fmt.Errorf("%s: the master key doesn't match the key check", path)
+	}
+	return key, nil
+}
+
+// writeKeyBackup writes the paper backup to path, which must not exist
+func writeKeyBackup(path string, cipher string, key string) error {
+	text, err := paperBackup(cipher, key, time.Now())
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(text)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+// showMasterKey shows the paper backup on the terminal, waits until the
+// user has written it down, and clears the screen
+func showMasterKey(tty *os.File, cipher string, key string) error {
+	text, err := paperBackup(cipher, key, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(tty, "\n%s\n", text)
+	_, err = askLine(tty, "Write down the master key, or take a photo of the QR code, "+
+		"then press Enter to clear the screen. ")
+	// clear the screen and the scrollback
+	fmt.Fprint(tty, "\033[H\033[2J\033[3J")
+	return err
+}
+
+// keyBackup is how emount init saves the master key
+type keyBackup struct {
+	file string // if not empty, write a paper backup to this file
+	show bool   // show the key once on the terminal
+}
+
+// saver returns the function that saves the master key at init, or nil if
+// it's not saved: without --key-backup or --show-key, the user is only
+// asked if the password is entered at a prompt. Scripts that use
+// EMOUNT_PASSWORD or another password source are not asked, and gocryptfs
+// doesn't print the key, as before init saved it.
+func (o *keyBackup) saver(pass *passwordSource) func(cipher string, key string) error {
+	if o.file == "" && !o.show && !pass.interactive() {
+		return nil
+	}
+	return o.save
+}
+
+// save saves the master key of the new volume as selected by the flags.
+// If no flag was given and there is a terminal, the user is asked.
+func (o *keyBackup) save(cipher string, key string) error {
+	cipher, err := filepath.Abs(cipher)
+	if err != nil {
+		return err
+	}
+	file, show := o.file, o.show
+	var tty *os.File
+	if show || file == "" {
+		if tty, err = os.OpenFile(ttyPath, os.O_RDWR, 0); err != nil {
+			tty = nil
+		} else {
+			defer tty.Close()
+		}
+	}
+	if file == "" && !show {
+		if tty == nil {
+			fmt.Printf("WARNING: the master key of %s was not saved. Without it, "+
+				"the data can't be recovered if the password is forgotten or "+
+				"%s is damaged. Use --key-backup FILE or --show-key with init "+
+				"to save it.\n", cipher, gocryptfsConf)
+			return nil
+		}
+		fmt.Fprintf(tty, "The master key can recover the volume if the password "+
+			"is forgotten or %s is damaged.\n", gocryptfsConf)
+		answer, err := askLine(tty, "Save it: [f]ile, [s]how once, or [n]o? ")
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(answer) {
+		case "f", "file":
+			def := strings.TrimSuffix(cipher, string(filepath.Separator)) + "-masterkey.txt"
+			if file, err = askLine(tty, fmt.Sprintf("File [%s]: ", def)); err != nil {
+				return err
+			}
+			if file == "" {
+				file = def
+			}
+		case "s", "show":
+			show = true
+		default:
+			fmt.Fprintf(tty, "The master key was not saved.\n")
+			return nil
+		}
+	}
+	if file != "" {
+		if err = writeKeyBackup(file, cipher, key); err != nil {
+			return fmt.Errorf("writing the master key backup: %v", err)
+		}
+		fmt.Printf("Wrote a paper backup of the master key to %s. Print it, "+
+			"store it in a safe place, and delete the file.\n", file)
+	}
+	if show {
+		if tty == nil {
+			return errors.New("--show-key needs a terminal")
+		}
+		return showMasterKey(tty, cipher, key)
+	}
+	return nil
+}
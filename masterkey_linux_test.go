@@ -0,0 +1,56 @@
+// +build !darwin
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestInitKeyNotAsked checks that init, with the password from
+// EMOUNT_PASSWORD, doesn't ask on the terminal how to save the master key
+func TestInitKeyNotAsked(t *testing.T) {
+
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	exe, err := os.Executable()
+	okf(t, err)
+	for _, args := range [][]string{
+		{"--init", filepath.Join(dir, "legacy")},
+		{"init", filepath.Join(dir, "new")},
+	} {
+		// the test binary runs emount (see TestMain)
+		cmd := exec.Command(exe, args...)
+		master, out := startOnPty(t, cmd)
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+		select {
+		case err = <-done:
+		case <-time.After(10 * time.Second):
+			_ = cmd.Process.Kill()
+			t.Fatalf("%v is waiting: %s", args, out.String())
+		}
+		_ = master.Close()
+		ok(t, err)
+		assert(t, !strings.Contains(out.String(), "master key"), "not asked",
+			args, out.String())
+		_, err = os.Stat(filepath.Join(args[1], gocryptfsConf))
+		ok(t, err)
+	}
+}
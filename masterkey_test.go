@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMasterKey(t *testing.T) {
+
+	// as printed by gocryptfs -init
+	out := "Your master key is:\n\n    6f717d8b-6b5f7e7b-cd2b6a2d-8c8b9e0f-\n" +
+		"    11223344-55667788-99aabbcc-ddeeff00\n\nIf the gocryptfs.conf file..."
+	key, err := masterKeyFromOutput(out)
+	okf(t, err)
+	assert(t, key == "6f717d8b6b5f7e7bcd2b6a2d8c8b9e0f1122334455667788"+
+		"99aabbccddeeff00", "key", key)
+	assert(t, formatMasterKey(key) == "6f717d8b-6b5f7e7b-cd2b6a2d-8c8b9e0f-"+
+		"11223344-55667788-99aabbcc-ddeeff00", "formatted", formatMasterKey(key))
+	_, err = masterKeyFromOutput("The gocryptfs filesystem has been created successfully.")
+	assert(t, err != nil, "no key in output", err)
+
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// the paper backup can be read back, and typos are found
+	backup := filepath.Join(dir, "key.txt")
+	okf(t, writeKeyBackup(backup, "/vol", key))
+	read, err := readKeyBackup(backup)
+	okf(t, err)
+	assert(t, read == key, "key from backup", read)
+	assert(t, writeKeyBackup(backup, "/vol", key) != nil, "backup is not overwritten", backup)
+	data, err := ioutil.ReadFile(backup)
+	okf(t, err)
+	typo := filepath.Join(dir, "typo.txt")
+	okf(t, ioutil.WriteFile(typo, []byte(strings.Replace(string(data),
+		"cd2b6a2d", "cd2b6a2e", 1)), 0600))
+	_, err = readKeyBackup(typo)
+	assert(t, err != nil && strings.Contains(err.Error(), "line 2"), "typo", err)
+
+	// a volume's password is replaced using its master key
+	defer setTestRuntimeDir(t)()
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	cipher := filepath.Join(dir, "vol")
+	var saved string
+	okf(t, initCryptVolWith(cipher, &initOptions{saveKey: func(c string, k string) error {
+		saved = k
+		return nil
+	}}))
+	assert(t, len(saved) == masterKeyLen, "key saved", saved)
+	okf(t, ioutil.WriteFile(filepath.Join(dir, "saved.txt"), []byte(formatMasterKey(saved)), 0600))
+
+	// with a file in the volume, a wrong key is detected even if gocryptfs
+	// doesn't check it
+	mp, err := mountCrypt(cipher, "", password)
+	okf(t, err)
+	ok(t, ioutil.WriteFile(filepath.Join(mp, "a.txt"), []byte("hello"), 0600))
+	ok(t, unmountVol(mp))
+	_ = os.Remove(mp)
+
+	wrong := filepath.Join(dir, "wrong.txt")
+	okf(t, ioutil.WriteFile(wrong, []byte(strings.Repeat("0", masterKeyLen)), 0600))
+	err = recoverVolume(cipher, wrong, nil)
+	assert(t, exitCode(err) == exitPassword, "wrong key", err)
+
+	newPassword := password + "-new"
+	os.Setenv("EMOUNT_PASSWORD", newPassword)
+	okf(t, recoverVolume(cipher, filepath.Join(dir, "saved.txt"), nil))
+	_, err = os.Stat(filepath.Join(cipher, gocryptfsConf+confBackupSuffix))
+	assert(t, os.IsNotExist(err), "conf backup removed", err)
+	mp, err = mountCrypt(cipher, "", newPassword)
+	okf(t, err)
+	data, err = ioutil.ReadFile(filepath.Join(mp, "a.txt"))
+	ok(t, err)
+	assert(t, string(data) == "hello", "data after recover", string(data))
+	ok(t, unmountVol(mp))
+	_ = os.Remove(mp)
+}
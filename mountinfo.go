@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// mountEntry describes a mounted filesystem
+type mountEntry struct {
+	source     string // device or source, e.g., the cipher dir for gocryptfs
+	mountPoint string
+	fsType     string // e.g., "fuse.gocryptfs" on linux
+}
+
+// isMountPoint returns true if a filesystem is mounted at path
+func isMountPoint(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+	mounts, err := readMounts()
+	if err != nil {
+		return false
+	}
+	for _, m := range mounts {
+		if m.mountPoint == abs {
+			return true
+		}
+	}
+	return false
+}
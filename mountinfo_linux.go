@@ -0,0 +1,75 @@
+// +build !darwin
+
+package main
+
+// linux mount table, read from /proc/self/mountinfo
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mountInfoPath is the mount table of the current process
+var mountInfoPath = "/proc/self/mountinfo"
+
+// readMounts returns the currently mounted filesystems
+func readMounts() ([]mountEntry, error) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMountInfo(f)
+}
+
+// parseMountInfo parses the mountinfo format documented in proc(5):
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+//
+// The mount point is the 5th field. After a variable number of optional
+// fields, the separator "-" is followed by the filesystem type and source.
+func parseMountInfo(r io.Reader) ([]mountEntry, error) {
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		sep := 6
+		for sep < len(fields) && fields[sep] != "-" {
+			sep++
+		}
+		if sep+2 >= len(fields) {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			mountPoint: unescapeMountInfo(fields[4]),
+			fsType:     fields[sep+1],
+			source:     unescapeMountInfo(fields[sep+2]),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountInfo decodes octal escapes such as \040 for space
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,24 @@
+// +build !darwin
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	info := `22 28 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:13 - proc proc rw
+36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+120 28 0:52 / /tmp/emount_123 rw,nosuid,nodev,relatime shared:64 - fuse.gocryptfs /home/me/my\040vol rw,user_id=1000
+bad line
+`
+	mounts, err := parseMountInfo(strings.NewReader(info))
+	okf(t, err)
+	assertf(t, len(mounts) == 3, "mounts", len(mounts))
+	assert(t, mounts[1].mountPoint == "/mnt2" && mounts[1].fsType == "ext3" &&
+		mounts[1].source == "/dev/root", "ext3", mounts[1])
+	assert(t, mounts[2].mountPoint == "/tmp/emount_123" &&
+		mounts[2].fsType == "fuse.gocryptfs" &&
+		mounts[2].source == "/home/me/my vol", "gocryptfs", mounts[2])
+}
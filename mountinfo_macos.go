@@ -0,0 +1,44 @@
+// +build darwin
+
+package main
+
+// macos mount table, read from the output of mount(8), since there is
+// no /proc. Lines look like:
+//
+//	gocryptfs@/Users/me/vol on /private/tmp/emount_123 (macfuse, nodev, nosuid)
+
+import (
+	"bufio"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// readMounts returns the currently mounted filesystems
+func readMounts() ([]mountEntry, error) {
+	out, err := exec.Command("/sbin/mount").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseMountOutput(strings.NewReader(string(out)))
+}
+
+func parseMountOutput(r io.Reader) ([]mountEntry, error) {
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		on := strings.Index(line, " on ")
+		paren := strings.LastIndex(line, " (")
+		if on < 0 || paren < on {
+			continue
+		}
+		opts := strings.TrimSuffix(line[paren+2:], ")")
+		mounts = append(mounts, mountEntry{
+			source:     line[:on],
+			mountPoint: line[on+4 : paren],
+			fsType:     strings.TrimSpace(strings.SplitN(opts, ",", 2)[0]),
+		})
+	}
+	return mounts, scanner.Err()
+}
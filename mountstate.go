@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Runtime state shared between emount processes. For each mounted volume,
+// the state dir contains a lock file and a JSON state file that records the
+// mount point and the emount processes using the mount. The first emount
+// process mounts the volume, later ones reuse the mount, and the last one
+// to finish unmounts it.
+
+const (
+	stateDirName  = "emount"
+	stateDirMode  = 0700
+	envRuntimeDir = "XDG_RUNTIME_DIR"
+)
+
+// mountState is the state of a mounted volume
+type mountState struct {
+	Cipher     string      `json:"cipher"`     // absolute path of encrypted folder
+	MountPoint string      `json:"mountPoint"` // absolute path of mount point
+	TempMount  bool        `json:"tempMount"`  // mount point was created by emount
+	MountedAt  time.Time   `json:"mountedAt"`
+	Users      []mountUser `json:"users"` // emount processes using the mount
+}
+
+// mountUser is an emount process using a mounted volume
+type mountUser struct {
+	PID      int  `json:"pid"`                // emount process
+	CmdPID   int  `json:"cmdPid,omitempty"`   // command run by emount
+	CmdGroup bool `json:"cmdGroup,omitempty"` // the command leads its process group
+}
+
+// stateDir returns the directory for runtime state, creating it if needed.
+// This is $XDG_RUNTIME_DIR/emount, or TMPDIR/emount-UID if XDG_RUNTIME_DIR
+// is not set.
+func stateDir() (string, error) {
+	dir := os.Getenv(envRuntimeDir)
+	if dir != "" {
+		dir = filepath.Join(dir, stateDirName)
+	} else {
+		dir = filepath.Join(os.TempDir(),
+			stateDirName+"-"+strconv.Itoa(os.Getuid()))
+	}
+	if err := os.MkdirAll(dir, stateDirMode); err != nil {
+		return "", fmt.Errorf("creating state dir: %v", err)
+	}
+	// the fallback in TMPDIR is shared with other users; make sure it's ours
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !fi.IsDir() ||
+		(ok && int(st.Uid) != os.Getuid()) || fi.Mode().Perm() != stateDirMode {
+		return "", fmt.Errorf("state dir %s must be a directory owned by "+
+			"the current user with mode %o", dir, stateDirMode)
+	}
+	return dir, nil
+}
+
+// volumeKey returns a file name for the volume's state,
+// derived from its absolute path
+func volumeKey(cipher string) string {
+	sum := sha256.Sum256([]byte(cipher))
+	return hex.EncodeToString(sum[:12])
+}
+
+// processAlive returns true if the process exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// volumeLock is an exclusive lock on the state of a volume
+type volumeLock struct {
+	file      *os.File
+	statePath string
+}
+
+// lockVolume waits for and acquires the lock for the volume.
+// cipher must be an absolute path.
+func lockVolume(cipher string) (*volumeLock, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Join(dir, volumeKey(cipher))
+	f, err := os.OpenFile(base+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("locking %s: %v", f.Name(), err)
+	}
+	return &volumeLock{file: f, statePath: base + ".json"}, nil
+}
+
+func (l *volumeLock) unlock() {
+	_ = syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	_ = l.file.Close()
+}
+
+// read returns the volume's state, or nil if it's not mounted by emount.
+// Users whose processes have exited are removed.
+func (l *volumeLock) read() (*mountState, error) {
+	st, err := readStateFile(l.statePath)
+	if err != nil || st == nil {
+		return nil, err
+	}
+	live := st.Users[:0]
+	for _, u := range st.Users {
+		if processAlive(u.PID) {
+			live = append(live, u)
+		}
+	}
+	st.Users = live
+	return st, nil
+}
+
+// write saves the state, or removes it if st is nil
+func (l *volumeLock) write(st *mountState) error {
+	if st == nil {
+		err := os.Remove(l.statePath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.statePath + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.statePath)
+}
+
+func readStateFile(path string) (*mountState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st mountState
+	if err = json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	return &st, nil
+}
+
+// sharedMount is a volume mounted for the current process, possibly
+// shared with other emount processes
+type sharedMount struct {
+	cipher     string // absolute path of the encrypted folder
+	mountPoint string // absolute path of the mount point
+	mounted    bool   // true if the volume was mounted by this process
+}
+
+// acquireMount mounts the volume, or reuses the mount if it's already
+// mounted by another emount process.
+// - cipher the encrypted folder
+// - mountPoint if not empty, the volume must be mounted here
+// - pass the source of the password, used only if the volume is mounted
+func acquireMount(cipher string, mountPoint string,
+	pass *passwordSource) (*sharedMount, error) {
+	return acquireMountPrompt(cipher, mountPoint, pass, "Enter encryption passphrase: ")
+}
+
+// acquireMountPrompt is acquireMount, with the prompt used if the user is
+// asked for the password
+func acquireMountPrompt(cipher string, mountPoint string, pass *passwordSource,
+	prompt string) (*sharedMount, error) {
+
+	var encPass string
+	var fromKeyring bool
+	vol, err := acquireMountWith(cipher, mountPoint, func(cipher string) (string, error) {
+		var err error
+		encPass, fromKeyring, err = pass.getVolumePassword(cipher, prompt)
+		return encPass, err
+	})
+	if err != nil {
+		if fromKeyring {
+			return nil, fmt.Errorf("%v (password from keyring)", err)
+		}
+		return nil, err
+	}
+	if vol.mounted && !fromKeyring {
+		pass.remember(vol.cipher, encPass)
+	}
+	return vol, nil
+}
+
+// acquireMountWith is acquireMount, with a function that returns the
+// password for the absolute path of the volume
+func acquireMountWith(cipher string, mountPoint string,
+	getPass func(cipher string) (string, error)) (*sharedMount, error) {
+
+	cipher, err := filepath.Abs(cipher)
+	if err != nil {
+		return nil, err
+	}
+	if mountPoint != "" {
+		if mountPoint, err = filepath.Abs(mountPoint); err != nil {
+			return nil, err
+		}
+	}
+	lock, err := lockVolume(cipher)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+	st, err := lock.read()
+	if err != nil {
+		return nil, err
+	}
+	user := mountUser{PID: os.Getpid()}
+
+	if st != nil && isMountPoint(st.MountPoint) {
+		if len(st.Users) > 0 {
+			if mountPoint != "" && mountPoint != st.MountPoint {
+				return nil, newExitErr(exitMount, fmt.Errorf(
+					"%s is already mounted at %s by emount (pid %d). "+
+						"Use that mount point, or omit --mount",
+					cipher, st.MountPoint, st.Users[0].PID))
+			}
+			st.Users = append(st.Users, user)
+			if err = lock.write(st); err != nil {
+				return nil, err
+			}
+			return &sharedMount{cipher: cipher, mountPoint: st.MountPoint}, nil
+		}
+		// left mounted by an emount process that no longer exists.
+		// Unmount it, so it's mounted fresh with the password.
+		if err = unmountVol(st.MountPoint); err != nil {
+			return nil, newExitErr(exitMount, fmt.Errorf(
+				"%s is still mounted at %s from an earlier run, and "+
+					"unmounting it failed: %v", cipher, st.MountPoint, err))
+		}
+		if st.TempMount {
+			_ = os.Remove(st.MountPoint)
+		}
+	}
+
+	encPass, err := getPass(cipher)
+	if err != nil {
+		return nil, err
+	}
+	mp, err := mountCrypt(cipher, mountPoint, encPass)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to mount: %w", err)
+	}
+	st = &mountState{
+		Cipher:     cipher,
+		MountPoint: mp,
+		TempMount:  mountPoint == "",
+		MountedAt:  time.Now(),
+		Users:      []mountUser{user},
+	}
+	if err = lock.write(st); err != nil {
+		// the state is needed so the mount is unmounted when done
+		_ = unmountVol(mp)
+		if st.TempMount {
+			_ = os.Remove(mp)
+		}
+		return nil, fmt.Errorf("saving mount state: %v", err)
+	}
+	return &sharedMount{cipher: cipher, mountPoint: mp, mounted: true}, nil
+}
+
+// setCommandPID records the pid of the command using the mount, and
+// whether it leads its own process group
+func (m *sharedMount) setCommandPID(pid int, ownGroup bool) error {
+	lock, err := lockVolume(m.cipher)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	st, err := lock.read()
+	if err != nil || st == nil {
+		return err
+	}
+	for i := range st.Users {
+		if st.Users[i].PID == os.Getpid() {
+			st.Users[i].CmdPID = pid
+			st.Users[i].CmdGroup = ownGroup
+		}
+	}
+	return lock.write(st)
+}
+
+// lastUser returns true if no other emount process is using the mount, so
+// it will be unmounted when this process releases it
+func (m *sharedMount) lastUser() bool {
+	lock, err := lockVolume(m.cipher)
+	if err != nil {
+		return false
+	}
+	defer lock.unlock()
+	st, err := lock.read()
+	if err != nil || st == nil {
+		return false
+	}
+	for _, u := range st.Users {
+		if u.PID != os.Getpid() {
+			return false
+		}
+	}
+	return true
+}
+
+// release ends this process's use of the mount. If no other emount process
+// is using it, the volume is unmounted, and the mount point is removed if it
+// was created by emount. Returns true if the volume was unmounted.
+func (m *sharedMount) release() (bool, error) {
+	lock, err := lockVolume(m.cipher)
+	if err != nil {
+		return false, err
+	}
+	defer lock.unlock()
+	st, err := lock.read()
+	if err != nil {
+		return false, err
+	}
+	if st == nil {
+		return false, errors.New("mount state is missing")
+	}
+	others := st.Users[:0]
+	for _, u := range st.Users {
+		if u.PID != os.Getpid() {
+			others = append(others, u)
+		}
+	}
+	st.Users = others
+	if len(others) > 0 {
+		return false, lock.write(st)
+	}
+	if err = unmountVol(st.MountPoint); err != nil {
+		// keep the state without users, so the mount can be found later
+		_ = lock.write(st)
+		return false, err
+	}
+	if st.TempMount {
+		_ = os.Remove(st.MountPoint)
+	}
+	return true, lock.write(nil)
+}
+
+// sharedMountPoint returns the mount point of the volume if it's currently
+// mounted by an emount process, otherwise ""
+func sharedMountPoint(cipher string) string {
+	cipher, err := filepath.Abs(cipher)
+	if err != nil {
+		return ""
+	}
+	lock, err := lockVolume(cipher)
+	if err != nil {
+		return ""
+	}
+	defer lock.unlock()
+	st, err := lock.read()
+	if err != nil || st == nil || len(st.Users) == 0 ||
+		!isMountPoint(st.MountPoint) {
+		return ""
+	}
+	return st.MountPoint
+}
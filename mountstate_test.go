@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// setTestRuntimeDir points XDG_RUNTIME_DIR at a new temp dir, so tests
+// don't share emount state with the user. Call the returned func to restore.
+func setTestRuntimeDir(t *testing.T) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	sav, had := os.LookupEnv(envRuntimeDir)
+	ok(t, os.Setenv(envRuntimeDir, dir))
+	return func() {
+		if had {
+			_ = os.Setenv(envRuntimeDir, sav)
+		} else {
+			_ = os.Unsetenv(envRuntimeDir)
+		}
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestSharedMount(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+
+	// generate random password of about 31-32 hex chars
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+
+	newCrypt, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(newCrypt)
+	}()
+	okf(t, initCryptVol(newCrypt, "", nil))
+
+	vol, err := acquireMount(newCrypt, "", nil)
+	okf(t, err)
+	assert(t, vol.mounted, "first user mounts", vol)
+	assert(t, isMountPoint(vol.mountPoint), "is mounted", vol.mountPoint)
+	assert(t, sharedMountPoint(newCrypt) == vol.mountPoint, "shared mount point",
+		sharedMountPoint(newCrypt))
+	ok(t, vol.setCommandPID(1234, true))
+
+	// simulate another emount process using the volume
+	other := exec.Command("sleep", "60")
+	okf(t, other.Start())
+	lock, err := lockVolume(vol.cipher)
+	okf(t, err)
+	st, err := lock.read()
+	okf(t, err)
+	assert(t, len(st.Users) == 1 && st.Users[0].CmdPID == 1234, "state", st)
+	st.Users = append(st.Users, mountUser{PID: other.Process.Pid})
+	ok(t, lock.write(st))
+	lock.unlock()
+
+	// another process can't mount it elsewhere
+	_, err = acquireMount(newCrypt, newCrypt+"/elsewhere", nil)
+	if err == nil || !strings.Contains(err.Error(), "already mounted") {
+		t.Errorf("expected already mounted error, got %v", err)
+	}
+
+	// the other process is still using it, so it stays mounted
+	unmounted, err := vol.release()
+	ok(t, err)
+	assert(t, !unmounted, "still in use", unmounted)
+	assert(t, isMountPoint(vol.mountPoint), "still mounted", vol.mountPoint)
+
+	// reuse while another process is using it: no password needed
+	os.Setenv("EMOUNT_PASSWORD", "wrong-password")
+	vol2, err := acquireMount(newCrypt, "", nil)
+	okf(t, err)
+	assert(t, !vol2.mounted && vol2.mountPoint == vol.mountPoint, "reused", vol2)
+	unmounted, err = vol2.release()
+	ok(t, err)
+	assert(t, !unmounted, "still in use by other", unmounted)
+
+	// after the other process exits, the mount is stale: it's unmounted
+	// and mounted again, which requires the password
+	ok(t, other.Process.Kill())
+	_ = other.Wait()
+	_, err = acquireMount(newCrypt, "", nil)
+	assert(t, exitCode(err) == exitPassword, "stale mount needs password", err)
+	assert(t, !isMountPoint(vol.mountPoint), "stale mount unmounted", vol.mountPoint)
+
+	os.Setenv("EMOUNT_PASSWORD", password)
+	vol3, err := acquireMount(newCrypt, "", nil)
+	okf(t, err)
+	assert(t, vol3.mounted, "mounted again", vol3)
+	unmounted, err = vol3.release()
+	ok(t, err)
+	assert(t, unmounted, "last user unmounts", unmounted)
+	assert(t, checkFolder(vol3.mountPoint) == invalidPath, "temp mount point removed",
+		vol3.mountPoint)
+	assert(t, sharedMountPoint(newCrypt) == "", "no shared mount", newCrypt)
+}
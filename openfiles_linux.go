@@ -0,0 +1,44 @@
+// +build !darwin
+
+package main
+
+// linux open file count, from the file descriptors in /proc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// procPath is the root of the proc filesystem
+var procPath = "/proc"
+
+// countOpenFiles returns the number of open file descriptors, of all
+// processes that can be inspected, for files on the mount at mountPoint
+func countOpenFiles(mountPoint string) (int, error) {
+	entries, err := ioutil.ReadDir(procPath)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, e := range entries {
+		if !e.IsDir() || strings.Trim(e.Name(), "0123456789") != "" {
+			continue
+		}
+		fdDir := filepath.Join(procPath, e.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			// the process exited, or belongs to another user
+			continue
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err == nil && (target == mountPoint ||
+				strings.HasPrefix(target, mountPoint+"/")) {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
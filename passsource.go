@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+const (
+	// maxPasswordLen limits the length of a password read from a file
+	// descriptor, to avoid unbounded reads from a misconfigured source
+	maxPasswordLen = 2048
+)
+
+// passwordSource describes where the volume password comes from.
+// The sources are modelled on the gocryptfs flags -passfile and -extpass.
+// At most one of fd, file, and extpass may be set. If none is set,
+// the password is taken from EMOUNT_PASSWORD, or the user is prompted.
+type passwordSource struct {
+	fd       int    // file descriptor to read password from, or -1
+	file     string // path of file containing password
+	extpass  string // external program that prints the password
+	askpass  string // prompt backend, one of askBackends
+	pinentry string // pinentry program for the pinentry backend
+	keyring  bool   // look up and store passwords in the Secret Service
+
+	msg io.Writer // where warnings are written, os.Stdout if nil
+}
+
+// newPasswordSource returns a source that uses EMOUNT_PASSWORD or prompts.
+// The prompt backend defaults to EMOUNT_ASKPASS and EMOUNT_PINENTRY.
+func newPasswordSource() *passwordSource {
+	askpass := os.Getenv(envAskpassKey)
+	if askpass == "" {
+		askpass = askAuto
+	}
+	return &passwordSource{
+		fd:       -1,
+		askpass:  askpass,
+		pinentry: os.Getenv(envPinentryKey),
+	}
+}
+
+// validate checks that at most one password source is specified
+func (ps *passwordSource) validate() error {
+	n := 0
+	if ps.fd >= 0 {
+		n++
+	}
+	if ps.file != "" {
+		n++
+	}
+	if ps.extpass != "" {
+		n++
+	}
+	if n > 1 {
+		return newUsageErr(
+			"Only one of --passfd, --passfile, or --extpass may be used.")
+	}
+	if ps.askpass != "" && !validAskBackend(ps.askpass) {
+		return newUsageErr(fmt.Sprintf("Invalid --askpass %q. Valid values: %s",
+			ps.askpass, strings.Join(askBackends, ", ")))
+	}
+	return nil
+}
+
+// ask prompts the user for a secret with the configured backend
+func (ps *passwordSource) ask(prompt string) (string, error) {
+	if ps == nil {
+		return askSecret(askAuto, "", prompt)
+	}
+	return askSecret(ps.askpass, ps.pinentry, prompt)
+}
+
+// interactive returns true if the password will be prompted from the user
+func (ps *passwordSource) interactive() bool {
+	if ps != nil && (ps.fd >= 0 || ps.file != "" || ps.extpass != "") {
+		return false
+	}
+	return os.Getenv(envPasswordKey) == ""
+}
+
+// getPassword returns the password for an existing volume.
+// prompt is used if the user is asked to enter the password.
+func (ps *passwordSource) getPassword(prompt string) (string, error) {
+	var password string
+	var err error
+	switch {
+	case ps.interactive():
+		password, err = ps.ask(prompt)
+		if err != nil {
+			err = fmt.Errorf("Input error: %v", err)
+		}
+	case ps == nil:
+		password = os.Getenv(envPasswordKey)
+	case ps.fd >= 0:
+		password, err = readPassFd(ps.fd)
+	case ps.file != "":
+		password, err = readPassFile(ps.file)
+	case ps.extpass != "":
+		password, err = readExtpass(ps.extpass)
+	default:
+		password = os.Getenv(envPasswordKey)
+	}
+	if err != nil {
+		return "", newExitErr(exitPassword, err)
+	}
+	if password == "" {
+		return "", newExitErr(exitPassword, errors.New("Password may not be empty"))
+	}
+	return password, nil
+}
+
+// output returns the writer for warnings
+func (ps *passwordSource) output() io.Writer {
+	if ps == nil || ps.msg == nil {
+		return os.Stdout
+	}
+	return ps.msg
+}
+
+// getVolumePassword returns the password for the volume. If the keyring is
+// enabled and has a password for the volume, it is used instead of
+// the other sources. fromKeyring is true if the password came from the keyring.
+func (ps *passwordSource) getVolumePassword(volume string,
+	prompt string) (password string, fromKeyring bool, err error) {
+	if ps != nil && ps.keyring {
+		password, err = keyringLookup(volume)
+		if err != nil {
+			fmt.Fprintf(ps.output(), "WARNING: %v\n", err)
+		} else if password != "" {
+			return password, true, nil
+		}
+	}
+	password, err = ps.getPassword(prompt)
+	return password, false, err
+}
+
+// remember stores the password for the volume in the keyring, if the keyring
+// is enabled. Failure is only a warning, since the volume can be used without it.
+func (ps *passwordSource) remember(volume string, password string) {
+	if ps == nil || !ps.keyring {
+		return
+	}
+	if err := keyringStore(volume, password); err != nil {
+		fmt.Fprintf(ps.output(), "WARNING: the password was not saved in the "+
+			"keyring: %v\n", err)
+	}
+}
+
+// getNewPassword returns the password for a new volume.
+// If the user is prompted, the password must be confirmed and meet
+// the minimum entropy.
+func (ps *passwordSource) getNewPassword(prompt string, minEntropy float64) (string, error) {
+	if !ps.interactive() {
+		return ps.getPassword(prompt)
+	}
+	password, err := promptNewPassword(ps.ask, prompt, minEntropy)
+	if err != nil {
+		return "", newExitErr(exitPassword, err)
+	}
+	return password, nil
+}
+
+// readPassFd reads the password from the first line of the open
+// file descriptor. The descriptor is read one byte at a time, so anything
+// after the first line is left unread. For example, with "--passfd 0",
+// the rest of stdin is passed to the command.
+// The descriptor is not closed.
+func readPassFd(fd int) (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for len(line) < maxPasswordLen {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("reading password fd %d: %v", fd, err)
+		}
+		if n == 0 || buf[0] == '\n' {
+			break
+		}
+		line = append(line, buf[0])
+	}
+	return strings.TrimRight(string(line), "\r"), nil
+}
+
+// readPassFile reads the password from the first line of the file
+func readPassFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading password file: %v", err)
+	}
+	return firstLine(data), nil
+}
+
+// readExtpass runs the external program and returns the first line
+// of its output. The command line is split on spaces, without shell
+// interpretation, the same as gocryptfs -extpass.
+func readExtpass(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errors.New("extpass command is empty")
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = filterEnv(os.Environ(), nil, nil)
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("extpass program %s failed: %v", args[0], err)
+	}
+	return firstLine(out.Bytes()), nil
+}
+
+// firstLine returns the first line of data, without line terminator
+func firstLine(data []byte) string {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[:i]
+	}
+	return strings.TrimRight(string(data), "\r")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	// gocryptfsConf is the config file in the root of the encrypted folder.
+	// It contains the master key, encrypted with the password.
+	gocryptfsConf = "gocryptfs.conf"
+
+	// confBackupSuffix is appended to gocryptfsConf for the backup made
+	// while the password is changed
+	confBackupSuffix = ".emount-bak"
+)
+
+// changePassword changes the password of the volume at path.
+// The current password is obtained from pass, and the user is prompted for
+// the new password, which must meet minEntropy. gocryptfs.conf is backed up
+// before it's changed, and restored if the change fails.
+func changePassword(path string, pass *passwordSource) error {
+
+	if err := checkConfBackup(path); err != nil {
+		return err
+	}
+	oldPass, _, err := pass.getVolumePassword(path, "Enter current passphrase: ")
+	if err != nil {
+		return err
+	}
+	// the new password is always prompted, so it can be confirmed
+	// and checked against minEntropy
+	newPass, err := promptNewPassword(pass.ask, "Enter new passphrase: ", minEntropy)
+	if err != nil {
+		return newExitErr(exitPassword, err)
+	}
+	if newPass == oldPass {
+		return newExitErr(exitPassword,
+			errors.New("The new password is the same as the current password"))
+	}
+
+	err = withConfBackup(path, func() error {
+		return gocryptfsPasswd(path, oldPass+"\n"+newPass+"\n", nil)
+	})
+	if err != nil {
+		return err
+	}
+	pass.remember(path, newPass)
+	return nil
+}
+
+// checkConfBackup checks that path is an encrypted volume, and that there is
+// no backup of gocryptfs.conf left by a password change that failed
+func checkConfBackup(path string) error {
+	confPath := filepath.Join(path, gocryptfsConf)
+	if _, err := os.Stat(confPath); err != nil {
+		return fmt.Errorf("%s is not an encrypted volume: %v", path, err)
+	}
+	backupPath := confPath + confBackupSuffix
+	if _, err := os.Stat(backupPath); err == nil {
+		return fmt.Errorf("The backup %s from a previous password change "+
+			"still exists. If %s works with the current password, "+
+			"remove the backup. Otherwise, restore it with 'mv %s %s'",
+			backupPath, path, backupPath, confPath)
+	}
+	return nil
+}
+
+// withConfBackup backs up gocryptfs.conf of the volume at path, and calls
+// change. If change fails, the backup is restored. Otherwise the backup is
+// removed, because the old password can decrypt it.
+func withConfBackup(path string, change func() error) error {
+	confPath := filepath.Join(path, gocryptfsConf)
+	backupPath := confPath + confBackupSuffix
+	if err := backupFile(confPath, backupPath); err != nil {
+		return fmt.Errorf("backing up %s: %v", confPath, err)
+	}
+	if err := change(); err != nil {
+		if rerr := restoreFile(backupPath, confPath); rerr != nil {
+			return fmt.Errorf("%v. Restoring %s also failed (%v): the backup "+
+				"is in %s", err, confPath, rerr, backupPath)
+		}
+		return err
+	}
+	if err := os.Remove(backupPath); err != nil {
+		fmt.Printf("WARNING: the password was changed, but the backup %s, "+
+			"which can be opened with the old password, could not be "+
+			"removed: %v\n", backupPath, err)
+	}
+	return nil
+}
+
+// gocryptfsPasswd runs gocryptfs -passwd with the extra options. input is
+// written to its stdin: the old and the new password, or with
+// -masterkey=stdin, the master key and the new password.
+func gocryptfsPasswd(path string, input string, extraArgs []string) error {
+	var out bytes.Buffer
+	args := append(append([]string{"-passwd", "-q"}, extraArgs...), "--", path)
+	cmd := exec.Command("gocryptfs", args...)
+	cmd.Stdin = bytes.NewBufferString(input)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			rc := ee.ProcessState.ExitCode()
+			if rc == 12 {
+				return newExitErr(exitPassword, errors.New("Invalid password"))
+			}
+			return fmt.Errorf("Password change failed: %s (rc=%d)",
+				string(out.Bytes()), rc)
+		}
+		return fmt.Errorf("Password change failed: %v", err)
+	}
+	return nil
+}
+
+// backupFile copies src to dst atomically: dst either does not exist or is
+// a complete copy. The copy is written to a temporary file, synced, and
+// renamed to dst. A temporary file left by a crash is never a complete
+// backup, so it's replaced.
+func backupFile(src string, dst string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	if err = os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// restoreFile atomically replaces dst with the backup
+func restoreFile(backup string, dst string) error {
+	if err := os.Rename(backup, dst); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// syncDir flushes directory entries to disk, so a rename is durable
+func syncDir(path string) error {
+	dh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dh.Close()
+	return dh.Sync()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChangePassword(t *testing.T) {
+
+	// generate random password of about 31-32 hex chars
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+
+	newCrypt, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(newCrypt)
+	}()
+	err = initCryptVol(newCrypt, "", nil)
+	okf(t, err)
+	confPath := filepath.Join(newCrypt, gocryptfsConf)
+	conf, err := ioutil.ReadFile(confPath)
+	okf(t, err)
+
+	// the new password is entered with a fake pinentry
+	pass := newPasswordSource()
+	pass.askpass = askPinentry
+	pass.pinentry = writeScript(t, newCrypt, "pinentry-fake", fakePinentry)
+	defer func() {
+		_ = os.Remove(pass.pinentry)
+	}()
+
+	// wrong current password: conf is unchanged, backup is removed
+	os.Setenv("EMOUNT_PASSWORD", "wrong-password")
+	err = changePassword(newCrypt, pass)
+	assert(t, exitCode(err) == exitPassword, "wrong password", err)
+	after, err := ioutil.ReadFile(confPath)
+	ok(t, err)
+	assert(t, bytes.Equal(conf, after), "conf unchanged", string(after))
+	assert(t, checkFolder(confPath+confBackupSuffix) == invalidPath,
+		"backup removed", confPath+confBackupSuffix)
+
+	os.Setenv("EMOUNT_PASSWORD", password)
+	err = changePassword(newCrypt, pass)
+	okf(t, err)
+	assert(t, checkFolder(confPath+confBackupSuffix) == invalidPath,
+		"backup removed", confPath+confBackupSuffix)
+
+	// the new password works and the old one doesn't
+	mp, err := mountCrypt(newCrypt, "", "fake%pin word")
+	okf(t, err)
+	ok(t, unmountVol(mp))
+	ok(t, os.RemoveAll(mp))
+	_, err = mountCrypt(newCrypt, "", password)
+	assert(t, exitCode(err) == exitPassword, "old password", err)
+
+	// a backup left from an interrupted change is not overwritten
+	ok(t, ioutil.WriteFile(confPath+confBackupSuffix, conf, 0400))
+	err = changePassword(newCrypt, pass)
+	assert(t, err != nil, "existing backup", err)
+}
+
+func TestBackupFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	src := filepath.Join(dir, "file")
+	dst := filepath.Join(dir, "file.bak")
+	okf(t, ioutil.WriteFile(src, []byte("original"), 0400))
+	// the temporary file of an interrupted backup is replaced
+	okf(t, ioutil.WriteFile(dst+".tmp", []byte("orig"), 0400))
+	ok(t, backupFile(src, dst))
+	fs, err := os.Stat(dst)
+	okf(t, err)
+	assert(t, fs.Mode().Perm() == 0400, "backup mode", fs.Mode())
+
+	ok(t, os.Chmod(src, 0600))
+	ok(t, ioutil.WriteFile(src, []byte("changed"), 0600))
+	ok(t, restoreFile(dst, src))
+	data, err := ioutil.ReadFile(src)
+	ok(t, err)
+	assert(t, string(data) == "original", "restored", string(data))
+	assert(t, checkFolder(dst) == invalidPath, "backup renamed", dst)
+}
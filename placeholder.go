@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+)
+
+// Placeholders in the arguments of the command are replaced with the paths
+// of the volumes before the command is started, so a program that takes a
+// folder as an argument doesn't need a shell to read EMOUNT_FOLDER:
+//
+//	{mount}         mount point of the run volume
+//	{mount:NAME}    mount point of the volume NAME (see --volume)
+//	{cipher}        absolute path of the encrypted folder of the run volume
+//	{cipher:NAME}   the same, of the volume NAME
+//
+// A placeholder in double braces is not replaced, and is passed with single
+// braces: {{mount}} becomes {mount}. Other text in braces, such as the {}
+// of find -exec, is passed unchanged. The command itself, the first
+// argument, is not expanded.
+
+// placeholderRe matches a placeholder, in single or double braces
+var placeholderRe = regexp.MustCompile(
+	`\{\{(mount|cipher)(:[A-Za-z0-9_-]+)?\}\}|\{(mount|cipher)(:[A-Za-z0-9_-]+)?\}`)
+
+// expandArgs returns the command with the placeholders in its arguments
+// replaced. vols are the volumes of run, the first is the run volume, and
+// mountPoints are their mount points. A placeholder with a name that isn't
+// one of the volumes is an error.
+func expandArgs(runCmd []string, vols []volume,
+	mountPoints []string) ([]string, error) {
+
+	if len(runCmd) == 0 {
+		return runCmd, nil
+	}
+	var err error
+	args := append([]string{runCmd[0]}, runCmd[1:]...)
+	for i := 1; i < len(args); i++ {
+		args[i] = placeholderRe.ReplaceAllStringFunc(args[i], func(s string) string {
+			m := placeholderRe.FindStringSubmatch(s)
+			if m[1] != "" {
+				// escaped: drop the outer braces
+				return s[1 : len(s)-1]
+			}
+			kind, name := m[3], m[4]
+			n := 0
+			if name != "" {
+				n = findVolume(vols, name[1:])
+				if n < 0 {
+					if err == nil {
+						err = newUsageErr(fmt.Sprintf("unknown volume %s in "+
+							"the argument %q", name[1:], runCmd[i]))
+					}
+					return s
+				}
+			}
+			if kind == "cipher" {
+				if abs, aerr := filepath.Abs(vols[n].Cipher); aerr == nil {
+					return abs
+				}
+				return vols[n].Cipher
+			}
+			return mountPoints[n]
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// findVolume returns the index of the volume with the name, or -1. Names
+// are compared the same way as their variables, so "secrets" matches
+// EMOUNT_FOLDER_SECRETS of ~/secrets.enc.
+func findVolume(vols []volume, name string) int {
+	want := (&volume{Name: name}).envName()
+	for i := range vols {
+		if vols[i].envName() == want {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandArgs(t *testing.T) {
+	vols := []volume{{Cipher: "/v/app.enc"}, {Name: "keys", Cipher: "/v/secrets.enc"}}
+	mounts := []string{"/tmp/m1", "/tmp/m2"}
+	for in, want := range map[string]string{
+		"{mount}/db.sqlite":       "/tmp/m1/db.sqlite",
+		"--data={mount:app}":      "--data=/tmp/m1",
+		"{mount:keys}:{cipher}":   "/tmp/m2:/v/app.enc",
+		"{cipher:KEYS}":           "/v/secrets.enc",
+		"{{mount}} {{cipher:x}}":  "{mount} {cipher:x}",
+		"{} {print} {mount":       "{} {print} {mount",
+		"{{mount}}/{mount}/{{a}}": "{mount}//tmp/m1/{{a}}",
+	} {
+		args, err := expandArgs([]string{"/bin/prog", in}, vols, mounts)
+		okf(t, err)
+		assert(t, len(args) == 2 && args[1] == want, in, args)
+	}
+
+	// the command is not expanded, and the argument list is copied
+	runCmd := []string{"/{mount}/prog", "{mount}"}
+	args, err := expandArgs(runCmd, vols, mounts)
+	ok(t, err)
+	assert(t, strings.Join(args, " ") == "/{mount}/prog /tmp/m1", "command", args)
+	assert(t, runCmd[1] == "{mount}", "copied", runCmd)
+
+	_, err = expandArgs([]string{"/bin/prog", "{mount:other}"}, vols, mounts)
+	assert(t, isUsageErr(err), "unknown volume", err)
+}
@@ -0,0 +1,355 @@
+// +build !darwin
+
+package main
+
+// Private mount namespace for --private. emount starts a copy of itself,
+// the helper, in a new user and mount namespace, where the user is mapped
+// to root. The helper mounts the volume, so the mount exists only in that
+// namespace, and runs the command in a nested user namespace that maps
+// the user back to their own uid. When the command exits, the helper
+// unmounts the volume.
+//
+// The helper is also PID 1 of a new PID namespace, so that every process
+// in the namespace, including gocryptfs, which daemonizes, is killed when
+// the helper exits or dies. Then no process is left in the mount namespace,
+// and the mount goes away with it. Without this, a killed helper would leave
+// gocryptfs running, and the mount reachable through its /proc/PID/root.
+// The helper mounts /proc for the new PID namespace, so the command sees
+// only the processes in it.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// privateHelperArg is the first argument of the helper process
+	privateHelperArg = "--private-helper"
+
+	// privateFolderPattern is the prefix of temp mount points created by
+	// the helper. It's different from tmpFolderPattern, because the mount
+	// point looks unused from outside the namespace, and must not be
+	// removed by emount --cleanup.
+	privateFolderPattern = "emount-private_"
+
+	// helper file descriptors
+	privateSpecFd   = 3 // the privateSpec, as JSON
+	privateStatusFd = 4 // status lines written by the helper
+)
+
+// privateSpec is sent by emount to the helper
+type privateSpec struct {
+	Cipher      string        `json:"cipher"`
+	MountPoint  string        `json:"mountPoint"` // if empty, a temp dir is used
+	RunCmd      []string      `json:"runCmd"`
+	EnvAllow    []string      `json:"envAllow"`
+	EnvDeny     []string      `json:"envDeny"`
+	IdleTimeout time.Duration `json:"idleTimeout"`
+	Password    string        `json:"password"`
+}
+
+// runPrivate runs the command with the volume mounted in a private mount
+// namespace. If user namespaces are not available, it prints a warning and
+// returns false, before the password is read, and the caller should mount
+// the volume as usual.
+func runPrivate(opt *options) (bool, error) {
+	if err := privateSupported(); err != nil {
+		fmt.Printf("WARNING: --private is not available: user namespaces "+
+			"are disabled or not supported (%v). The volume is mounted "+
+			"without a private mount namespace, so other processes of the "+
+			"same user can see the decrypted files while the command runs.\n", err)
+		return false, nil
+	}
+
+	cipher, err := filepath.Abs(opt.run)
+	if err != nil {
+		return true, err
+	}
+	mountPoint := opt.mountPoint
+	if mountPoint != "" {
+		if mountPoint, err = filepath.Abs(mountPoint); err != nil {
+			return true, err
+		}
+	}
+	if mp := sharedMountPoint(cipher); mp != "" {
+		return true, newExitErr(exitMount, fmt.Errorf("%s is already mounted "+
+			"at %s by emount. It can't be mounted again with --private "+
+			"while it's in use", cipher, mp))
+	}
+	encPass, fromKeyring, err := opt.pass.getVolumePassword(cipher,
+		"Enter encryption passphrase: ")
+	if err != nil {
+		return true, err
+	}
+
+	cmd, status, err := privateHelperCmd(&privateSpec{
+		Cipher:      cipher,
+		MountPoint:  mountPoint,
+		RunCmd:      opt.runCmd,
+		EnvAllow:    opt.envAllow,
+		EnvDeny:     opt.envDeny,
+		IdleTimeout: opt.idleTimeout,
+		Password:    encPass,
+	})
+	if err != nil {
+		return true, err
+	}
+	defer status.Close()
+
+	where := mountPoint
+	if where == "" {
+		where = "a private temporary mount point"
+	}
+	fwd := newSignalForwarder(where)
+	defer fwd.stop()
+	err = runForwardedCmd(cmd, fwd, func(int, bool) {
+		closeHelperFiles(cmd)
+	})
+	closeHelperFiles(cmd)
+
+	mounted, msg := readPrivateStatus(status)
+	if mounted && !fromKeyring {
+		opt.pass.remember(cipher, encPass)
+	}
+	if msg != "" {
+		return true, newExitErr(exitCode(err), errors.New(msg))
+	}
+	return true, err
+}
+
+// privateSupported checks that the helper can be started in new user and
+// mount namespaces, by starting it without a spec
+func privateSupported() error {
+	cmd, status, err := privateHelperCmd(nil)
+	if err != nil {
+		return err
+	}
+	defer status.Close()
+	cmd.Stdin = nil
+	err = cmd.Run()
+	closeHelperFiles(cmd)
+	if err != nil {
+		if _, msg := readPrivateStatus(status); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// privateHelperCmd returns the command for the helper process, and the
+// read end of its status pipe. The spec is written to the helper's
+// privateSpecFd; if spec is nil, the helper only checks that it can
+// make its mounts private.
+func privateHelperCmd(spec *privateSpec) (*exec.Cmd, *os.File, error) {
+	var data []byte
+	if spec != nil {
+		var err error
+		if data, err = json.Marshal(spec); err != nil {
+			return nil, nil, err
+		}
+	}
+	specR, specW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	statusR, statusW, err := os.Pipe()
+	if err != nil {
+		_ = specR.Close()
+		_ = specW.Close()
+		return nil, nil, err
+	}
+	go func() {
+		_, _ = specW.Write(data)
+		_ = specW.Close()
+	}()
+
+	cmd := &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       []string{os.Args[0], privateHelperArg},
+		Stdin:      os.Stdin,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		ExtraFiles: []*os.File{specR, statusW},
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS |
+				syscall.CLONE_NEWPID,
+			UidMappings: []syscall.SysProcIDMap{
+				{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+			},
+			GidMappings: []syscall.SysProcIDMap{
+				{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+			},
+			// the helper unmounts and exits if emount dies
+			Pdeathsig: syscall.SIGTERM,
+		},
+	}
+	return cmd, statusR, nil
+}
+
+// closeHelperFiles closes emount's copies of the pipe ends used by the
+// helper, so that reading the status ends when the helper exits
+func closeHelperFiles(cmd *exec.Cmd) {
+	for _, f := range cmd.ExtraFiles {
+		_ = f.Close()
+	}
+}
+
+// readPrivateStatus reads the helper's status lines: "mounted" after the
+// volume is mounted, and "error MESSAGE" if the helper failed
+func readPrivateStatus(status *os.File) (mounted bool, msg string) {
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "mounted":
+			mounted = true
+		case strings.HasPrefix(line, "error "):
+			msg = strings.TrimPrefix(line, "error ")
+		}
+	}
+	return mounted, msg
+}
+
+// runPrivateHelper is the helper process, in the new namespaces.
+// Returns the exit code.
+func runPrivateHelper() int {
+	status := os.NewFile(privateStatusFd, "status")
+	defer status.Close()
+	fail := func(err error) int {
+		fmt.Fprintf(status, "error %s\n",
+			strings.Replace(err.Error(), "\n", " ", -1))
+		return exitCode(err)
+	}
+
+	// mounts made here are not propagated to the parent namespace
+	if err := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE,
+		""); err != nil {
+		return fail(newExitErr(exitMount,
+			fmt.Errorf("making mounts private: %v", err)))
+	}
+	// /proc of the new PID namespace, where the pids of the helper's
+	// children are valid
+	if err := syscall.Mount("proc", "/proc", "proc",
+		syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fail(newExitErr(exitMount,
+			fmt.Errorf("mounting /proc: %v", err)))
+	}
+	specFile := os.NewFile(privateSpecFd, "spec")
+	data, err := ioutil.ReadAll(specFile)
+	_ = specFile.Close()
+	if err != nil {
+		return fail(err)
+	}
+	if len(data) == 0 {
+		return exitOK
+	}
+	var spec privateSpec
+	if err = json.Unmarshal(data, &spec); err != nil {
+		return fail(err)
+	}
+
+	// the command runs as the user, in a nested user namespace
+	uid, err := outerID("/proc/self/uid_map")
+	if err != nil {
+		return fail(err)
+	}
+	gid, err := outerID("/proc/self/gid_map")
+	if err != nil {
+		return fail(err)
+	}
+
+	mountPoint := spec.MountPoint
+	tempMount := mountPoint == ""
+	if tempMount {
+		if mountPoint, err = ioutil.TempDir("", privateFolderPattern); err != nil {
+			return fail(newExitErr(exitMount,
+				fmt.Errorf("Failed to create mount point: %v", err)))
+		}
+	}
+	if _, err = mountCrypt(spec.Cipher, mountPoint, spec.Password); err != nil {
+		if tempMount {
+			_ = os.Remove(mountPoint)
+		}
+		return fail(fmt.Errorf("Failed to mount: %w", err))
+	}
+	fmt.Fprintln(status, "mounted")
+
+	fwd := newSignalForwarder(mountPoint)
+	defer fwd.stop()
+	if spec.IdleTimeout > 0 {
+		idle, err := watchIdle([]string{mountPoint}, spec.IdleTimeout, func() {
+			fwd.stopCommand(fmt.Sprintf("no activity on the volume for %v",
+				spec.IdleTimeout))
+		})
+		if err != nil {
+			_ = unmountVol(mountPoint)
+			return fail(err)
+		}
+		defer idle.stop()
+	}
+
+	env := append(filterEnv(os.Environ(), spec.EnvAllow, spec.EnvDeny),
+		fmt.Sprintf("%s=%s", envFolderKey, mountPoint))
+	runCmd, err := expandArgs(spec.RunCmd, []volume{{Cipher: spec.Cipher}},
+		[]string{mountPoint})
+	if err != nil {
+		_ = unmountVol(mountPoint)
+		return fail(err)
+	}
+	cmd := &exec.Cmd{
+		Path:   runCmd[0],
+		Args:   runCmd,
+		Env:    env,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		SysProcAttr: &syscall.SysProcAttr{
+			Cloneflags: syscall.CLONE_NEWUSER,
+			UidMappings: []syscall.SysProcIDMap{
+				{ContainerID: uid, HostID: 0, Size: 1},
+			},
+			GidMappings: []syscall.SysProcIDMap{
+				{ContainerID: gid, HostID: 0, Size: 1},
+			},
+			// the command can't outlive the mount
+			Pdeathsig: syscall.SIGKILL,
+		},
+	}
+	cmdErr := runForwardedCmd(cmd, fwd, nil)
+
+	if err = unmountVol(mountPoint); err != nil && cmdErr == nil {
+		cmdErr = newExitErr(exitUnmount, fmt.Errorf("Unmount failed: %v", err))
+	}
+	if tempMount {
+		_ = os.Remove(mountPoint)
+	}
+	if cmdErr != nil {
+		return fail(cmdErr)
+	}
+	return exitOK
+}
+
+// outerID returns the id in the parent namespace that is mapped to 0,
+// from /proc/self/uid_map or gid_map
+func outerID(mapPath string) (int, error) {
+	data, err := ioutil.ReadFile(mapPath)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 || fields[0] != "0" {
+		return 0, fmt.Errorf("unexpected %s: %q", mapPath, string(data))
+	}
+	return strconv.Atoi(fields[1])
+}
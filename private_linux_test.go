@@ -0,0 +1,153 @@
+// +build !darwin
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPrivateMount(t *testing.T) {
+
+	if err := privateSupported(); err != nil {
+		t.Skipf("user namespaces not available: %v", err)
+	}
+	defer setTestRuntimeDir(t)()
+
+	// generate random password of about 31-32 hex chars
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	newCrypt, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(newCrypt)
+	}()
+	okf(t, initCryptVol(newCrypt, "", nil))
+	mountPoint := filepath.Join(newCrypt, "mnt")
+	okf(t, os.Mkdir(mountPoint, dirMode))
+	outFile := filepath.Join(newCrypt, "out")
+
+	// the command writes a file to the volume, and reports its uid
+	done := make(chan error)
+	go func() {
+		done <- decryptAndRun(&options{
+			run:        newCrypt,
+			mountPoint: mountPoint,
+			private:    true,
+			runCmd: []string{"/bin/sh", "-c", `echo hello > "$EMOUNT_FOLDER/new.txt" &&
+				id -u > ` + outFile + ` && sleep 1`},
+		})
+	}()
+
+	// while the command runs, the mount is not visible here
+	time.Sleep(500 * time.Millisecond)
+	assert(t, !isMountPoint(mountPoint), "not mounted outside", mountPoint)
+	assert(t, checkEmptyDir(mountPoint) == nil, "mount point empty outside",
+		mountPoint)
+	ok(t, <-done)
+
+	uid, err := ioutil.ReadFile(outFile)
+	okf(t, err)
+	assert(t, string(uid) == fmt.Sprintf("%d\n", os.Getuid()), "command uid",
+		string(uid))
+
+	// the file is in the volume
+	vol, err := acquireMount(newCrypt, "", nil)
+	okf(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(vol.mountPoint, "new.txt"))
+	ok(t, err)
+	assert(t, string(data) == "hello\n", "file written in private mount",
+		string(data))
+	_, err = vol.release()
+	ok(t, err)
+
+	// a wrong password is reported by the helper
+	os.Setenv("EMOUNT_PASSWORD", "wrong-password")
+	err = decryptAndRun(&options{
+		run:     newCrypt,
+		private: true,
+		runCmd:  []string{"/bin/true"},
+	})
+	assert(t, exitCode(err) == exitPassword, "wrong password", err)
+}
+
+// findProcess returns the pid of a process whose command line contains s,
+// or 0
+func findProcess(s string) int {
+	dirs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range dirs {
+		cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+		if err == nil && strings.Contains(string(cmdline), s) {
+			pid, _ := strconv.Atoi(filepath.Base(dir))
+			return pid
+		}
+	}
+	return 0
+}
+
+// TestPrivateHelperKilled checks that the processes left in the namespace,
+// such as gocryptfs after it daemonizes, die with the helper
+func TestPrivateHelperKilled(t *testing.T) {
+
+	if err := privateSupported(); err != nil {
+		t.Skipf("user namespaces not available: %v", err)
+	}
+	defer setTestRuntimeDir(t)()
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	newCrypt, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(newCrypt)
+	}()
+	okf(t, initCryptVol(newCrypt, "", nil))
+
+	// the daemon stands in for gocryptfs: it's orphaned, and reparented to
+	// the helper
+	daemonArg := fmt.Sprintf("300.%d", rand.Int31())
+	daemonCmd := "sleep\x00" + daemonArg + "\x00"
+	done := make(chan error)
+	go func() {
+		done <- decryptAndRun(&options{
+			run:     newCrypt,
+			private: true,
+			runCmd: []string{"/bin/sh", "-c", "(setsid sleep " + daemonArg +
+				" &); sleep 30"},
+		})
+	}()
+	var daemon, helper int
+	for i := 0; i < 50 && (daemon == 0 || helper == 0); i++ {
+		time.Sleep(100 * time.Millisecond)
+		daemon = findProcess(daemonCmd)
+		helper = findProcess(privateHelperArg)
+	}
+	assertf(t, daemon != 0 && helper != 0, "processes started", daemon, helper)
+
+	okf(t, syscall.Kill(helper, syscall.SIGKILL))
+	select {
+	case err = <-done:
+		assert(t, err != nil, "helper killed", err)
+	case <-time.After(10 * time.Second):
+		_ = syscall.Kill(daemon, syscall.SIGKILL)
+		t.Fatalf("emount didn't exit after the helper was killed")
+	}
+	for i := 0; i < 50 && findProcess(daemonCmd) != 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if findProcess(daemonCmd) != 0 {
+		_ = syscall.Kill(daemon, syscall.SIGKILL)
+		t.Errorf("the daemon survived the helper")
+	}
+}
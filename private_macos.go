@@ -0,0 +1,24 @@
+// +build darwin
+
+package main
+
+// this file applies to macos only
+
+import "fmt"
+
+// privateHelperArg is the first argument of the helper process, which
+// is only used on linux
+const privateHelperArg = "--private-helper"
+
+// runPrivate returns false, because macos has no user namespaces.
+// The caller mounts the volume as usual.
+func runPrivate(opt *options) (bool, error) {
+	fmt.Printf("WARNING: --private is only supported on linux. The volume " +
+		"is mounted without a private mount namespace, so other processes " +
+		"of the same user can see the decrypted files while the command runs.\n")
+	return false, nil
+}
+
+func runPrivateHelper() int {
+	return exitError
+}
@@ -0,0 +1,101 @@
+// +build !darwin
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// openPty opens a new pseudo-terminal, and returns its master and slave
+func openPty(t *testing.T) (*os.File, *os.File) {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %v", err)
+	}
+	var unlock int32
+	var n uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(),
+		uintptr(syscall.TIOCSPTLCK), uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		t.Skipf("no pseudo-terminals: %v", errno)
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(),
+		uintptr(syscall.TIOCGPTN), uintptr(unsafe.Pointer(&n))); errno != 0 {
+		t.Skipf("no pseudo-terminals: %v", errno)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n),
+		os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		_ = master.Close()
+		t.Skipf("no pseudo-terminals: %v", err)
+	}
+	return master, slave
+}
+
+// ptyOutput collects what is written to the terminal
+type ptyOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (o *ptyOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.Write(p)
+}
+
+func (o *ptyOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.String()
+}
+
+// waitFor waits until the output contains s
+func (o *ptyOutput) waitFor(s string) bool {
+	for i := 0; i < 100; i++ {
+		if strings.Contains(o.String(), s) {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+// startOnPty starts the command in a new session, with the slave of a new
+// pseudo-terminal as its controlling terminal, stdin, stdout and stderr.
+// Returns the master, and the output written to the terminal.
+func startOnPty(t *testing.T, cmd *exec.Cmd) (*os.File, *ptyOutput) {
+	t.Helper()
+	master, slave := openPty(t)
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	err := cmd.Start()
+	_ = slave.Close()
+	if err != nil {
+		_ = master.Close()
+		t.Fatalf("starting %v: %v", cmd.Args, err)
+	}
+	out := &ptyOutput{}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := master.Read(buf)
+			_, _ = out.Write(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return master, out
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// recoverVolume implements emount recover. It sets a new password for the
+// volume at path, using the master key instead of the current password.
+// The key is read from keyFile, a paper backup, or typed by the user.
+func recoverVolume(path string, keyFile string, pass *passwordSource) error {
+
+	if err := checkConfBackup(path); err != nil {
+		return err
+	}
+	if _, err := readVolumeInfo(path); err != nil {
+		return fmt.Errorf("%v. A new password can't be set without %s. "+
+			"Restore it from a backup if you have one. Otherwise, mount the "+
+			"volume with 'gocryptfs -ro -masterkey=stdin' and the options it "+
+			"was created with, and copy the data to a new volume", err, gocryptfsConf)
+	}
+	key, err := getMasterKey(keyFile)
+	if err != nil {
+		return newExitErr(exitPassword, err)
+	}
+	if err = verifyMasterKey(path, key); err != nil {
+		return err
+	}
+	newPass, err := pass.getNewPassword("Enter new passphrase: ", minEntropy)
+	if err != nil {
+		return err
+	}
+
+	err = withConfBackup(path, func() error {
+		return gocryptfsPasswd(path, formatMasterKey(key)+"\n"+newPass+"\n",
+			[]string{"-masterkey=stdin"})
+	})
+	if err != nil {
+		return err
+	}
+	pass.remember(path, newPass)
+	fmt.Printf("The password of %s was changed\n", path)
+	return nil
+}
+
+// getMasterKey reads the master key from the backup file, or if keyFile is
+// empty, asks the user to type it and to confirm its check
+func getMasterKey(keyFile string) (string, error) {
+	if keyFile != "" {
+		return readKeyBackup(keyFile)
+	}
+	typed, err := terminalGetSecret("Enter the master key (dashes are optional): ")
+	if err != nil {
+		return "", err
+	}
+	key, err := normalizeMasterKey(typed)
+	if err != nil {
+		return "", err
+	}
+	tty, err := os.OpenFile(ttyPath, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+	yes, err := askYesNo(tty, fmt.Sprintf("The key check is %s. Does it match "+
+		"the key check of the backup?", masterKeyCheck(key)))
+	if err != nil {
+		return "", err
+	}
+	if !yes {
+		return "", errors.New("The master key was not entered correctly")
+	}
+	return key, nil
+}
+
+// verifyMasterKey mounts the volume read-only with the master key, and checks
+// that its files can be decrypted. gocryptfs doesn't check the key when it
+// mounts with -masterkey, and a new password set with the wrong key would
+// make the volume unreadable.
+func verifyMasterKey(cipher string, key string) error {
+	mountPoint, err := mountCryptWith(cipher, "", formatMasterKey(key),
+		[]string{"-ro", "-masterkey=stdin"})
+	if err != nil {
+		if exitCode(err) == exitPassword {
+			return newExitErr(exitPassword, fmt.Errorf(
+				"The master key is not the key of %s", cipher))
+		}
+		return err
+	}
+	err = checkDecrypted(cipher, mountPoint)
+	if uerr := unmountVol(mountPoint); uerr != nil {
+		printUnmountWarning(mountPoint)
+	} else {
+		_ = os.Remove(mountPoint)
+	}
+	if err != nil {
+		return newExitErr(exitPassword, fmt.Errorf("The master key is not the "+
+			"key of %s: %v", cipher, err))
+	}
+	return nil
+}
+
+// checkDecrypted checks that the names in the root of the mounted volume,
+// and the content of the first file, can be decrypted. gocryptfs leaves out
+// names it can't decrypt, so with the wrong key the root looks empty.
+func checkDecrypted(cipher string, mountPoint string) error {
+	cipherEntries, err := ioutil.ReadDir(cipher)
+	if err != nil {
+		return err
+	}
+	encrypted := 0
+	for _, fi := range cipherEntries {
+		name := fi.Name()
+		if !strings.HasPrefix(name, "gocryptfs.") && !strings.HasPrefix(name, ".") {
+			encrypted++
+		}
+	}
+	entries, err := ioutil.ReadDir(mountPoint)
+	if err != nil {
+		return err
+	}
+	if encrypted > 0 && len(entries) == 0 {
+		return errors.New("no file names could be decrypted")
+	}
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || fi.Size() == 0 {
+			continue
+		}
+		f, err := os.Open(filepath.Join(mountPoint, fi.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = f.Read(make([]byte, 4096))
+		_ = f.Close()
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("reading %s: %v", fi.Name(), err)
+		}
+		break
+	}
+	return nil
+}
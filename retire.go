@@ -0,0 +1,442 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// After a verified init --from, the plaintext source can be retired with
+// --retire-source: its files are overwritten and removed (shred), or moved
+// to a quarantine folder, which emount reminds the user to delete when it's
+// due. The empty source folder is left to be used as the mount point.
+
+const (
+	retireShred      = "shred"
+	retireQuarantine = "quarantine"
+
+	defaultQuarantineDays = 14
+
+	envStateHome       = "XDG_STATE_HOME"
+	quarantineFileName = "quarantine.json"
+
+	// shredBufSize is the size of the writes that overwrite a file
+	shredBufSize = 64 * 1024
+)
+
+// retireOptions selects what init does with the source after a verified copy
+type retireOptions struct {
+	mode       string // "", retireShred, or retireQuarantine
+	quarantine string // quarantine folder
+	days       int    // days until the quarantine is due for deletion
+}
+
+// validate checks the options. src is the source folder and cipher the
+// new volume, neither of which may be inside the other folders. The whole
+// source folder is retired, so it can't be used with exclude patterns.
+func (r *retireOptions) validate(src string, cipher string, exclude []string) error {
+	switch r.mode {
+	case "":
+		if r.quarantine != "" {
+			return newUsageErr("--quarantine is only used with --retire-source quarantine")
+		}
+		return nil
+	case retireShred, retireQuarantine:
+	default:
+		return newUsageErr(fmt.Sprintf("invalid --retire-source %q: use %s or %s",
+			r.mode, retireShred, retireQuarantine))
+	}
+	if src == "" {
+		return newUsageErr("--retire-source is only used with --from")
+	}
+	if len(exclude) > 0 {
+		return newUsageErr("--retire-source can't be used with --exclude: the " +
+			"excluded items would be removed with the source folder")
+	}
+	if isWithin(cipher, src) {
+		return fmt.Errorf("the volume %s is inside the source folder, which can't "+
+			"be retired", cipher)
+	}
+	if r.mode == retireShred {
+		if r.quarantine != "" {
+			return newUsageErr("--quarantine is only used with --retire-source quarantine")
+		}
+		return nil
+	}
+	if r.quarantine == "" {
+		return newUsageErr("--retire-source quarantine needs --quarantine FOLDER")
+	}
+	if r.days < 1 {
+		return newUsageErr("--quarantine-days must be at least 1")
+	}
+	if isWithin(r.quarantine, src) || isWithin(src, r.quarantine) {
+		return newUsageErr("the quarantine folder and the source folder must not " +
+			"be inside each other")
+	}
+	switch checkFolder(r.quarantine) {
+	case isNotDir:
+		return fmt.Errorf("quarantine %s is not a directory", r.quarantine)
+	case isDir:
+		if err := checkEmptyDir(r.quarantine); err != nil {
+			return fmt.Errorf("quarantine folder: %v", err)
+		}
+	}
+	return nil
+}
+
+// isWithin returns true if path is dir or inside it
+func isWithin(path string, dir string) bool {
+	rel, err := filepath.Rel(resolvePath(dir), resolvePath(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// retireSource retires the source folder of a verified copy into the volume
+// at cipher. The source folder is left empty, with mode dirMode.
+func retireSource(src string, cipher string, r *retireOptions) error {
+	var err error
+	if src, err = filepath.Abs(src); err != nil {
+		return err
+	}
+	switch r.mode {
+	case retireShred:
+		fmt.Printf("WARNING: overwriting files doesn't reliably erase them on SSDs " +
+			"and flash storage, on copy-on-write file systems such as btrfs and ZFS, " +
+			"or from snapshots and backups. Copies of the plaintext may remain " +
+			"on the disk.\n")
+		n, linked, err := shredContents(src)
+		if err != nil {
+			return fmt.Errorf("overwriting the files of %s: %v", src, err)
+		}
+		fmt.Printf("Overwrote and removed %d files from %s\n", n, src)
+		if len(linked) > 0 {
+			fmt.Printf("WARNING: %d files also had hard links outside %s, and "+
+				"were removed without overwriting them:\n", len(linked), src)
+			for i, path := range linked {
+				if i == maxReportItems {
+					fmt.Printf("  ... and %d more\n", len(linked)-maxReportItems)
+					break
+				}
+				fmt.Printf("  %s\n", path)
+			}
+		}
+	case retireQuarantine:
+		q, err := quarantineSource(src, cipher, r.quarantine, r.days)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Moved the files of %s to %s. They are due for deletion on %s. "+
+			"emount will remind you then, and 'emount cleanup' will delete them.\n",
+			src, q.Folder, q.Due.Format("Mon Jan 2 2006"))
+	}
+	if err = os.Chmod(src, dirMode); err != nil {
+		return err
+	}
+	fmt.Printf("%s is empty, and can be the mount point of the volume: "+
+		"emount run %s --mount %s COMMAND\n", src, cipher, src)
+	return nil
+}
+
+// shredContents overwrites the regular files in dir with random data, and
+// removes everything in dir. A file with several hard links is overwritten
+// once if all its links are in dir. If it's also linked from outside dir,
+// its links in dir are removed without overwriting it, since the data is
+// still used by the other links. It returns the number of files
+// overwritten, and the paths of the files that were not.
+func shredContents(dir string) (int, []string, error) {
+	var files, dirs []string
+	links := make(map[fileID][]string) // paths of files with several links
+	nlinks := make(map[fileID]uint64)
+	var ids []fileID
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir():
+			// make it writable, and readable to walk it
+			if err := os.Chmod(path, 0700); err != nil {
+				return err
+			}
+			if path != dir {
+				dirs = append(dirs, path)
+			}
+		case fi.Mode().IsRegular():
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+				id := fileID{uint64(st.Dev), uint64(st.Ino)}
+				if _, ok := links[id]; !ok {
+					ids = append(ids, id)
+					nlinks[id] = uint64(st.Nlink)
+				}
+				links[id] = append(links[id], path)
+				return nil
+			}
+			files = append(files, path)
+		default:
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	var linked []string
+	for _, id := range ids {
+		paths := links[id]
+		if uint64(len(paths)) < nlinks[id] {
+			// also linked from outside dir
+			for _, path := range paths {
+				if err := os.Remove(path); err != nil {
+					return 0, linked, err
+				}
+				linked = append(linked, path)
+			}
+			continue
+		}
+		// all the links are in dir: overwrite the data through one of them
+		for _, path := range paths[1:] {
+			if err := os.Remove(path); err != nil {
+				return 0, linked, err
+			}
+		}
+		files = append(files, paths[0])
+	}
+	for _, path := range files {
+		if err := shredFile(path); err != nil {
+			return 0, linked, err
+		}
+	}
+	// remove the deepest folders first
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, path := range dirs {
+		if err := os.Remove(path); err != nil {
+			return 0, linked, err
+		}
+	}
+	return len(files), linked, nil
+}
+
+// shredFile overwrites the file with random data, syncs it, and removes it
+func shredFile(path string) error {
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		buf := make([]byte, shredBufSize)
+		for left := fi.Size(); left > 0 && err == nil; {
+			n := int64(len(buf))
+			if left < n {
+				n = left
+			}
+			if _, err = rand.Read(buf[:n]); err == nil {
+				_, err = f.Write(buf[:n])
+			}
+			left -= n
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// quarantine is a source folder moved by init --retire-source quarantine
+type quarantine struct {
+	Folder  string    `json:"folder"`  // the quarantine folder
+	Source  string    `json:"source"`  // the folder the files were moved from
+	Volume  string    `json:"volume"`  // the volume they were copied to
+	Created time.Time `json:"created"` // when the files were moved
+	Due     time.Time `json:"due"`     // when they should be deleted
+}
+
+// quarantineSource moves the contents of src to the quarantine folder, which
+// must be on the same file system, and records it with its due date
+func quarantineSource(src string, cipher string, folder string, days int) (*quarantine, error) {
+	folder, err := filepath.Abs(folder)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err = filepath.Abs(cipher)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(folder, 0700); err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(folder, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range entries {
+		err = os.Rename(filepath.Join(src, fi.Name()), filepath.Join(folder, fi.Name()))
+		if le, ok := err.(*os.LinkError); ok && le.Err == syscall.EXDEV {
+			return nil, fmt.Errorf("the quarantine folder %s must be on the same "+
+				"file system as %s", folder, src)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	q := &quarantine{
+		Folder:  folder,
+		Source:  src,
+		Volume:  cipher,
+		Created: now,
+		Due:     now.AddDate(0, 0, days),
+	}
+	list, err := readQuarantines()
+	if err != nil {
+		return nil, err
+	}
+	if err = writeQuarantines(append(list, *q)); err != nil {
+		return nil, fmt.Errorf("recording the quarantine folder %s: %v", folder, err)
+	}
+	return q, nil
+}
+
+// quarantinePath returns the file where quarantine folders are recorded:
+// $XDG_STATE_HOME/emount/quarantine.json, by default in ~/.local/state.
+// It's not in the runtime dir, which is removed when the user logs out.
+func quarantinePath() (string, error) {
+	dir := os.Getenv(envStateHome)
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, configDirName, quarantineFileName), nil
+}
+
+// readQuarantines returns the recorded quarantine folders
+func readQuarantines() ([]quarantine, error) {
+	path, err := quarantinePath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []quarantine
+	if err = json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return list, nil
+}
+
+// writeQuarantines replaces the recorded quarantine folders
+func writeQuarantines(list []quarantine) error {
+	path, err := quarantinePath()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// dueQuarantines returns the quarantine folders that are due for deletion.
+// Folders that no longer exist are forgotten.
+func dueQuarantines() ([]quarantine, error) {
+	list, err := readQuarantines()
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	var keep, due []quarantine
+	for _, q := range list {
+		if _, err := os.Lstat(q.Folder); os.IsNotExist(err) {
+			continue
+		}
+		keep = append(keep, q)
+		if time.Now().After(q.Due) {
+			due = append(due, q)
+		}
+	}
+	if len(keep) != len(list) {
+		if err = writeQuarantines(keep); err != nil {
+			return nil, err
+		}
+	}
+	return due, nil
+}
+
+// remindQuarantines prints a reminder for the quarantine folders that are
+// due for deletion
+func remindQuarantines() {
+	due, err := dueQuarantines()
+	if err != nil {
+		fmt.Printf("WARNING: %v\n", err)
+		return
+	}
+	for _, q := range due {
+		fmt.Printf("REMINDER: %s has the plaintext files of %s, which were "+
+			"copied to %s. They were due for deletion on %s. Run 'emount cleanup' "+
+			"to delete them.\n", q.Folder, q.Source, q.Volume,
+			q.Due.Format("Mon Jan 2 2006"))
+	}
+}
+
+// cleanupQuarantines deletes the quarantine folders that are due, after
+// asking the user with ask. If ask is nil, they are only reported.
+func cleanupQuarantines(res *cleanupResult, ask func(question string) bool) error {
+	due, err := dueQuarantines()
+	if err != nil {
+		return err
+	}
+	for _, q := range due {
+		if ask == nil || !ask(fmt.Sprintf("Delete %s, the plaintext files of %s "+
+			"that were quarantined on %s?", q.Folder, q.Source,
+			q.Created.Format("Mon Jan 2 2006"))) {
+			res.add("%s is due for deletion since %s", q.Folder,
+				q.Due.Format("Mon Jan 2 2006"))
+			continue
+		}
+		if _, _, err := shredContents(q.Folder); err != nil {
+			res.fail("Deleting %s failed: %v", q.Folder, err)
+			continue
+		}
+		if err := os.Remove(q.Folder); err != nil {
+			res.fail("Deleting %s failed: %v", q.Folder, err)
+			continue
+		}
+		res.add("Overwrote and deleted %s", q.Folder)
+	}
+	// forget the deleted folders
+	_, err = dueQuarantines()
+	return err
+}
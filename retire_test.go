@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetireSource(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	sav, had := os.LookupEnv(envStateHome)
+	ok(t, os.Setenv(envStateHome, filepath.Join(dir, "state")))
+	defer func() {
+		if had {
+			_ = os.Setenv(envStateHome, sav)
+		} else {
+			_ = os.Unsetenv(envStateHome)
+		}
+	}()
+
+	src, err := createTestData()
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(src)
+	}()
+	okf(t, os.Symlink("abc.txt", filepath.Join(src, "link")))
+	okf(t, os.Link(filepath.Join(src, "abc.txt"), filepath.Join(dir, "hardlink")))
+	orig, err := ioutil.ReadFile(filepath.Join(dir, "hardlink"))
+	okf(t, err)
+	// a file whose links are all in the source; f reads it after the shred
+	inner := filepath.Join(src, "inner.txt")
+	okf(t, ioutil.WriteFile(inner, []byte("plaintext"), 0600))
+	okf(t, os.Link(inner, filepath.Join(src, "sub", "inner2.txt")))
+	f, err := os.Open(inner)
+	okf(t, err)
+	defer f.Close()
+
+	// the volume and the quarantine can't be inside the source
+	r := &retireOptions{mode: retireShred}
+	assert(t, r.validate(src, filepath.Join(src, "vol"), nil) != nil, "volume in source", r)
+	r = &retireOptions{mode: retireQuarantine, quarantine: filepath.Join(src, "q"), days: 1}
+	assert(t, isUsageErr(r.validate(src, filepath.Join(dir, "vol"), nil)), "quarantine in source", r)
+	r = &retireOptions{mode: "delete"}
+	assert(t, isUsageErr(r.validate(src, filepath.Join(dir, "vol"), nil)), "mode", r)
+	r = &retireOptions{mode: retireShred}
+	assert(t, isUsageErr(r.validate(src, filepath.Join(dir, "vol"), []string{"*.txt"})),
+		"exclude", r)
+
+	// excluded items are not shredded
+	excluded := filepath.Join(dir, "excluded")
+	opt := &initOptions{from: src, copy: copyOptions{exclude: []string{"link"},
+		retire: retireOptions{mode: retireShred}}}
+	err = initCryptVolWith(excluded, opt)
+	assert(t, err != nil && strings.Contains(err.Error(), "not retired"), "excluded", err)
+	_, err = os.Lstat(filepath.Join(src, "link"))
+	ok(t, err)
+
+	// nor are skipped items
+	l, err := net.Listen("unix", filepath.Join(src, "sock"))
+	okf(t, err)
+	skipped := filepath.Join(dir, "skipped")
+	opt = &initOptions{from: src,
+		copy: copyOptions{retire: retireOptions{mode: retireShred}}}
+	err = initCryptVolWith(skipped, opt)
+	assert(t, err != nil && strings.Contains(err.Error(), "not retired"), "skipped", err)
+	_, err = os.Lstat(filepath.Join(src, "sock"))
+	ok(t, err)
+	ok(t, l.Close())
+	_ = os.Remove(filepath.Join(src, "sock"))
+
+	// shred
+	cipher := filepath.Join(dir, "vol")
+	opt = &initOptions{from: src,
+		copy: copyOptions{retire: retireOptions{mode: retireShred}}}
+	okf(t, initCryptVolWith(cipher, opt))
+	ok(t, checkEmptyDir(src))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "hardlink"))
+	ok(t, err)
+	assert(t, bytes.Equal(data, orig), "other hard link is not overwritten", data)
+	data, err = ioutil.ReadAll(f)
+	ok(t, err)
+	assert(t, len(data) == len("plaintext") && string(data) != "plaintext",
+		"hard links in the source are overwritten", string(data))
+
+	// only the files also linked from outside are reported
+	okf(t, os.Mkdir(filepath.Join(src, "sub"), 0700))
+	okf(t, ioutil.WriteFile(inner, []byte("plaintext"), 0600))
+	okf(t, os.Link(inner, filepath.Join(src, "sub", "inner2.txt")))
+	outer := filepath.Join(src, "outer.txt")
+	okf(t, ioutil.WriteFile(outer, []byte("plaintext"), 0600))
+	okf(t, os.Link(outer, filepath.Join(dir, "outer.txt")))
+	n, linked, err := shredContents(src)
+	ok(t, err)
+	assert(t, n == 1 && len(linked) == 1 && linked[0] == outer, "shredded",
+		fmt.Sprint(n, linked))
+	ok(t, checkEmptyDir(src))
+
+	// quarantine
+	src2, err := createTestData()
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(src2)
+	}()
+	folder := filepath.Join(dir, "quarantine")
+	q, err := quarantineSource(src2, cipher, folder, 3)
+	okf(t, err)
+	ok(t, checkEmptyDir(src2))
+	tf := getTestFileInfo()[0]
+	_, err = os.Stat(folder + tf.name)
+	ok(t, err)
+	assert(t, q.Due.Sub(q.Created) > 2*24*time.Hour, "due", q.Due)
+
+	due, err := dueQuarantines()
+	ok(t, err)
+	assert(t, len(due) == 0, "not due yet", due)
+
+	list, err := readQuarantines()
+	okf(t, err)
+	list[0].Due = time.Now().Add(-time.Minute)
+	okf(t, writeQuarantines(list))
+	due, err = dueQuarantines()
+	ok(t, err)
+	assert(t, len(due) == 1 && due[0].Folder == folder, "due", due)
+
+	// without a terminal, cleanup only reports it
+	res := &cleanupResult{}
+	ok(t, cleanupQuarantines(res, nil))
+	assert(t, res.found == 1 && res.failed == 0, "reported", res.report)
+	_, err = os.Stat(folder)
+	ok(t, err)
+
+	res = &cleanupResult{}
+	ok(t, cleanupQuarantines(res, func(string) bool { return true }))
+	assert(t, res.found == 1 && res.failed == 0, "deleted", res.report)
+	_, err = os.Stat(folder)
+	assert(t, os.IsNotExist(err), "quarantine deleted", err)
+	list, err = readQuarantines()
+	ok(t, err)
+	assert(t, len(list) == 0, "forgotten", list)
+}
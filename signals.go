@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// stopGracePeriod is the time the command has to exit after SIGTERM,
+// when emount stops it, before it's killed
+const stopGracePeriod = 10 * time.Second
+
+// forwardedSignals are the signals emount catches while a volume is mounted.
+// While the command is running they are forwarded to its process group.
+var forwardedSignals = []os.Signal{
+	syscall.SIGINT,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+	syscall.SIGWINCH,
+}
+
+// ttySignals are sent by the terminal to its foreground process group
+var ttySignals = map[os.Signal]bool{
+	syscall.SIGINT:   true,
+	syscall.SIGQUIT:  true,
+	syscall.SIGWINCH: true,
+}
+
+// signalForwarder catches signals for emount while a volume is mounted,
+// so that emount is not terminated before it can unmount the volume.
+// While the command runs, signals are forwarded to it. A second SIGINT
+// kills the command.
+//
+// The command runs in its own process group, which gets the forwarded
+// signals, unless emount is in the foreground of a terminal. Then the
+// command stays in emount's process group, so that the signals from the
+// terminal, such as Ctrl-C, reach both the command and emount. They are not
+// forwarded, since the command already got them, and other signals are
+// forwarded to the command's process.
+type signalForwarder struct {
+	mountPoint string
+	ch         chan os.Signal
+	done       chan struct{}
+
+	mu         sync.Mutex
+	pid        int       // the command, or 0 if not running
+	ownGroup   bool      // the command leads its own process group
+	interrupts int       // number of SIGINT received
+	caught     os.Signal // first terminating signal received, or nil
+	stopReason string    // stopCommand before the command started, or ""
+}
+
+func newSignalForwarder(mountPoint string) *signalForwarder {
+	f := &signalForwarder{
+		mountPoint: mountPoint,
+		ch:         make(chan os.Signal, 8),
+		done:       make(chan struct{}),
+	}
+	signal.Notify(f.ch, forwardedSignals...)
+	go f.loop()
+	return f
+}
+
+// setCommand sets the command that receives forwarded signals, and whether
+// it leads its own process group. Use 0 after the command has exited.
+// If stopCommand was called before, the command is stopped now.
+func (f *signalForwarder) setCommand(pid int, ownGroup bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pid = pid
+	f.ownGroup = ownGroup
+	if pid != 0 && f.stopReason != "" {
+		f.stopLocked(f.stopReason)
+		f.stopReason = ""
+	}
+}
+
+// target describes the processes that get the signals, for messages
+func (f *signalForwarder) target() string {
+	if f.ownGroup {
+		return fmt.Sprintf("process group %d", f.pid)
+	}
+	return fmt.Sprintf("pid %d", f.pid)
+}
+
+// kill sends the signal to the command, and to its process group if it
+// leads one
+func (f *signalForwarder) kill(sig syscall.Signal) {
+	if f.ownGroup {
+		_ = syscall.Kill(-f.pid, sig)
+	} else {
+		_ = syscall.Kill(f.pid, sig)
+	}
+}
+
+// interrupted returns the first terminating signal received, or nil
+func (f *signalForwarder) interrupted() os.Signal {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.caught
+}
+
+// stopped returns the reason the command was stopped before it started,
+// or ""
+func (f *signalForwarder) stopped() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stopReason
+}
+
+// stop restores default signal handling
+func (f *signalForwarder) stop() {
+	signal.Stop(f.ch)
+	close(f.done)
+}
+
+func (f *signalForwarder) loop() {
+	for {
+		select {
+		case sig := <-f.ch:
+			f.handle(sig)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+func (f *signalForwarder) handle(sig os.Signal) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if sig != syscall.SIGWINCH && f.caught == nil {
+		f.caught = sig
+	}
+	if sig == syscall.SIGINT {
+		f.interrupts++
+	}
+	if f.pid == 0 {
+		if sig != syscall.SIGWINCH {
+			fmt.Fprintf(os.Stderr, "emount: received %v. The decrypted volume "+
+				"is still mounted at %s, and will be released before "+
+				"emount exits.\n", sig, f.mountPoint)
+		}
+		return
+	}
+	if sig == syscall.SIGINT && f.interrupts > 1 {
+		fmt.Fprintf(os.Stderr, "emount: interrupted again. Killing command "+
+			"(%s). The decrypted volume is still mounted at %s, "+
+			"and will be released when the command exits.\n",
+			f.target(), f.mountPoint)
+		f.kill(syscall.SIGKILL)
+		return
+	}
+	if !f.ownGroup && ttySignals[sig] {
+		// the terminal sent it to the command too
+		return
+	}
+	f.kill(sig.(syscall.Signal))
+}
+
+// stopCommand sends SIGTERM to the command, and SIGKILL if it's still
+// running after stopGracePeriod. reason is shown to the user. If the command
+// hasn't started yet, the reason is returned by stopped, so the command
+// isn't started, and it's stopped when it starts anyway.
+func (f *signalForwarder) stopCommand(reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pid == 0 {
+		f.stopReason = reason
+		return
+	}
+	f.stopLocked(reason)
+}
+
+// stopLocked is stopCommand for a running command, with f.mu locked
+func (f *signalForwarder) stopLocked(reason string) {
+	pid := f.pid
+	fmt.Fprintf(os.Stderr, "emount: %s. Stopping command (%s), "+
+		"so that the volume at %s can be unmounted.\n", reason, f.target(),
+		f.mountPoint)
+	f.kill(syscall.SIGTERM)
+	time.AfterFunc(stopGracePeriod, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.pid == pid {
+			f.kill(syscall.SIGKILL)
+		}
+	})
+}
+
+// runForwarded runs the command and waits for it to complete, forwarding
+// signals received by emount to the command (see signalForwarder).
+// Parameters and return value are the same as for runCommand. If started is
+// not nil, it's called with the pid of the command after it starts.
+//
+// If emount is in the foreground of a terminal, the command shares emount's
+// process group, the terminal's foreground process group, so that
+// interactive programs can read from the terminal and receive Ctrl-C
+// directly. Otherwise the command runs in its own process group.
+func runForwarded(runCmd []string, env []string, fwd *signalForwarder,
+	started func(pid int, ownGroup bool)) error {
+	cmd := &exec.Cmd{
+		Path:   runCmd[0],
+		Args:   runCmd[:],
+		Env:    env,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	return runForwardedCmd(cmd, fwd, started)
+}
+
+// runForwardedCmd is runForwarded for a prepared command. SysProcAttr may
+// be set, for example to run the command in new namespaces. started gets
+// the pid of the command, and whether it leads its own process group.
+func runForwardedCmd(cmd *exec.Cmd, fwd *signalForwarder,
+	started func(pid int, ownGroup bool)) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	ownGroup := !isForeground(int(os.Stdin.Fd()))
+	cmd.SysProcAttr.Setpgid = ownGroup
+	if err := cmd.Start(); err != nil {
+		return commandExitErr(err)
+	}
+	fwd.setCommand(cmd.Process.Pid, ownGroup)
+	if started != nil {
+		started(cmd.Process.Pid, ownGroup)
+	}
+	err := cmd.Wait()
+	fwd.setCommand(0, false)
+	if err != nil {
+		return commandExitErr(err)
+	}
+	return nil
+}
+
+// isForeground returns true if fd is a terminal and emount's process group
+// is its foreground process group
+func isForeground(fd int) bool {
+	if !terminal.IsTerminal(fd) {
+		return false
+	}
+	var pgid int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgid)))
+	return errno == 0 && int(pgid) == syscall.Getpgrp()
+}
@@ -0,0 +1,96 @@
+// +build !darwin
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTerminalInterrupt runs emount in the foreground of a terminal, where
+// Ctrl-C is sent by the terminal, not by kill
+func TestTerminalInterrupt(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+	cipher, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(cipher)
+	}()
+	okf(t, initCryptVol(cipher, "", nil))
+
+	exe, err := os.Executable()
+	okf(t, err)
+	// the test binary runs emount (see TestMain)
+	cmd := exec.Command(exe, "run", cipher, "--no-agent", "--", "/bin/sh", "-c",
+		"trap '' INT; echo ready; while true; do sleep 0.1; done")
+	master, out := startOnPty(t, cmd)
+	defer master.Close()
+	defer func() {
+		_ = cmd.Process.Kill()
+	}()
+
+	assertf(t, out.waitFor("ready"), "command started", out.String())
+	// the first Ctrl-C goes to the command, which ignores it
+	_, err = master.Write([]byte{3})
+	okf(t, err)
+	time.Sleep(300 * time.Millisecond)
+	assert(t, !strings.Contains(out.String(), "interrupted again"), "first Ctrl-C",
+		out.String())
+	_, err = master.Write([]byte{3})
+	okf(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("emount didn't exit after the second Ctrl-C: %s", out.String())
+	}
+	assert(t, exitCode(commandExitErr(err)) == 128+9, "killed", err)
+	assert(t, out.waitFor("interrupted again. Killing command") &&
+		strings.Contains(out.String(), "still mounted at"), "message", out.String())
+	assert(t, sharedMountPoint(cipher) == "", "unmounted", cipher)
+}
+
+// TestUnmountForeground stops a command that ignores SIGTERM, run in the
+// foreground of a terminal, where it doesn't lead its own process group
+func TestUnmountForeground(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+	cipher, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(cipher)
+	}()
+	okf(t, initCryptVol(cipher, "", nil))
+
+	exe, err := os.Executable()
+	okf(t, err)
+	cmd := exec.Command(exe, "run", cipher, "--no-agent", "--", "/bin/sh", "-c",
+		"trap '' TERM; echo ready; while true; do sleep 0.1; done")
+	master, out := startOnPty(t, cmd)
+	defer master.Close()
+	defer func() {
+		_ = cmd.Process.Kill()
+	}()
+	assertf(t, out.waitFor("ready"), "command started", out.String())
+
+	okf(t, runUnmount(cipher))
+	assert(t, sharedMountPoint(cipher) == "", "unmounted", cipher)
+	_ = cmd.Wait()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// volumeStatus is a volume mounted by emount, as shown by emount status
+type volumeStatus struct {
+	mountState
+	OpenFiles int `json:"openFiles"` // open file handles on the mount, or -1 if unknown
+}
+
+// listMounts returns the volumes mounted by running emount processes,
+// sorted by cipher dir
+func listMounts() ([]volumeStatus, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	stateFiles, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	list := []volumeStatus{}
+	for _, path := range stateFiles {
+		st, err := readStateFile(path)
+		if err != nil || st == nil {
+			continue
+		}
+		// lock, so that the state is not read while it's being replaced,
+		// and users that no longer exist are removed
+		lock, err := lockVolume(st.Cipher)
+		if err != nil {
+			return nil, err
+		}
+		st, err = lock.read()
+		lock.unlock()
+		if err != nil || st == nil || len(st.Users) == 0 || !isMountPoint(st.MountPoint) {
+			continue
+		}
+		n, err := countOpenFiles(resolvePath(st.MountPoint))
+		if err != nil {
+			n = -1
+		}
+		list = append(list, volumeStatus{mountState: *st, OpenFiles: n})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Cipher < list[j].Cipher
+	})
+	return list, nil
+}
+
+// printStatus writes the list of mounted volumes as text, or as JSON
+func printStatus(w io.Writer, list []volumeStatus, asJSON bool) error {
+	if asJSON {
+		data, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+	if len(list) == 0 {
+		_, err := fmt.Fprintln(w, "No volumes are mounted by emount")
+		return err
+	}
+	for i, v := range list {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		var users []string
+		for _, u := range v.Users {
+			if u.CmdPID != 0 {
+				users = append(users, fmt.Sprintf("%d (command %d)", u.PID, u.CmdPID))
+			} else {
+				users = append(users, fmt.Sprintf("%d", u.PID))
+			}
+		}
+		openFiles := "unknown"
+		if v.OpenFiles >= 0 {
+			openFiles = fmt.Sprintf("%d", v.OpenFiles)
+		}
+		fmt.Fprintf(w, "%s\n", v.Cipher)
+		fmt.Fprintf(w, "  mount point:  %s\n", v.MountPoint)
+		fmt.Fprintf(w, "  mounted at:   %s\n", v.MountedAt.Format(time.RFC1123))
+		fmt.Fprintf(w, "  emount pid:   %s\n", strings.Join(users, ", "))
+		fmt.Fprintf(w, "  open files:   %s\n", openFiles)
+	}
+	return nil
+}
+
+// showStatus implements emount status
+func showStatus(asJSON bool) error {
+	list, err := listMounts()
+	if err != nil {
+		return err
+	}
+	return printStatus(os.Stdout, list, asJSON)
+}
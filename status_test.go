@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+
+	defer setTestRuntimeDir(t)()
+
+	// generate random password of about 31-32 hex chars
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	newCrypt, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(newCrypt)
+	}()
+	okf(t, initCryptVol(newCrypt, "", nil))
+
+	list, err := listMounts()
+	okf(t, err)
+	assert(t, len(list) == 0, "nothing mounted", list)
+	var buf bytes.Buffer
+	ok(t, printStatus(&buf, list, true))
+	assert(t, strings.TrimSpace(buf.String()) == "[]", "empty json", buf.String())
+
+	vol, err := acquireMount(newCrypt, "", nil)
+	okf(t, err)
+	defer func() {
+		_, _ = vol.release()
+	}()
+	ok(t, vol.setCommandPID(1234, true))
+	f, err := os.Create(filepath.Join(vol.mountPoint, "open.txt"))
+	okf(t, err)
+	defer f.Close()
+
+	list, err = listMounts()
+	okf(t, err)
+	assertf(t, len(list) == 1, "one mount", list)
+	v := list[0]
+	assert(t, v.Cipher == vol.cipher && v.MountPoint == vol.mountPoint,
+		"volume", v)
+	assert(t, len(v.Users) == 1 && v.Users[0].PID == os.Getpid() &&
+		v.Users[0].CmdPID == 1234, "users", v.Users)
+	assert(t, v.OpenFiles == 1, "open files", v.OpenFiles)
+
+	buf.Reset()
+	ok(t, printStatus(&buf, list, true))
+	var decoded []volumeStatus
+	ok(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert(t, len(decoded) == 1 && decoded[0].MountPoint == vol.mountPoint &&
+		decoded[0].OpenFiles == 1, "json", buf.String())
+
+	buf.Reset()
+	ok(t, printStatus(&buf, list, false))
+	assert(t, strings.Contains(buf.String(), vol.mountPoint) &&
+		strings.Contains(buf.String(), "(command 1234)"), "text", buf.String())
+}
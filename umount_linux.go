@@ -27,7 +27,7 @@ func unmountVol(path string) error {
 	if e1 != nil {
 		// however, fusermount is installed with suid bit
 		// try with fusermount -u
-		env := os.Environ()[:]
+		env := filterEnv(os.Environ(), nil, nil)
 		fusermount, err := exec.LookPath("fusermount")
 		if err == nil {
 			e2 := runCommand([]string{fusermount, "-u", path}, env)
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// unmountPoll is how often emount unmount checks whether the volume has
+// been released
+const unmountPoll = 100 * time.Millisecond
+
+// findMount returns the state of the volume mounted by emount whose
+// encrypted folder or mount point is path, or nil
+func findMount(path string) (*mountState, error) {
+	path = resolvePath(path)
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	stateFiles, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, sf := range stateFiles {
+		st, err := readStateFile(sf)
+		if err != nil || st == nil {
+			continue
+		}
+		if resolvePath(st.Cipher) == path || resolvePath(st.MountPoint) == path {
+			return st, nil
+		}
+	}
+	return nil, nil
+}
+
+// runUnmount implements emount unmount. The emount processes using the
+// volume get SIGTERM, which they forward to their commands, and the last
+// one to exit unmounts the volume. Commands still running after
+// stopGracePeriod are killed.
+func runUnmount(target string) error {
+	st, err := findMount(target)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		return fmt.Errorf("%s is not mounted by emount", target)
+	}
+	lock, err := lockVolume(st.Cipher)
+	if err != nil {
+		return err
+	}
+	st, err = lock.read()
+	lock.unlock()
+	if err != nil {
+		return err
+	}
+	if st == nil || !isMountPoint(st.MountPoint) {
+		return fmt.Errorf("%s is not mounted by emount", target)
+	}
+
+	if len(st.Users) == 0 {
+		// left mounted by an emount process that no longer exists
+		res := &cleanupResult{}
+		mounted := map[string]bool{resolvePath(st.MountPoint): true}
+		if err = cleanupVolume(st.Cipher, mounted, map[string]bool{}, true, res); err != nil {
+			return err
+		}
+		for _, line := range res.report {
+			fmt.Println(line)
+		}
+		if res.failed > 0 {
+			return newExitErr(exitUnmount, fmt.Errorf("%s is still mounted at %s",
+				st.Cipher, st.MountPoint))
+		}
+		return nil
+	}
+
+	// the agent releases the volume when asked, instead of being stopped
+	resp, err := callAgent(&agentRequest{Op: agentLock, Cipher: st.Cipher})
+	if err == nil && len(resp.Volumes) > 0 {
+		if resp.Volumes[0].Unmounted {
+			fmt.Printf("Unmounted %s\n", st.MountPoint)
+			return nil
+		}
+		lock, err := lockVolume(st.Cipher)
+		if err != nil {
+			return err
+		}
+		st, err = lock.read()
+		lock.unlock()
+		if err != nil {
+			return err
+		}
+		if st == nil {
+			fmt.Printf("Unmounted %s\n", resp.Volumes[0].MountPoint)
+			return nil
+		}
+	}
+
+	fmt.Printf("Stopping %d emount process(es) using %s\n", len(st.Users), st.MountPoint)
+	for _, u := range st.Users {
+		_ = syscall.Kill(u.PID, syscall.SIGTERM)
+	}
+	if waitReleased(st.Cipher, stopGracePeriod) {
+		fmt.Printf("Unmounted %s\n", st.MountPoint)
+		return nil
+	}
+	for _, u := range st.Users {
+		if u.CmdPID == 0 || !processAlive(u.PID) {
+			continue
+		}
+		// the command leads its own process group, unless emount runs in
+		// the foreground of a terminal
+		if u.CmdGroup {
+			fmt.Printf("Killing command (process group %d)\n", u.CmdPID)
+			_ = syscall.Kill(-u.CmdPID, syscall.SIGKILL)
+		} else {
+			fmt.Printf("Killing command (pid %d)\n", u.CmdPID)
+			_ = syscall.Kill(u.CmdPID, syscall.SIGKILL)
+		}
+	}
+	if waitReleased(st.Cipher, stopGracePeriod) {
+		fmt.Printf("Unmounted %s\n", st.MountPoint)
+		return nil
+	}
+	return newExitErr(exitUnmount, fmt.Errorf("%s is still mounted at %s. "+
+		"Run 'emount status' to see the processes using it", st.Cipher, st.MountPoint))
+}
+
+// waitReleased waits until the volume is no longer mounted by emount,
+// or the timeout. Returns true if it was unmounted.
+func waitReleased(cipher string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		lock, err := lockVolume(cipher)
+		if err != nil {
+			return false
+		}
+		st, err := lock.read()
+		lock.unlock()
+		if err == nil && st == nil {
+			return true
+		}
+		if err == nil && len(st.Users) == 0 {
+			// the last emount process exited, but could not unmount
+			return !isMountPoint(st.MountPoint)
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(unmountPoll)
+	}
+}
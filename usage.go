@@ -1,14 +1,18 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 )
 
 type usageErr struct {
 	message string
+	command *command // if not nil, the help of the command is shown
 }
 
 func (e *usageErr) Error() string {
@@ -26,126 +30,288 @@ func isUsageErr(e error) bool {
 	return ok
 }
 
+// errHelp is returned by parseArgs after help was shown
+var errHelp = errors.New("help requested")
+
+// showUsageErr shows the help for a usage error
+func showUsageErr(err error) {
+	if e, ok := err.(*usageErr); ok && e.command != nil {
+		showCommandHelp(e.command)
+		return
+	}
+	showUsage()
+}
+
 func showUsage() {
 
 	// prog is the name of the program invoked
 	//prog := path.Base(os.Args[0])
 
-	usage := `Usage:
-emount --init FOLDER [--from srcFolder]
-  Initialize a new encrypted volume at FOLDER. Either the path FOLDER must not exist
-  or it must be an empty directory. If srcFolder is specified, the volume is
-  populated with a recursive copy from the source folder.
+	var cmds strings.Builder
+	for _, c := range commands {
+		fmt.Fprintf(&cmds, "  %-30s %s\n", c.name+" "+c.args, c.summary)
+	}
+	fmt.Fprintf(&cmds, "  %-30s %s", "help [COMMAND]", "Show the help for a command")
 
-  The user is prompted to enter a new password, and the password is rejected
-  if it is too weak (according to the minEntropy setting in emount.go)
+	usage := `Usage: emount COMMAND [flags] [args...]
 
-emount --run FOLDER [--mount mountpoint] command args...
-  Run the command (with optional arguments), providing access to decrypted FOLDER
-  mounted in a temporary location. When the command completes, the decrypted volume
-  is unmounted. The 'command' term should be a program in your PATH
-  or an absolute path to an executable.
+Commands:
+` + cmds.String() + `
 
-  The default mount point is a dynamically-created temporary folder (inside TMPDIR),
-  owned by the calling user with permission mode 0700. The dynamic folder name
-  is passed to the command executable through the environment variable EMOUNT_FOLDER.
+VOLUME is an encrypted folder, or the name of a volume profile in the config
+file. Flags may be given before or after VOLUME. Run 'emount help COMMAND'
+for the description and flags of a command.
 
-  The default mount point can be overridden by the --mount/-m flag.
-  
 For automation or to avoid interactive prompting for password, the encryption
-password can be provided via the environment variable EMOUNT_PASSWORD.
+password can be provided via the environment variable EMOUNT_PASSWORD, or
+by one of these password sources:
+  --passfd N         read the password from the first line of file descriptor N
+                     (one line for each volume that needs a password)
+  --passfile PATH    read the password from the first line of the file
+  --extpass "CMD"    run CMD (split on spaces, no shell) and use the first line
+                     of its output
+Otherwise the password is prompted on the terminal (/dev/tty), so stdin
+can be piped to the command. If there is no terminal, for example when emount
+is started from a desktop launcher, and DISPLAY or WAYLAND_DISPLAY is set,
+a graphical prompt is used: a graphical pinentry, zenity, kdialog, or
+ssh-askpass, whichever is installed first.
+  --askpass BACKEND  select the prompt: auto (default), tty, pinentry,
+                     zenity, kdialog, or ssh-askpass. Default $EMOUNT_ASKPASS
+  --pinentry PROG    pinentry program. Default $EMOUNT_PINENTRY
+
+With --keyring, the password is stored in the desktop keyring (the freedesktop
+Secret Service, e.g., gnome-keyring or KWallet). init --keyring and
+passwd --keyring store the new password. run --keyring uses the stored
+password if there is one, otherwise it gets the password as usual and stores
+it after the volume is mounted.
+
+Configuration file: $XDG_CONFIG_HOME/emount/config.toml (by default
+~/.config/emount/config.toml), or --config PATH. Global settings:
+min_entropy, dir_mode, and tmp_folder_pattern. Profiles are tables named
+[profile.NAME] with the settings: cipher, mount, command, passfile, extpass,
+askpass, pinentry, keyring, env_allow, env_deny, idle_timeout, private,
+and min_entropy.
+
+The flags of earlier versions still work: emount --init FOLDER,
+--passwd FOLDER, --run FOLDER command args..., --profile NAME, --cleanup,
+and --status are the same as the init, passwd, run, cleanup, and status
+commands.
+
+Exit status: for run, the exit status of the command (128+signal if it was
+killed by a signal). Otherwise: 1 general error, 2 usage error, 121 password
+error, 122 mount or mount hook failed, 123 unmount failed, 126 command could
+not be started.
 `
 	fmt.Println(usage)
 }
 
+// parseArgs parses the command line: a subcommand (emount run ...), or the
+// older flags (emount --run ...), which are kept for compatibility
 func parseArgs(opt *options) error {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		return parseCommand(opt, os.Args[1:])
+	}
+	return parseLegacyArgs(opt)
+}
+
+// parseLegacyArgs parses the flag-based command line, where the operation
+// is selected by one of --run, --init, --passwd, --cleanup, or --status
+func parseLegacyArgs(opt *options) error {
+
+	opt.pass = newPasswordSource()
 
-	flag.StringVar(&opt.run, "run", "", "run command")
-	flag.StringVar(&opt.run, "r", "", "run command (shorthand)")
+	flag.Var(&runFolders{opt}, "run", "run command (may be repeated for more volumes)")
+	flag.Var(&runFolders{opt}, "r", "run command (shorthand)")
 	flag.StringVar(&opt.init, "init", "", "initialize a new folder")
 	flag.StringVar(&opt.init, "i", "", "initialize a new folder (shorthand)")
+	flag.StringVar(&opt.passwd, "passwd", "", "change password of folder")
+	flag.BoolVar(&opt.cleanup, "cleanup", false, "clean up stale mounts")
+	flag.BoolVar(&opt.status, "status", false, "list mounted volumes")
+	flag.BoolVar(&opt.json, "json", false, "--status output as JSON")
 	flag.StringVar(&opt.srcFolder, "from", "", "folder to copy from")
 	flag.StringVar(&opt.srcFolder, "f", "", "folder to copy from (shorthand)")
 	flag.BoolVar(&opt.verbose, "v", false, "show progress messages")
-	flag.StringVar(&opt.mountPoint, "mount", "",
-		"mount point for decrypted content")
-	flag.StringVar(&opt.mountPoint, "m", "",
-		"mount point for decrypted content (shorthand)")
+	passwordFlags(flag.CommandLine, opt)
+	runFlags(flag.CommandLine, opt)
+	configFlag(flag.CommandLine, opt)
+	flag.StringVar(&opt.profile, "profile", "", "run the volume profile from the config file")
 	flag.Parse()
 
-	// exactly one of run or init
-	if (opt.run != "" && opt.init != "") || (opt.run == "" && opt.init == "") {
-		return newUsageErr(
-			"One of the flags (--run/-r) or (--init/-i) must be specified.")
+	cfg, err := loadConfig(opt.config)
+	if err != nil {
+		return err
 	}
-
-	if opt.init != "" {
-		cf := checkFolder(opt.init)
-		if cf == isNotDir {
-			return fmt.Errorf("invalid init path: not a directory %v", opt.init)
+	if err = cfg.applyDefaults(); err != nil {
+		return err
+	}
+	opt.runCmd = flag.Args()
+	if opt.profile != "" {
+		if opt.init != "" || opt.passwd != "" || opt.cleanup || opt.status {
+			return newUsageErr("--profile is only used to run a volume")
 		}
-		if cf == isDir {
-			if err := checkEmptyDir(opt.init); err != nil {
-				return err
-			}
-		} else {
-			if err := os.MkdirAll(opt.init, 0700); err != nil {
-				return fmt.Errorf("creating init path %s: %v", opt.init, err)
-			}
+		p, err := cfg.profile(opt.profile)
+		if err != nil {
+			return err
 		}
-		if opt.srcFolder != "" {
-			if cf := checkFolder(opt.srcFolder); cf != isDir {
-				return fmt.Errorf("init from srcFolder %s invalid", opt.srcFolder)
-			}
+		p.apply(opt, setFlags(flag.CommandLine))
+	}
+
+	// exactly one of run, init, passwd, cleanup, or status
+	modes := 0
+	for _, m := range []string{opt.run, opt.init, opt.passwd} {
+		if m != "" {
+			modes++
 		}
+	}
+	for _, m := range []bool{opt.cleanup, opt.status} {
+		if m {
+			modes++
+		}
+	}
+	if modes != 1 {
+		return newUsageErr("One of the flags (--run/-r), (--init/-i), " +
+			"(--passwd), (--cleanup), or (--status) must be specified.")
+	}
+	if (opt.cleanup || opt.status) && flag.NArg() > 0 {
+		return newUsageErr("--cleanup and --status do not take arguments")
+	}
+	if opt.json && !opt.status {
+		return newUsageErr("--json is only used with --status")
+	}
+	if err := opt.pass.validate(); err != nil {
+		return err
+	}
+
+	if opt.init != "" {
 		if opt.mountPoint != "" {
 			return fmt.Errorf("mountPoint arg is not used with init")
 		}
+		if len(opt.envAllow) > 0 || len(opt.envDeny) > 0 {
+			return fmt.Errorf("the --env-allow/--env-deny flags are not used with init")
+		}
+		if opt.idleTimeout != 0 || opt.private {
+			return fmt.Errorf("--idle-timeout and --private are not used with init")
+		}
+		return checkInitArgs(opt)
 	}
 
-	// run command validation
-	if opt.run != "" {
-
-		if checkFolder(opt.run) != isDir {
-			return fmt.Errorf("invalid run folder %s", opt.run)
+	if opt.passwd != "" {
+		if opt.srcFolder != "" || opt.mountPoint != "" ||
+			len(opt.envAllow) > 0 || len(opt.envDeny) > 0 || opt.idleTimeout != 0 ||
+			opt.private {
+			return newUsageErr("--passwd does not use --from, --mount, " +
+				"--env-allow, --env-deny, --idle-timeout, or --private")
 		}
+		return checkPasswdArgs(opt)
+	}
+
+	if opt.run != "" {
 		if opt.srcFolder != "" {
 			return fmt.Errorf("the -f srcFolder is not used with --run")
 		}
+		return checkRunArgs(opt)
+	}
+	return nil
+}
 
-		// if mount point specified, it should already exist and be empty
-		if opt.mountPoint != "" {
-			if err := checkEmptyDir(opt.mountPoint); err != nil {
-				return fmt.Errorf("Mountpoint %s error: %v", opt.mountPoint, err)
-			}
+// checkInitArgs validates the folders for init. The volume folder is
+// created if it doesn't exist.
+func checkInitArgs(opt *options) error {
+	cf := checkFolder(opt.init)
+	if cf == isNotDir {
+		return fmt.Errorf("invalid init path: not a directory %v", opt.init)
+	}
+	if cf == isDir {
+		if err := checkEmptyDir(opt.init); err != nil {
+			return err
 		}
-
-		if opt.mountPoint == opt.run {
-			return fmt.Errorf("mountPoint may not be same as run folder")
+	} else {
+		if err := os.MkdirAll(opt.init, 0700); err != nil {
+			return fmt.Errorf("creating init path %s: %v", opt.init, err)
 		}
+	}
+	if opt.srcFolder != "" {
+		if cf := checkFolder(opt.srcFolder); cf != isDir {
+			return fmt.Errorf("init from srcFolder %s invalid", opt.srcFolder)
+		}
+	}
+	return nil
+}
 
-		opt.runCmd = flag.Args()
-		if len(opt.runCmd) == 0 {
-			// check that command[0] is a valid binary, or in the PATH
-			return newUsageErr("Command required for -run")
+// checkPasswdArgs validates the folder for passwd
+func checkPasswdArgs(opt *options) error {
+	if checkFolder(opt.passwd) != isDir {
+		return fmt.Errorf("invalid passwd folder %s", opt.passwd)
+	}
+	return nil
+}
+
+// checkRunArgs validates the folder, mount point, and command for run.
+// The command is looked up in the PATH.
+func checkRunArgs(opt *options) error {
+	if checkFolder(opt.run) != isDir {
+		return fmt.Errorf("invalid run folder %s", opt.run)
+	}
+	if opt.idleTimeout < 0 {
+		return newUsageErr("--idle-timeout may not be negative")
+	}
+
+	if err := checkMountPoint(opt.run, opt.mountPoint); err != nil {
+		return err
+	}
+	if err := checkVolumes(opt); err != nil {
+		return err
+	}
+	if opt.private && !opt.hooks.empty() {
+		return newUsageErr("the mount hooks can't be used with --private")
+	}
+	if opt.private && opt.lockSuspend {
+		return newUsageErr("--lock-on-suspend can't be used with --private")
+	}
+	vols := opt.runVolumes()
+	if _, err := expandArgs(opt.runCmd, vols, make([]string, len(vols))); err != nil {
+		return err
+	}
+
+	if len(opt.runCmd) == 0 {
+		// check that command[0] is a valid binary, or in the PATH
+		return newUsageErr("Command required for -run")
+	}
+	runExePath := opt.runCmd[0]
+	reInfo, err := os.Stat(runExePath)
+	if err != nil {
+		// see if we can find it with path lookup
+		foundPath, err := exec.LookPath(runExePath)
+		if err == nil && foundPath != runExePath {
+			opt.runCmd[0] = foundPath
+			return nil
 		}
-		runExePath := opt.runCmd[0]
-		reInfo, err := os.Stat(runExePath)
-		if err != nil {
-			// see if we can find it with path lookup
-			foundPath, err := exec.LookPath(runExePath)
-			if err == nil && foundPath != runExePath {
-				opt.runCmd[0] = foundPath
-				return nil
+		return fmt.Errorf("run program %s not found: %v", runExePath, err)
+	}
+	mode := reInfo.Mode()
+	if !mode.IsRegular() || ((mode & 0111) == 0) {
+		return fmt.Errorf(
+			"run program %s permission error or not executable: %v",
+			runExePath, err)
+	}
+	return nil
+}
+
+// checkMountPoint validates the mount point of a volume for run. If it's
+// specified, it should already exist and be empty, unless another emount
+// process has the volume mounted there.
+func checkMountPoint(cipher string, mountPoint string) error {
+	if mountPoint != "" {
+		if err := checkEmptyDir(mountPoint); err != nil {
+			abs, _ := filepath.Abs(mountPoint)
+			if mp := sharedMountPoint(cipher); mp == "" || mp != abs {
+				return fmt.Errorf("Mountpoint %s error: %v", mountPoint, err)
 			}
-			return fmt.Errorf("run program %s not found: %v", runExePath, err)
-		}
-		mode := reInfo.Mode()
-		if !mode.IsRegular() || ((mode & 0111) == 0) {
-			return fmt.Errorf(
-				"run program %s permission error or not executable: %v",
-				runExePath, err)
 		}
 	}
+
+	if mountPoint == cipher {
+		return fmt.Errorf("mountPoint may not be same as run folder")
+	}
 	return nil
 }
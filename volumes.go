@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Several volumes can be mounted for one command: the run volume, and
+// more volumes from --volume, repeated --run flags, or the volume tables
+// of a profile:
+//
+//	[[profile.app.volume]]
+//	name = "secrets"
+//	cipher = "~/secrets.enc"
+//
+// Each volume has its own mount point, which is passed to the command in
+// EMOUNT_FOLDER_<NAME>. The volumes are mounted in order before the command
+// starts, and unmounted in reverse order.
+
+// volume is an extra volume mounted for run
+type volume struct {
+	Name   string `toml:"name"`   // if empty, from the folder name
+	Cipher string `toml:"cipher"` // encrypted folder
+	Mount  string `toml:"mount"`  // if empty, a temp dir is used
+}
+
+// parseVolume parses a --volume value, [NAME=]FOLDER[:MOUNT]
+func parseVolume(spec string) (volume, error) {
+	var v volume
+	folder := spec
+	if i := strings.Index(folder, "="); i > 0 && validVolumeName(folder[:i]) {
+		v.Name, folder = folder[:i], folder[i+1:]
+	}
+	if i := strings.Index(folder, ":"); i >= 0 {
+		folder, v.Mount = folder[:i], folder[i+1:]
+	}
+	v.Cipher = folder
+	if v.Cipher == "" {
+		return v, newUsageErr(fmt.Sprintf("invalid volume %q: expected "+
+			"[NAME=]FOLDER[:MOUNT]", spec))
+	}
+	return v, nil
+}
+
+// validVolumeName returns true if the name has only letters, digits,
+// '_', and '-'
+func validVolumeName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// envName returns the environment variable with the mount point of the
+// volume: EMOUNT_FOLDER_ and the name in upper case, where characters other
+// than letters and digits are replaced by '_'. Without a name, the name of
+// the folder without its extension is used, e.g., EMOUNT_FOLDER_JOPLIN for
+// joplin.enc.
+func (v *volume) envName() string {
+	name := v.Name
+	if name == "" {
+		name = filepath.Base(filepath.Clean(v.Cipher))
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return envFolderKey + "_" + strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z':
+			return c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			return c
+		}
+		return '_'
+	}, name)
+}
+
+// volumeList is a flag.Value for --volume. The flag may be repeated.
+type volumeList []volume
+
+func (l *volumeList) String() string {
+	var specs []string
+	for _, v := range *l {
+		specs = append(specs, v.Cipher)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (l *volumeList) Set(value string) error {
+	v, err := parseVolume(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, v)
+	return nil
+}
+
+// runFolders is a flag.Value for --run in the older command line. The
+// first --run is the run volume, and a repeated --run adds a volume, with
+// the same syntax as --volume.
+type runFolders struct {
+	opt *options
+}
+
+func (f *runFolders) String() string {
+	if f.opt == nil {
+		return ""
+	}
+	return f.opt.run
+}
+
+func (f *runFolders) Set(value string) error {
+	if f.opt.run == "" {
+		f.opt.run = value
+		return nil
+	}
+	return (*volumeList)(&f.opt.volumes).Set(value)
+}
+
+// runVolumes returns the volumes of run: the run volume, with the mount
+// point from --mount, and the extra volumes
+func (opt *options) runVolumes() []volume {
+	return append([]volume{{Cipher: opt.run, Mount: opt.mountPoint}},
+		opt.volumes...)
+}
+
+// volumeEnv returns the variables with the mount points of the volumes:
+// EMOUNT_FOLDER, and EMOUNT_FOLDER_<NAME> for each volume if there are
+// several
+func volumeEnv(vols []volume, mountPoints []string) []string {
+	env := []string{fmt.Sprintf("%s=%s", envFolderKey, mountPoints[0])}
+	if len(vols) > 1 {
+		for i, v := range vols {
+			env = append(env, fmt.Sprintf("%s=%s", v.envName(), mountPoints[i]))
+		}
+	}
+	return env
+}
+
+// selectVolumes returns the volumes, and their mount points, for which
+// selected is true
+func selectVolumes(vols []volume, mountPoints []string,
+	selected []bool) ([]volume, []string) {
+
+	var sv []volume
+	var sm []string
+	for i, ok := range selected {
+		if ok {
+			sv = append(sv, vols[i])
+			sm = append(sm, mountPoints[i])
+		}
+	}
+	return sv, sm
+}
+
+// checkVolumes validates the extra volumes of run. The folders must be
+// different, and so must their mount points and variable names.
+func checkVolumes(opt *options) error {
+	if len(opt.volumes) == 0 {
+		return nil
+	}
+	if opt.private {
+		return newUsageErr("--private can't be used with more than one volume")
+	}
+	ciphers := make(map[string]bool)
+	mounts := make(map[string]bool)
+	names := make(map[string]bool)
+	for i, v := range opt.runVolumes() {
+		if i > 0 {
+			if checkFolder(v.Cipher) != isDir {
+				return fmt.Errorf("invalid volume folder %s", v.Cipher)
+			}
+			if err := checkMountPoint(v.Cipher, v.Mount); err != nil {
+				return err
+			}
+		}
+		abs, err := filepath.Abs(v.Cipher)
+		if err != nil {
+			return err
+		}
+		if ciphers[abs] {
+			return newUsageErr(fmt.Sprintf("volume %s is listed twice", v.Cipher))
+		}
+		ciphers[abs] = true
+		if v.Mount != "" {
+			if abs, err = filepath.Abs(v.Mount); err != nil {
+				return err
+			}
+			if mounts[abs] {
+				return newUsageErr(fmt.Sprintf("mount point %s is used by "+
+					"more than one volume", v.Mount))
+			}
+			mounts[abs] = true
+		}
+		name := v.envName()
+		if names[name] {
+			return newUsageErr(fmt.Sprintf("two volumes would use the "+
+				"variable %s. Give them names with --volume NAME=FOLDER, or "+
+				"in the profile", name))
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// mountVolumes mounts the volumes in order. If one can't be mounted, the
+// ones already mounted are released in reverse order, and the error is
+// returned.
+func mountVolumes(vols []volume, pass *passwordSource,
+	verbose bool) ([]*sharedMount, error) {
+
+	var mounts []*sharedMount
+	for _, v := range vols {
+		prompt := "Enter encryption passphrase: "
+		if len(vols) > 1 {
+			prompt = fmt.Sprintf("Enter encryption passphrase for %s: ", v.Cipher)
+		}
+		m, err := acquireMountPrompt(v.Cipher, v.Mount, pass, prompt)
+		if err != nil {
+			if len(vols) > 1 {
+				err = newExitErr(exitCode(err), fmt.Errorf("volume %s: %v",
+					v.Cipher, err))
+			}
+			if len(mounts) > 0 && verbose {
+				fmt.Printf("Releasing the volumes already mounted\n")
+			}
+			_, _ = releaseVolumes(mounts, verbose)
+			return nil, err
+		}
+		if verbose {
+			if m.mounted {
+				fmt.Printf("Mounted %s on %s\n", v.Cipher, m.mountPoint)
+			} else {
+				fmt.Printf("Using %s, already mounted on %s\n", v.Cipher,
+					m.mountPoint)
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// releaseVolumes releases the volumes in reverse order. A volume that
+// can't be unmounted is reported, and the others are still released.
+// Returns whether each volume was unmounted, and the first error.
+func releaseVolumes(mounts []*sharedMount, verbose bool) ([]bool, error) {
+	var firstErr error
+	released := make([]bool, len(mounts))
+	for i := len(mounts) - 1; i >= 0; i-- {
+		vol := mounts[i]
+		unmounted, err := vol.release()
+		released[i] = unmounted
+		if err != nil {
+			printUnmountWarning(vol.mountPoint)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if verbose {
+			if unmounted {
+				fmt.Printf("Unmounted %s\n", vol.mountPoint)
+			} else {
+				fmt.Printf("%s is still in use by another emount process\n",
+					vol.mountPoint)
+			}
+		}
+	}
+	return released, firstErr
+}
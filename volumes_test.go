@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseVolume(t *testing.T) {
+	for spec, want := range map[string]volume{
+		"/a/b.enc":               {Cipher: "/a/b.enc"},
+		"keys=/a/b.enc":          {Name: "keys", Cipher: "/a/b.enc"},
+		"keys=/a/b.enc:/mnt/x":   {Name: "keys", Cipher: "/a/b.enc", Mount: "/mnt/x"},
+		"/a/x=y.enc":             {Cipher: "/a/x=y.enc"},
+		"my-keys=rel/dir:../mnt": {Name: "my-keys", Cipher: "rel/dir", Mount: "../mnt"},
+	} {
+		v, err := parseVolume(spec)
+		ok(t, err)
+		assert(t, v == want, spec, v)
+	}
+	_, err := parseVolume("keys=:/mnt")
+	assert(t, isUsageErr(err), "no folder", err)
+
+	v := volume{Cipher: "/a/shared-secrets.enc/"}
+	assert(t, v.envName() == "EMOUNT_FOLDER_SHARED_SECRETS", "from folder", v.envName())
+	v.Name = "keys"
+	assert(t, v.envName() == "EMOUNT_FOLDER_KEYS", "from name", v.envName())
+}
+
+func TestRunVolumes(t *testing.T) {
+
+	sav := flag.CommandLine
+	defer func() {
+		flag.CommandLine = sav
+	}()
+	defer setTestRuntimeDir(t)()
+	password := fmt.Sprintf("%x%x", rand.Int63(), rand.Int63())
+	os.Setenv("EMOUNT_PASSWORD", password)
+	defer os.Unsetenv("EMOUNT_PASSWORD")
+
+	dir, err := ioutil.TempDir("", testDirPrefix)
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	src, err := createTestData()
+	okf(t, err)
+	defer func() {
+		_ = os.RemoveAll(src)
+	}()
+	app := filepath.Join(dir, "app.enc")
+	secrets := filepath.Join(dir, "secrets.enc")
+	okf(t, initCryptVol(app, "", nil))
+	okf(t, initCryptVol(secrets, src, nil))
+
+	// the older flags: a repeated --run adds a volume
+	flag.CommandLine = flag.NewFlagSet("prog", flag.ContinueOnError)
+	os.Args = []string{"prog", "--run", app, "--run", "keys=" + secrets, "/bin/true"}
+	opt := &options{}
+	okf(t, parseArgs(opt))
+	assert(t, opt.run == app && len(opt.volumes) == 1 &&
+		opt.volumes[0].Name == "keys", "repeated --run", opt.volumes)
+
+	opt = &options{}
+	err = parseCommand(opt, []string{"run", app, "--volume", app, "/bin/true"})
+	assert(t, isUsageErr(err), "same volume twice", err)
+	err = parseCommand(opt, []string{"run", app, "--private",
+		"--volume", secrets, "/bin/true"})
+	assert(t, isUsageErr(err), "--private", err)
+
+	// each volume has its own variable, and the command sees both
+	tf := getTestFileInfo()[0]
+	out := filepath.Join(dir, "out")
+	opt = &options{}
+	okf(t, parseCommand(opt, []string{"run", app, "--volume", secrets, "--",
+		"/bin/sh", "-c", `cp "$EMOUNT_FOLDER_SECRETS` + tf.name + `" "$EMOUNT_FOLDER_APP"` +
+			` && test "$EMOUNT_FOLDER" = {mount:app} && ls {mount} > ` + out}))
+	okf(t, decryptAndRun(opt))
+	data, err := ioutil.ReadFile(out)
+	okf(t, err)
+	assert(t, string(data) == filepath.Base(tf.name)+"\n", "copied between volumes",
+		string(data))
+	assert(t, sharedMountPoint(app) == "" && sharedMountPoint(secrets) == "",
+		"unmounted", nil)
+
+	// if a volume can't be mounted, the ones mounted before are released
+	notVolume := filepath.Join(dir, "empty")
+	okf(t, os.Mkdir(notVolume, 0700))
+	err = decryptAndRun(&options{
+		run:     app,
+		volumes: []volume{{Cipher: secrets}, {Cipher: notVolume}},
+		runCmd:  []string{"/bin/true"},
+		pass:    newPasswordSource(),
+	})
+	assert(t, exitCode(err) == exitMount, "mount failed", err)
+	assert(t, sharedMountPoint(app) == "" && sharedMountPoint(secrets) == "",
+		"rolled back", nil)
+}